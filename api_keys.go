@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/throttled/throttled/v2"
+	"github.com/throttled/throttled/v2/store/memstore"
+)
+
+type apiKeyContextKey struct{}
+
+// APIKey defines an API key with its own scopes and limits, as defined in the API keys file.
+// Empty scopes allow everything.
+type APIKey struct {
+	Name            string            `json:"name"`
+	Key             string            `json:"key"`
+	Endpoints       []string          `json:"endpoints"`
+	Sources         []ImageSourceType `json:"sources"`
+	AllowedOrigins  []string          `json:"allowedOrigins"`
+	MaxOutputWidth  int               `json:"maxOutputWidth"`
+	MaxOutputHeight int               `json:"maxOutputHeight"`
+	MaxOutputPixels int               `json:"maxOutputPixels"`
+	RateLimit       int               `json:"rateLimit"`
+	Burst           int               `json:"burst"`
+
+	origins []*url.URL
+	limiter throttled.RateLimiter
+}
+
+// APIKeys stores the API keys loaded from the API keys file, indexed by their digest.
+type APIKeys struct {
+	keys map[[sha256.Size]byte]*APIKey
+}
+
+// LoadAPIKeys reads the API keys from a JSON file, such as:
+//
+//	[{"name": "frontend", "key": "...", "endpoints": ["resize"], "sources": ["http"], "rateLimit": 10}]
+func LoadAPIKeys(path string) (*APIKeys, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseAPIKeys(buf)
+}
+
+// ParseAPIKeys parses and validates the JSON list of API keys.
+func ParseAPIKeys(buf []byte) (*APIKeys, error) {
+	var list []*APIKey
+	if err := json.Unmarshal(buf, &list); err != nil {
+		return nil, err
+	}
+
+	keys := &APIKeys{keys: make(map[[sha256.Size]byte]*APIKey, len(list))}
+	names := map[string]bool{}
+	for i, key := range list {
+		if key.Name == "" {
+			return nil, fmt.Errorf("API key %d has empty name", i)
+		}
+		if names[key.Name] {
+			return nil, fmt.Errorf("duplicate API key name: %s", key.Name)
+		}
+		names[key.Name] = true
+
+		if len(key.Key) < 16 {
+			return nil, fmt.Errorf("API key %s must be a minimum of 16 characters", key.Name)
+		}
+		digest := sha256.Sum256([]byte(key.Key))
+		if _, exists := keys.keys[digest]; exists {
+			return nil, fmt.Errorf("duplicate API key: %s", key.Name)
+		}
+
+		for i, endpoint := range key.Endpoints {
+			key.Endpoints[i] = strings.ToLower(strings.TrimPrefix(endpoint, "/"))
+		}
+		for _, source := range key.Sources {
+			if !IsSourceRegistered(source) {
+				return nil, fmt.Errorf("API key %s has unknown image source: %s", key.Name, source)
+			}
+		}
+		for _, origin := range key.AllowedOrigins {
+			origins := parseOrigins(origin)
+			if len(origins) != 1 || len(origins[0].Host) < 2 {
+				return nil, fmt.Errorf("API key %s has invalid allowed origin: %s", key.Name, origin)
+			}
+			key.origins = append(key.origins, origins[0])
+		}
+		if key.MaxOutputWidth < 0 || key.MaxOutputHeight < 0 || key.MaxOutputPixels < 0 {
+			return nil, fmt.Errorf("API key %s has negative output limits", key.Name)
+		}
+
+		if key.RateLimit < 0 || key.Burst < 0 {
+			return nil, fmt.Errorf("API key %s has negative rate limit", key.Name)
+		}
+		if key.RateLimit > 0 {
+			limiter, err := newAPIKeyRateLimiter(key.RateLimit, key.Burst)
+			if err != nil {
+				return nil, err
+			}
+			key.limiter = limiter
+		}
+
+		keys.keys[digest] = key
+	}
+	return keys, nil
+}
+
+func newAPIKeyRateLimiter(rate, burst int) (throttled.RateLimiter, error) {
+	store, err := memstore.New(1)
+	if err != nil {
+		return nil, err
+	}
+	return throttled.NewGCRARateLimiter(store, throttled.RateQuota{MaxRate: throttled.PerSec(rate), MaxBurst: burst})
+}
+
+// Lookup returns the API key matching the given secret, if any.
+func (k *APIKeys) Lookup(secret string) (*APIKey, bool) {
+	if k == nil || secret == "" {
+		return nil, false
+	}
+	key, ok := k.keys[sha256.Sum256([]byte(secret))]
+	return key, ok
+}
+
+// AllowsEndpoint returns true if the API key can use the given endpoint, such as resize.
+func (k *APIKey) AllowsEndpoint(name string) bool {
+	if len(k.Endpoints) == 0 {
+		return true
+	}
+	for _, endpoint := range k.Endpoints {
+		if endpoint == name {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsSource returns true if the API key can read images from the given source.
+func (k *APIKey) AllowsSource(source ImageSourceType) bool {
+	if len(k.Sources) == 0 {
+		return true
+	}
+	for _, allowed := range k.Sources {
+		if allowed == source {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsOrigin returns true if the API key can fetch remote images from the given URL.
+func (k *APIKey) AllowsOrigin(u *url.URL) bool {
+	return !shouldRestrictOrigin(u, k.origins)
+}
+
+// restrictLimits returns the most restrictive combination of the server and API key output limits.
+func (k *APIKey) restrictLimits(limits ImageLimits) ImageLimits {
+	limits.MaxOutputWidth = minLimit(limits.MaxOutputWidth, k.MaxOutputWidth)
+	limits.MaxOutputHeight = minLimit(limits.MaxOutputHeight, k.MaxOutputHeight)
+	limits.MaxOutputPixels = minLimit(limits.MaxOutputPixels, k.MaxOutputPixels)
+	return limits
+}
+
+// minLimit returns the lowest of both limits, where zero means unlimited.
+func minLimit(a, b int) int {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// allow consumes a request from the API key rate limit, setting the rate limit response headers.
+func (k *APIKey) allow(w http.ResponseWriter) (bool, error) {
+	if k.limiter == nil {
+		return true, nil
+	}
+
+	limited, result, err := k.limiter.RateLimit(k.Name, 1)
+	if err != nil {
+		return false, err
+	}
+
+	setRateLimitHeaders(w, result, limited)
+	return !limited, nil
+}
+
+// authorizeSource checks if the API key of the request, if any, can read the image from the matched source.
+func authorizeSource(r *http.Request, source ImageSourceType) error {
+	key := apiKeyFrom(r.Context())
+	if key == nil {
+		return nil
+	}
+	if !key.AllowsSource(source) {
+		return ErrAPIKeySourceNotAllowed
+	}
+
+	// Check the remote image URL and the watermark image URL, if any
+	query := r.URL.Query()
+	urls := []string{query.Get("image")}
+	if source == ImageSourceTypeHTTP {
+		urls = append(urls, query.Get(URLQueryKey))
+	}
+	for _, rawURL := range urls {
+		if err := authorizeRawOrigin(r.Context(), rawURL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// authorizeOptions checks if the API key of the request, if any, can fetch the watermark images
+// defined by the pipeline operations and the multi tasks params.
+func authorizeOptions(ctx context.Context, opts ImageOptions) error {
+	if err := authorizeRawOrigin(ctx, opts.Image); err != nil {
+		return err
+	}
+	for _, operation := range opts.Operations {
+		if err := authorizeParamsOrigin(ctx, operation.Params); err != nil {
+			return err
+		}
+	}
+	for _, task := range opts.Multi {
+		if err := authorizeParamsOrigin(ctx, task.Params); err != nil {
+			return err
+		}
+		if err := authorizeOptions(ctx, ImageOptions{Operations: task.Operations}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func authorizeParamsOrigin(ctx context.Context, params map[string]interface{}) error {
+	if value, ok := params["image"].(string); ok {
+		return authorizeRawOrigin(ctx, value)
+	}
+	return nil
+}
+
+func authorizeRawOrigin(ctx context.Context, rawURL string) error {
+	key := apiKeyFrom(ctx)
+	if rawURL == "" || key == nil || len(key.origins) == 0 {
+		return nil
+	}
+	if u, err := url.Parse(rawURL); err != nil || !key.AllowsOrigin(u) {
+		return ErrAPIKeyOriginNotAllowed
+	}
+	return nil
+}
+
+// authorizeOrigin checks if the API key stored in the context, if any, can fetch remote images from the given URL.
+// It is enforced right before fetching as well, so no remote image is ever fetched out of the key scope.
+func authorizeOrigin(ctx context.Context, u *url.URL) error {
+	key := apiKeyFrom(ctx)
+	if key == nil || len(key.origins) == 0 {
+		return nil
+	}
+	if !key.AllowsOrigin(u) {
+		return ErrAPIKeyOriginNotAllowed
+	}
+	return nil
+}
+
+// withAPIKey returns a copy of the context storing the API key of the request.
+func withAPIKey(ctx context.Context, key *APIKey) context.Context {
+	return context.WithValue(ctx, apiKeyContextKey{}, key)
+}
+
+// apiKeyFrom returns the API key of the request, if authorized by a key from the API keys file.
+func apiKeyFrom(ctx context.Context) *APIKey {
+	key, _ := ctx.Value(apiKeyContextKey{}).(*APIKey)
+	return key
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/throttled/throttled/v2"
+)
+
+const testAPIKeys = `[
+	{"name": "frontend", "key": "frontend-secret-key", "endpoints": ["resize", "/Info"], "sources": ["http"],
+	 "allowedOrigins": ["https://cdn.example.org/images/"], "maxOutputWidth": 1000},
+	{"name": "batch", "key": "batch-secret-key-0"}
+]`
+
+type testRateLimiter struct {
+	limited bool
+}
+
+func (l testRateLimiter) RateLimit(key string, quantity int) (bool, throttled.RateLimitResult, error) {
+	return l.limited, throttled.RateLimitResult{Limit: 10, RetryAfter: 2 * time.Second}, nil
+}
+
+func TestParseAPIKeys(t *testing.T) {
+	keys, err := ParseAPIKeys([]byte(testAPIKeys))
+	if err != nil {
+		t.Fatalf("Cannot parse API keys: %s", err)
+	}
+
+	key, ok := keys.Lookup("frontend-secret-key")
+	if !ok || key.Name != "frontend" {
+		t.Fatal("API key not found")
+	}
+	if _, ok := keys.Lookup("frontend-secret"); ok {
+		t.Fatal("Unknown API key must not be found")
+	}
+	if !key.AllowsEndpoint("resize") || !key.AllowsEndpoint("info") || key.AllowsEndpoint("crop") {
+		t.Fatal("Invalid API key endpoints scope")
+	}
+	if !key.AllowsSource(ImageSourceTypeHTTP) || key.AllowsSource(ImageSourceTypeFileSystem) {
+		t.Fatal("Invalid API key sources scope")
+	}
+
+	invalid := []string{
+		`{}`,
+		`[{"key": "frontend-secret-key"}]`,
+		`[{"name": "foo", "key": "short"}]`,
+		`[{"name": "foo", "key": "frontend-secret-key"}, {"name": "foo", "key": "batch-secret-key-0"}]`,
+		`[{"name": "foo", "key": "frontend-secret-key"}, {"name": "bar", "key": "frontend-secret-key"}]`,
+		`[{"name": "foo", "key": "frontend-secret-key", "sources": ["ftp"]}]`,
+		`[{"name": "foo", "key": "frontend-secret-key", "allowedOrigins": ["/images"]}]`,
+		`[{"name": "foo", "key": "frontend-secret-key", "rateLimit": -1}]`,
+	}
+	for _, data := range invalid {
+		if _, err := ParseAPIKeys([]byte(data)); err == nil {
+			t.Errorf("Invalid API keys must be rejected: %s", data)
+		}
+	}
+}
+
+func TestAuthorizeClientAPIKeys(t *testing.T) {
+	keys, _ := ParseAPIKeys([]byte(testAPIKeys))
+	o := ServerOptions{APIKey: "master-secret-key", APIKeys: keys}
+
+	var authorized *APIKey
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorized = apiKeyFrom(r.Context())
+	})
+
+	cases := []struct {
+		path, key string
+		status    int
+	}{
+		{"/resize", "master-secret-key", http.StatusOK},
+		{"/crop", "master-secret-key", http.StatusOK},
+		{"/resize", "frontend-secret-key", http.StatusOK},
+		{"/crop", "frontend-secret-key", http.StatusForbidden},
+		{"/health", "frontend-secret-key", http.StatusOK},
+		{"/crop", "batch-secret-key-0", http.StatusOK},
+		{"/crop", "unknown-secret-key", http.StatusUnauthorized},
+		{"/crop", "", http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		authorized = nil
+		req := httptest.NewRequest(http.MethodGet, c.path, nil)
+		req.Header.Set("API-Key", c.key)
+		w := httptest.NewRecorder()
+		authorizeClient(next, o).ServeHTTP(w, req)
+
+		if w.Code != c.status {
+			t.Errorf("Invalid response status for %s with key %s: %d", c.path, c.key, w.Code)
+		}
+		if w.Code == http.StatusOK && c.key != o.APIKey && authorized == nil {
+			t.Errorf("Missing API key in the request context: %s", c.key)
+		}
+	}
+}
+
+func TestAuthorizeClientRateLimit(t *testing.T) {
+	keys, _ := ParseAPIKeys([]byte(testAPIKeys))
+	key, _ := keys.Lookup("batch-secret-key-0")
+	key.limiter = testRateLimiter{limited: true}
+
+	req := httptest.NewRequest(http.MethodGet, "/crop", nil)
+	req.Header.Set("API-Key", "batch-secret-key-0")
+	w := httptest.NewRecorder()
+	authorizeClient(http.NotFoundHandler(), ServerOptions{APIKeys: keys}).ServeHTTP(w, req)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Invalid response status: %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "2" || w.Header().Get("RateLimit-Limit") != "10" {
+		t.Fatalf("Invalid rate limit headers: %v", w.Header())
+	}
+}
+
+func TestAuthorizeSource(t *testing.T) {
+	keys, _ := ParseAPIKeys([]byte(testAPIKeys))
+	key, _ := keys.Lookup("frontend-secret-key")
+
+	cases := []struct {
+		url    string
+		source ImageSourceType
+		err    error
+	}{
+		{"/resize?url=https://cdn.example.org/images/foo.jpg", ImageSourceTypeHTTP, nil},
+		{"/resize?url=https://example.org/foo.jpg", ImageSourceTypeHTTP, ErrAPIKeyOriginNotAllowed},
+		{"/resize?url=https://cdn.example.org/images/foo.jpg&image=https://example.org/bar.png", ImageSourceTypeHTTP, ErrAPIKeyOriginNotAllowed},
+		{"/resize?file=foo.jpg", ImageSourceTypeFileSystem, ErrAPIKeySourceNotAllowed},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, c.url, nil)
+		req = req.WithContext(withAPIKey(req.Context(), key))
+		if err := authorizeSource(req, c.source); err != c.err {
+			t.Errorf("Invalid source authorization of %s: %v", c.url, err)
+		}
+	}
+
+	if err := authorizeSource(httptest.NewRequest(http.MethodGet, "/resize?file=foo.jpg", nil), ImageSourceTypeFileSystem); err != nil {
+		t.Fatalf("Requests without API key must not be restricted: %s", err)
+	}
+}
+
+func TestAuthorizeWatermarkOrigins(t *testing.T) {
+	keys, _ := ParseAPIKeys([]byte(testAPIKeys))
+	key, _ := keys.Lookup("frontend-secret-key")
+	ctx := withAPIKey(context.Background(), key)
+
+	watermark := func(image string) PipelineOperation {
+		return PipelineOperation{Name: "watermarkImage", Params: map[string]interface{}{"image": image}}
+	}
+	allowed, denied := "https://cdn.example.org/images/logo.png", "http://169.254.169.254/logo.png"
+	cases := []struct {
+		opts ImageOptions
+		err  error
+	}{
+		{ImageOptions{Operations: PipelineOperations{watermark(allowed)}}, nil},
+		{ImageOptions{Operations: PipelineOperations{watermark(denied)}}, ErrAPIKeyOriginNotAllowed},
+		{ImageOptions{Multi: []MultiTask{{Name: "foo", OperationName: "watermarkImage", Params: map[string]interface{}{"image": denied}}}}, ErrAPIKeyOriginNotAllowed},
+		{ImageOptions{Multi: []MultiTask{{Name: "foo", Operations: PipelineOperations{watermark(denied)}}}}, ErrAPIKeyOriginNotAllowed},
+	}
+	for i, c := range cases {
+		if err := authorizeOptions(ctx, c.opts); err != c.err {
+			t.Errorf("Invalid authorization of case %d: %v", i, err)
+		}
+	}
+
+	// Pipeline requests with a watermark image out of the key scope are rejected
+	buf, _ := ioutil.ReadFile("testdata/large.jpg")
+	operations := `[{"operation":"watermarkImage","params":{"image":"` + denied + `"}}]`
+	req := httptest.NewRequest(http.MethodGet, "/pipeline?operations="+url.QueryEscape(operations), nil)
+	w := httptest.NewRecorder()
+	imageHandler(w, req.WithContext(ctx), buf, ImageSourceMetadata{}, Pipeline, ServerOptions{})
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Invalid response status: %d %s", w.Code, w.Body.String())
+	}
+
+	// The key scope is enforced right before fetching the watermark image as well
+	opts := ImageOptions{Image: denied, ctx: ctx}
+	if _, err := WatermarkImage(buf, opts); err != ErrAPIKeyOriginNotAllowed {
+		t.Fatalf("Invalid watermark image error: %v", err)
+	}
+	source := NewHTTPImageSource(&SourceConfig{})
+	req = httptest.NewRequest(http.MethodGet, "/resize?url="+url.QueryEscape(denied), nil)
+	if _, err := source.GetImage(ctx, req); err != ErrAPIKeyOriginNotAllowed {
+		t.Fatalf("Invalid remote image error: %v", err)
+	}
+}
+
+func TestAPIKeyRestrictLimits(t *testing.T) {
+	key := &APIKey{MaxOutputWidth: 1000, MaxOutputPixels: 4000000}
+	limits := key.restrictLimits(ImageLimits{MaxOutputWidth: 2000, MaxOutputHeight: 3000, MaxOutputPixels: 1000000})
+
+	expected := ImageLimits{MaxOutputWidth: 1000, MaxOutputHeight: 3000, MaxOutputPixels: 1000000}
+	if limits != expected {
+		t.Fatalf("Invalid restricted limits: %#v", limits)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheStatusHeader is the response header exposing whether the response was served from cache.
+const CacheStatusHeader = "Image-Cache"
+
+const (
+	CacheStatusHit  = "HIT"
+	CacheStatusMiss = "MISS"
+)
+
+// responseCache stores the processed images in memory, if enabled.
+var responseCache *ResponseCache
+
+// diskCache stores the processed images in a local directory, if enabled.
+var diskCache *DiskCache
+
+// LoadResponseCache creates the in-memory and disk caches of processed images, if enabled.
+func LoadResponseCache(o ServerOptions) error {
+	responseCache, diskCache = nil, nil
+	if o.MemoryCacheMaxSize > 0 {
+		responseCache = NewResponseCache(int64(o.MemoryCacheMaxSize), o.CacheTTL)
+	}
+	if o.CacheDir != "" {
+		cache, err := NewDiskCache(o.CacheDir, o.CacheMaxSize, o.CacheTTL)
+		if err != nil {
+			return err
+		}
+		diskCache = cache
+	}
+	return nil
+}
+
+// isCacheEnabled returns true if any cache of processed images is enabled.
+func isCacheEnabled() bool {
+	return responseCache != nil || diskCache != nil
+}
+
+// getCachedImage looks up the processed image in memory first and then on disk.
+// Images found on disk are kept in memory for the next requests.
+func getCachedImage(key string) (Image, bool) {
+	if responseCache != nil {
+		if image, ok := responseCache.Get(key); ok {
+			return image, true
+		}
+	}
+	if diskCache != nil {
+		if image, ok := diskCache.Get(key); ok {
+			if responseCache != nil {
+				responseCache.Add(key, image)
+			}
+			return image, true
+		}
+	}
+	return Image{}, false
+}
+
+// addCachedImage stores the processed image in every enabled cache.
+func addCachedImage(key string, image Image) {
+	if responseCache != nil {
+		responseCache.Add(key, image)
+	}
+	if diskCache != nil {
+		diskCache.Add(key, image)
+	}
+}
+
+// CacheStats represents the response cache usage statistics.
+type CacheStats struct {
+	Entries   int    `json:"entries"`
+	Size      int64  `json:"size"`
+	MaxSize   int64  `json:"maxSize"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+// ResponseCache is an in-memory LRU cache of processed images,
+// bounded by the total size in bytes of the cached image bodies.
+// Images expire once cached for longer than the TTL, unless it is zero.
+type ResponseCache struct {
+	mutex     sync.Mutex
+	maxSize   int64
+	ttl       time.Duration
+	size      int64
+	entries   *list.List
+	items     map[string]*list.Element
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+type cacheEntry struct {
+	key     string
+	image   Image
+	created time.Time
+}
+
+// NewResponseCache creates a new response cache bounded to maxSize bytes.
+func NewResponseCache(maxSize int64, ttl time.Duration) *ResponseCache {
+	return &ResponseCache{
+		maxSize: maxSize,
+		ttl:     ttl,
+		entries: list.New(),
+		items:   make(map[string]*list.Element),
+	}
+}
+
+// Get returns the cached image for the given key, if present.
+func (c *ResponseCache) Get(key string) (Image, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.items[key]
+	if ok && isCacheExpired(element.Value.(*cacheEntry).created, c.ttl) {
+		c.remove(element)
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		return Image{}, false
+	}
+
+	c.hits++
+	c.entries.MoveToFront(element)
+	return element.Value.(*cacheEntry).image, true
+}
+
+// Add stores the image in the cache, evicting the least recently used entries if required.
+// Images larger than the whole cache are ignored.
+func (c *ResponseCache) Add(key string, image Image) {
+	size := int64(len(image.Body))
+	if size > c.maxSize {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.items[key]; ok {
+		c.remove(element)
+	}
+
+	c.items[key] = c.entries.PushFront(&cacheEntry{key, image, time.Now()})
+	c.size += size
+
+	for c.size > c.maxSize {
+		c.remove(c.entries.Back())
+		c.evictions++
+	}
+}
+
+func (c *ResponseCache) remove(element *list.Element) {
+	entry := c.entries.Remove(element).(*cacheEntry)
+	delete(c.items, entry.key)
+	c.size -= int64(len(entry.image.Body))
+}
+
+// Stats returns the cache usage statistics.
+func (c *ResponseCache) Stats() CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return CacheStats{
+		Entries:   c.entries.Len(),
+		Size:      c.size,
+		MaxSize:   c.maxSize,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+}
+
+// isCacheExpired returns true if an image cached at the given time outlived the cache TTL, if any.
+func isCacheExpired(created time.Time, ttl time.Duration) bool {
+	return ttl > 0 && time.Since(created) > ttl
+}
+
+// newCacheKey builds the key identifying a processed image, used to cache and coalesce transformations,
+// from the operation name, the parsed options, which already include the negotiated output type,
+// and the source image fingerprint.
+func newCacheKey(operation string, opts ImageOptions, fingerprint string) string {
+	data, _ := json.Marshal(struct {
+		Operation   string
+		Options     ImageOptions
+		Defined     IsDefinedField
+		Fingerprint string
+	}{operation, opts, opts.IsDefinedField, fingerprint})
+
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// operationName returns the normalized operation name of the request, based on the endpoint path.
+func operationName(r *http.Request) string {
+	return strings.ToLower(path.Base(r.URL.Path))
+}
+
+// bodyFingerprint identifies the source image by the hash of its contents.
+func bodyFingerprint(buf []byte) string {
+	hash := sha256.Sum256(buf)
+	return "sha256:" + hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestResponseCacheEviction(t *testing.T) {
+	cache := NewResponseCache(10, 0)
+
+	cache.Add("foo", Image{Body: []byte("1234"), Mime: "image/jpeg"})
+	cache.Add("bar", Image{Body: []byte("1234"), Mime: "image/jpeg"})
+	if _, ok := cache.Get("foo"); !ok {
+		t.Fatal("Expected cached image: foo")
+	}
+
+	// Evicts bar, since foo has been recently used
+	cache.Add("baz", Image{Body: []byte("1234"), Mime: "image/jpeg"})
+	if _, ok := cache.Get("bar"); ok {
+		t.Fatal("Unexpected cached image: bar")
+	}
+	if image, ok := cache.Get("baz"); !ok || string(image.Body) != "1234" {
+		t.Fatal("Expected cached image: baz")
+	}
+
+	// Ignores images larger than the cache
+	cache.Add("large", Image{Body: make([]byte, 11)})
+	if _, ok := cache.Get("large"); ok {
+		t.Fatal("Unexpected cached image: large")
+	}
+
+	stats := cache.Stats()
+	expected := CacheStats{Entries: 2, Size: 8, MaxSize: 10, Hits: 2, Misses: 2, Evictions: 1}
+	if stats != expected {
+		t.Fatalf("Invalid cache stats: %#v", stats)
+	}
+}
+
+func TestResponseCacheTTL(t *testing.T) {
+	cache := NewResponseCache(10, 20*time.Millisecond)
+	cache.Add("foo", Image{Body: []byte("1234"), Mime: "image/jpeg"})
+	if _, ok := cache.Get("foo"); !ok {
+		t.Fatal("Expected cached image: foo")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := cache.Get("foo"); ok {
+		t.Fatal("Unexpected expired image: foo")
+	}
+	if stats := cache.Stats(); stats.Entries != 0 || stats.Size != 0 {
+		t.Fatalf("Expired images must be removed: %#v", stats)
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	foo, bar := bodyFingerprint([]byte("foo")), bodyFingerprint([]byte("bar"))
+	key := newCacheKey("resize", ImageOptions{Width: 300, Type: "webp"}, foo)
+
+	cases := []struct {
+		operation   string
+		opts        ImageOptions
+		fingerprint string
+		equal       bool
+	}{
+		{"resize", ImageOptions{Width: 300, Type: "webp"}, foo, true},
+		{"crop", ImageOptions{Width: 300, Type: "webp"}, foo, false},
+		{"resize", ImageOptions{Width: 300, Type: "png"}, foo, false},
+		{"resize", ImageOptions{Width: 301, Type: "webp"}, foo, false},
+		{"resize", ImageOptions{Width: 300, Type: "webp", IsDefinedField: IsDefinedField{Flip: true}}, foo, false},
+		{"resize", ImageOptions{Width: 300, Type: "webp"}, bar, false},
+	}
+
+	for _, test := range cases {
+		if equal := newCacheKey(test.operation, test.opts, test.fingerprint) == key; equal != test.equal {
+			t.Errorf("Invalid cache key for %s %#v %s", test.operation, test.opts, test.fingerprint)
+		}
+	}
+}
+
+func TestImageHandlerCache(t *testing.T) {
+	responseCache = NewResponseCache(1024*1024, 0)
+	defer func() { responseCache = nil }()
+
+	calls := 0
+	op := func(buf []byte, opts ImageOptions) (Image, error) {
+		calls++
+		return Image{Body: []byte("processed"), Mime: "image/jpeg"}, nil
+	}
+
+	buf, _ := ioutil.ReadFile("testdata/large.jpg")
+	for i, status := range []string{CacheStatusMiss, CacheStatusHit} {
+		req := httptest.NewRequest(http.MethodPost, "/resize?width=300", bytes.NewReader(buf))
+		w := httptest.NewRecorder()
+		imageHandler(w, req, buf, ImageSourceMetadata{}, op, ServerOptions{})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Invalid response status: %d", w.Code)
+		}
+		if w.Header().Get(CacheStatusHeader) != status {
+			t.Fatalf("Invalid cache status on request %d: %s", i, w.Header().Get(CacheStatusHeader))
+		}
+		if w.Body.String() != "processed" {
+			t.Fatalf("Invalid response body: %s", w.Body.String())
+		}
+	}
+
+	if calls != 1 {
+		t.Fatalf("Operation must be run once, got: %d", calls)
+	}
+
+	// A changed source image is processed again, even if served under the same location
+	changed := append(append([]byte{}, buf...), 0)
+	req := httptest.NewRequest(http.MethodGet, "/resize?width=300", nil)
+	w := httptest.NewRecorder()
+	imageHandler(w, req, changed, ImageSourceMetadata{}, op, ServerOptions{})
+	if w.Header().Get(CacheStatusHeader) != CacheStatusMiss || calls != 2 {
+		t.Fatalf("Changed source image must not be served from cache: %s", w.Header().Get(CacheStatusHeader))
+	}
+
+	stats := GetHealthStats()
+	if stats.Cache == nil || stats.Cache.Hits != 1 || stats.Cache.Misses != 2 {
+		t.Fatalf("Invalid health cache stats: %#v", stats.Cache)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// newETag builds a strong entity tag of the processed image from the operation, the parsed options
+// and the hash of the source image contents, so it can be checked before processing the image.
+func newETag(operation string, opts ImageOptions, bodyFingerprint string) string {
+	return `"` + newCacheKey(operation, opts, bodyFingerprint)[:32] + `"`
+}
+
+// setValidatorHeaders exposes the ETag and Last-Modified response headers, if known.
+func setValidatorHeaders(w http.ResponseWriter, etag string, lastModified time.Time) {
+	w.Header().Set("ETag", etag)
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// isNotModified evaluates the If-None-Match and If-Modified-Since request headers.
+// As defined by RFC 7232, If-Modified-Since is ignored if If-None-Match is present.
+func isNotModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		return etagMatches(header, etag)
+	}
+
+	header := r.Header.Get("If-Modified-Since")
+	if header == "" || lastModified.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(header)
+	if err != nil {
+		return false
+	}
+	return !lastModified.Truncate(time.Second).After(since)
+}
+
+// etagMatches performs a weak comparison of the entity tags list against the given entity tag.
+func etagMatches(header, etag string) bool {
+	for _, value := range strings.Split(header, ",") {
+		value = strings.TrimSpace(value)
+		if value == "*" || strings.TrimPrefix(value, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func writeNotModified(w http.ResponseWriter, etag string, lastModified time.Time, vary string) {
+	setValidatorHeaders(w, etag, lastModified)
+	if vary != "" {
+		w.Header().Set("Vary", vary)
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
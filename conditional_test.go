@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIsNotModified(t *testing.T) {
+	etag := `"foo"`
+	modified := time.Date(2020, 1, 1, 10, 0, 0, 500, time.UTC)
+
+	cases := []struct {
+		method       string
+		header       string
+		value        string
+		lastModified time.Time
+		expected     bool
+	}{
+		{http.MethodGet, "If-None-Match", `"foo"`, modified, true},
+		{http.MethodGet, "If-None-Match", `"bar", W/"foo"`, modified, true},
+		{http.MethodGet, "If-None-Match", `*`, modified, true},
+		{http.MethodGet, "If-None-Match", `"bar"`, modified, false},
+		{http.MethodPost, "If-None-Match", `"foo"`, modified, false},
+		{http.MethodGet, "If-Modified-Since", "Wed, 01 Jan 2020 10:00:00 GMT", modified, true},
+		{http.MethodGet, "If-Modified-Since", "Wed, 01 Jan 2020 11:00:00 GMT", modified, true},
+		{http.MethodGet, "If-Modified-Since", "Wed, 01 Jan 2020 09:59:59 GMT", modified, false},
+		{http.MethodGet, "If-Modified-Since", "Wed, 01 Jan 2020 10:00:00 GMT", time.Time{}, false},
+		{http.MethodGet, "If-Modified-Since", "invalid", modified, false},
+		{http.MethodGet, "", "", modified, false},
+	}
+
+	for _, test := range cases {
+		req := httptest.NewRequest(test.method, "/resize", nil)
+		if test.header != "" {
+			req.Header.Set(test.header, test.value)
+		}
+		if isNotModified(req, etag, test.lastModified) != test.expected {
+			t.Errorf("Invalid result for %s %s: %s", test.method, test.header, test.value)
+		}
+	}
+}
+
+func TestImageHandlerNotModified(t *testing.T) {
+	calls := 0
+	op := func(buf []byte, opts ImageOptions) (Image, error) {
+		calls++
+		return Image{Body: []byte("processed"), Mime: "image/jpeg"}, nil
+	}
+
+	buf, _ := ioutil.ReadFile("testdata/large.jpg")
+	meta := ImageSourceMetadata{LastModified: time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)}
+
+	req := httptest.NewRequest(http.MethodGet, "/resize?width=300", bytes.NewReader(buf))
+	w := httptest.NewRecorder()
+	imageHandler(w, req, buf, meta, op, ServerOptions{})
+
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("Invalid response: %d, ETag: %s", w.Code, etag)
+	}
+	if w.Header().Get("Last-Modified") != "Wed, 01 Jan 2020 10:00:00 GMT" {
+		t.Fatalf("Invalid Last-Modified header: %s", w.Header().Get("Last-Modified"))
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/resize?width=300", bytes.NewReader(buf))
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	imageHandler(w, req, buf, meta, op, ServerOptions{})
+
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("Invalid response status: %d", w.Code)
+	}
+	if calls != 1 {
+		t.Fatalf("The image must not be processed if not modified, got %d calls", calls)
+	}
+
+	// Different params must produce a different entity tag
+	req = httptest.NewRequest(http.MethodGet, "/resize?width=301", bytes.NewReader(buf))
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	imageHandler(w, req, buf, meta, op, ServerOptions{})
+
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Fatalf("Invalid response: %d, ETag: %s", w.Code, w.Header().Get("ETag"))
+	}
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"mime"
 	"net/http"
 	"path"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/h2non/bimg"
 	"github.com/h2non/filetype"
@@ -38,15 +40,41 @@ func healthController(w http.ResponseWriter, r *http.Request) {
 
 func imageController(o ServerOptions, operation Operation) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
-		imageSource := MatchSource(req)
+		sourceType, imageSource := matchSource(req)
 		if imageSource == nil {
 			ErrorReply(req, w, ErrMissingImageSource, o)
 			return
 		}
 
-		buf, err := imageSource.GetImage(req)
+		// Expose the matched image source for debugging purposes
+		w.Header().Set(ImageSourceHeader, string(sourceType))
+
+		if err := authorizeSource(req, sourceType); err != nil {
+			ErrorReply(req, w, err.(Error), o)
+			return
+		}
+
+		info := requestInfoFrom(req.Context())
+		info.SourceType = sourceType
+		info.Source = sourceLocation(sourceType, req)
+
+		ctx, span := StartSpan(req.Context(), "source.get_image", SpanKindClient)
+		span.SetAttribute("imaginary.source.type", string(sourceType))
+		span.SetAttribute("imaginary.source.location", info.Source)
+
+		start := time.Now()
+		buf, meta, err := getImageWithMetadata(ctx, imageSource, req.WithContext(ctx))
+		info.FetchTime = time.Since(start)
+		info.InputBytes = len(buf)
+		metrics.ObserveSourceFetch(sourceType, len(buf), info.FetchTime, err)
+
+		span.SetAttribute("imaginary.source.bytes", len(buf))
+		span.RecordError(err)
+		span.Finish()
 		if err != nil {
-			if xerr, ok := err.(Error); ok {
+			if xerr, ok := requestContextError(req); ok {
+				ErrorReply(req, w, xerr, o)
+			} else if xerr, ok := err.(Error); ok {
 				ErrorReply(req, w, xerr, o)
 			} else {
 				ErrorReply(req, w, NewError(err.Error(), http.StatusBadRequest), o)
@@ -59,7 +87,7 @@ func imageController(o ServerOptions, operation Operation) func(http.ResponseWri
 			return
 		}
 
-		imageHandler(w, req, buf, operation, o)
+		imageHandler(w, req, buf, meta, operation, o)
 	}
 }
 
@@ -81,7 +109,10 @@ func determineAcceptMimeType(accept string) string {
 	return ""
 }
 
-func imageHandler(w http.ResponseWriter, r *http.Request, buf []byte, operation Operation, o ServerOptions) {
+func imageHandler(w http.ResponseWriter, r *http.Request, buf []byte, meta ImageSourceMetadata, operation Operation, o ServerOptions) {
+	info := requestInfoFrom(r.Context())
+	detectStart := time.Now()
+
 	// Infer the body MIME type via mime sniff algorithm
 	mimeType := http.DetectContentType(buf)
 
@@ -106,6 +137,17 @@ func imageHandler(w http.ResponseWriter, r *http.Request, buf []byte, operation
 		return
 	}
 
+	// Collect the input image details for the access log and diagnostics headers, if required
+	info.InputFormat = mimeType
+	info.InputBytes = len(buf)
+	if o.LogFormat == LogFormatJSON || o.EnableServerTiming || o.MemoryBudget > 0 {
+		if size, err := bimg.Size(buf); err == nil {
+			info.InputWidth, info.InputHeight = size.Width, size.Height
+		}
+	}
+	info.DetectTime = time.Since(detectStart)
+
+	paramsStart := time.Now()
 	opts, err := buildParamsFromQuery(r.URL.Query())
 	if err != nil {
 		ErrorReply(r, w, NewError("Error while processing parameters, "+err.Error(), http.StatusBadRequest), o)
@@ -120,29 +162,154 @@ func imageHandler(w http.ResponseWriter, r *http.Request, buf []byte, operation
 		ErrorReply(r, w, ErrOutputFormat, o)
 		return
 	}
+	info.ParamsTime = time.Since(paramsStart)
+
+	// Check the watermark images of the pipeline steps and multi tasks against the client scope
+	if err := authorizeOptions(r.Context(), opts); err != nil {
+		ErrorReply(r, w, err.(Error), o)
+		return
+	}
+
+	// Check the image dimensions and requested output size, if required
+	limits := o.Limits
+	if key := apiKeyFrom(r.Context()); key != nil {
+		limits = key.restrictLimits(limits)
+	}
+	if limits.IsEnabled() {
+		size, err := limits.CheckInput(buf)
+		if err == nil {
+			err = limits.CheckOptions(opts, size)
+		}
+		if err != nil {
+			ErrorReply(r, w, err.(Error), o)
+			return
+		}
+		opts.limits = limits
+	}
+
+	// Identify the processed image by the operation, params and source image contents,
+	// so a changed source image is never served from cache
+	name := operationName(r)
+	bodyHash := bodyFingerprint(buf)
+	key := newCacheKey(name, opts, bodyHash)
+	etag := newETag(name, opts, bodyHash)
+
+	// Reply with 304 if the client copy is still valid, without processing the image
+	if isNotModified(r, etag, meta.LastModified) {
+		writeNotModified(w, etag, meta.LastModified, vary)
+		return
+	}
+
+	// Serve the processed image from cache, if available
+	if isCacheEnabled() {
+		if image, ok := getCachedImage(key); ok {
+			w.Header().Set(CacheStatusHeader, CacheStatusHit)
+			setValidatorHeaders(w, etag, meta.LastModified)
+			writeImage(w, r, image, vary, o)
+			return
+		}
+		w.Header().Set(CacheStatusHeader, CacheStatusMiss)
+	}
+
+	// Share a single transformation between concurrent identical requests
+	processStart := time.Now()
+	cost := estimateMemoryCost(buf, bimg.ImageSize{Width: info.InputWidth, Height: info.InputHeight}, opts)
+	result, err, _ := processFlight.DoContext(r.Context(), key, func(ctx context.Context) (interface{}, error) {
+		// Reserve the memory once a worker is acquired, so queued requests do not hold any memory
+		releaseWorker, err := acquireProcessingWorker(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer releaseWorker()
+
+		release, err := reserveMemory(ctx, cost)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
 
-	image, err := operation.Run(buf, opts)
+		var encode encodeTimer
+		start := time.Now()
+		image, err := operation.RunContext(withEncodeTimer(ctx, &encode), buf, opts)
+		elapsed := time.Since(start)
+		metrics.ObserveProcessing(name, elapsed)
+		if err == nil && isCacheEnabled() {
+			addCachedImage(key, image)
+		}
+		return processResult{image: image, process: elapsed, encode: encode.Elapsed()}, err
+	})
+	setProcessingTimes(info, result, time.Since(processStart))
 	if err != nil {
 		// Ensure the Vary header is set when an error occurs
 		if vary != "" {
 			w.Header().Set("Vary", vary)
 		}
+		if replyServerBusy(w, r, err, o) {
+			return
+		}
+		if xerr, ok := requestContextError(r); ok {
+			ErrorReply(r, w, xerr, o)
+			return
+		}
 		ErrorReply(r, w, NewError("Error while processing the image: "+err.Error(), http.StatusBadRequest), o)
 		return
 	}
 
+	image := result.(processResult).image
+	setValidatorHeaders(w, etag, meta.LastModified)
+	writeImage(w, r, image, vary, o)
+}
+
+// processResult is the image processed by a coalesced call, with the time spent processing it.
+type processResult struct {
+	image   Image
+	process time.Duration
+	encode  time.Duration
+}
+
+// setProcessingTimes splits the time spent waiting for the processed image between the queue,
+// which includes waiting for a coalesced call, a processing worker and memory, the libvips
+// processing and the encoding of the response body.
+func setProcessingTimes(info *RequestInfo, result interface{}, elapsed time.Duration) {
+	res, ok := result.(processResult)
+	if !ok {
+		info.QueueTime = elapsed
+		return
+	}
+	info.EncodeTime = res.encode
+	if info.ProcessingTime = res.process - res.encode; info.ProcessingTime < 0 {
+		info.ProcessingTime = 0
+	}
+	if info.QueueTime = elapsed - res.process; info.QueueTime < 0 {
+		// The call was already running when the request joined it
+		info.QueueTime = 0
+	}
+}
+
+func writeImage(w http.ResponseWriter, r *http.Request, image Image, vary string, o ServerOptions) {
+	info := requestInfoFrom(r.Context())
+	info.OutputFormat = image.Mime
+	info.OutputBytes = len(image.Body)
+
 	// Expose Content-Length response header
 	w.Header().Set("Content-Length", strconv.Itoa(len(image.Body)))
 	w.Header().Set("Content-Type", image.Mime)
-	if image.Mime != "application/json" && o.ReturnSize {
+	if image.Mime != "application/json" && (o.ReturnSize || o.LogFormat == LogFormatJSON) {
 		meta, err := bimg.Metadata(image.Body)
 		if err == nil {
-			w.Header().Set("Image-Width", strconv.Itoa(meta.Size.Width))
-			w.Header().Set("Image-Height", strconv.Itoa(meta.Size.Height))
+			info.OutputWidth, info.OutputHeight = meta.Size.Width, meta.Size.Height
+			if o.ReturnSize {
+				w.Header().Set("Image-Width", strconv.Itoa(meta.Size.Width))
+				w.Header().Set("Image-Height", strconv.Itoa(meta.Size.Height))
+			}
 		}
 	}
 	if vary != "" {
 		w.Header().Set("Vary", vary)
 	}
+
+	if o.EnableServerTiming {
+		setDiagnosticsHeaders(w, info, o)
+	}
 	_, _ = w.Write(image.Body)
 }
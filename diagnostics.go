@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ServerTimingHeader is the response header exposing the time spent on every stage of an image request.
+const ServerTimingHeader = "Server-Timing"
+
+// Response headers exposing the details of the input image
+const (
+	ImageInputWidthHeader  = "Image-Input-Width"
+	ImageInputHeightHeader = "Image-Input-Height"
+	ImageInputFormatHeader = "Image-Input-Format"
+	ImageInputBytesHeader  = "Image-Input-Bytes"
+)
+
+// serverTiming formats the Server-Timing header value from the request stages durations,
+// such as: fetch;desc="Source fetch";dur=92.1, process;desc="libvips processing";dur=58.3
+func serverTiming(info *RequestInfo) string {
+	stages := []struct {
+		name, desc string
+		duration   time.Duration
+	}{
+		{"fetch", "Source fetch", info.FetchTime},
+		{"detect", "Type detection", info.DetectTime},
+		{"params", "Parameters parsing", info.ParamsTime},
+		{"queue", "Processing queue", info.QueueTime},
+		{"process", "libvips processing", info.ProcessingTime},
+		{"encode", "Output encoding", info.EncodeTime},
+	}
+
+	metrics := make([]string, len(stages))
+	for i, stage := range stages {
+		ms := float64(stage.duration) / float64(time.Millisecond)
+		metrics[i] = stage.name + `;desc="` + stage.desc + `";dur=` + strconv.FormatFloat(ms, 'f', 3, 64)
+	}
+	return strings.Join(metrics, ", ")
+}
+
+// setDiagnosticsHeaders exposes the request stages timing and the input image details.
+func setDiagnosticsHeaders(w http.ResponseWriter, info *RequestInfo, o ServerOptions) {
+	w.Header().Set(ServerTimingHeader, serverTiming(info))
+	if o.CORS {
+		// Let cross-origin pages read the timing via the Resource Timing API
+		w.Header().Set("Timing-Allow-Origin", "*")
+	}
+
+	w.Header().Set(ImageInputFormatHeader, info.InputFormat)
+	w.Header().Set(ImageInputBytesHeader, strconv.Itoa(info.InputBytes))
+	if info.InputWidth > 0 && info.InputHeight > 0 {
+		w.Header().Set(ImageInputWidthHeader, strconv.Itoa(info.InputWidth))
+		w.Header().Set(ImageInputHeightHeader, strconv.Itoa(info.InputHeight))
+	}
+}
+
+type encodeTimerKey struct{}
+
+// encodeTimer accumulates the time spent encoding the response bodies of an image processing,
+// which can be measured from the goroutines running the multi tasks at the same time.
+type encodeTimer struct {
+	elapsed int64
+}
+
+// withEncodeTimer returns a copy of the context measuring the encoding time in the given timer.
+func withEncodeTimer(ctx context.Context, timer *encodeTimer) context.Context {
+	return context.WithValue(ctx, encodeTimerKey{}, timer)
+}
+
+// observeEncode adds the time elapsed since start to the encoding timer of the context, if any.
+func observeEncode(ctx context.Context, start time.Time) {
+	if timer, ok := ctx.Value(encodeTimerKey{}).(*encodeTimer); ok {
+		atomic.AddInt64(&timer.elapsed, int64(time.Since(start)))
+	}
+}
+
+// Elapsed returns the total encoding time measured.
+func (t *encodeTimer) Elapsed() time.Duration {
+	return time.Duration(atomic.LoadInt64(&t.elapsed))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerTiming(t *testing.T) {
+	info := &RequestInfo{
+		FetchTime:      92 * time.Millisecond,
+		DetectTime:     400 * time.Microsecond,
+		ParamsTime:     20 * time.Microsecond,
+		QueueTime:      3 * time.Millisecond,
+		ProcessingTime: 1500 * time.Millisecond,
+	}
+
+	expected := `fetch;desc="Source fetch";dur=92.000, detect;desc="Type detection";dur=0.400, ` +
+		`params;desc="Parameters parsing";dur=0.020, queue;desc="Processing queue";dur=3.000, ` +
+		`process;desc="libvips processing";dur=1500.000, encode;desc="Output encoding";dur=0.000`
+	if timing := serverTiming(info); timing != expected {
+		t.Fatalf("Invalid Server-Timing header: %s", timing)
+	}
+}
+
+func TestImageHandlerServerTiming(t *testing.T) {
+	op := func(buf []byte, opts ImageOptions) (Image, error) {
+		return Image{Body: []byte("processed"), Mime: "image/jpeg"}, nil
+	}
+
+	buf, _ := ioutil.ReadFile("testdata/large.jpg")
+	for _, enabled := range []bool{false, true} {
+		req := httptest.NewRequest(http.MethodPost, "/resize?width=300", bytes.NewReader(buf))
+		req = req.WithContext(withRequestInfo(req.Context(), &RequestInfo{}))
+		w := httptest.NewRecorder()
+		imageHandler(w, req, buf, ImageSourceMetadata{}, op, ServerOptions{EnableServerTiming: enabled, CORS: true})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Invalid response status: %d", w.Code)
+		}
+
+		timing := w.Header().Get(ServerTimingHeader)
+		if !enabled {
+			if timing != "" || w.Header().Get(ImageInputBytesHeader) != "" {
+				t.Fatal("Diagnostics headers must not be returned if disabled")
+			}
+			continue
+		}
+
+		for _, stage := range []string{"fetch", "detect", "params", "queue", "process", "encode"} {
+			if !strings.Contains(timing, stage+`;desc="`) {
+				t.Errorf("Missing Server-Timing stage %s: %s", stage, timing)
+			}
+		}
+		if w.Header().Get("Timing-Allow-Origin") != "*" {
+			t.Error("Missing Timing-Allow-Origin header")
+		}
+		if w.Header().Get(ImageInputFormatHeader) != "image/jpeg" {
+			t.Errorf("Invalid input format header: %s", w.Header().Get(ImageInputFormatHeader))
+		}
+		if w.Header().Get(ImageInputBytesHeader) != strconv.Itoa(len(buf)) {
+			t.Errorf("Invalid input bytes header: %s", w.Header().Get(ImageInputBytesHeader))
+		}
+		if w.Header().Get(ImageInputWidthHeader) != "1920" || w.Header().Get(ImageInputHeightHeader) != "1080" {
+			t.Errorf("Invalid input size headers: %sx%s", w.Header().Get(ImageInputWidthHeader), w.Header().Get(ImageInputHeightHeader))
+		}
+	}
+}
+
+func TestSetProcessingTimes(t *testing.T) {
+	info := &RequestInfo{}
+	result := processResult{process: 50 * time.Millisecond, encode: 10 * time.Millisecond}
+	setProcessingTimes(info, result, 80*time.Millisecond)
+	if info.QueueTime != 30*time.Millisecond || info.ProcessingTime != 40*time.Millisecond || info.EncodeTime != 10*time.Millisecond {
+		t.Errorf("Invalid processing times: %+v", info)
+	}
+
+	// Requests joining a running call do not wait in the queue
+	info = &RequestInfo{}
+	setProcessingTimes(info, result, 20*time.Millisecond)
+	if info.QueueTime != 0 || info.ProcessingTime != 40*time.Millisecond {
+		t.Errorf("Invalid processing times of a coalesced request: %+v", info)
+	}
+
+	// Requests failing before processing the image only waited in the queue
+	info = &RequestInfo{}
+	setProcessingTimes(info, nil, 20*time.Millisecond)
+	if info.QueueTime != 20*time.Millisecond || info.ProcessingTime != 0 || info.EncodeTime != 0 {
+		t.Errorf("Invalid processing times of a failed request: %+v", info)
+	}
+}
+
+func TestImageHandlerEncodeTiming(t *testing.T) {
+	op := func(buf []byte, opts ImageOptions) (Image, error) {
+		time.Sleep(10 * time.Millisecond)
+		defer observeEncode(opts.Context(), time.Now())
+		time.Sleep(20 * time.Millisecond)
+		return Image{Body: []byte("processed"), Mime: "application/json"}, nil
+	}
+
+	buf, _ := ioutil.ReadFile("testdata/large.jpg")
+	info := &RequestInfo{}
+	req := httptest.NewRequest(http.MethodPost, "/info", bytes.NewReader(buf))
+	req = req.WithContext(withRequestInfo(req.Context(), info))
+	w := httptest.NewRecorder()
+	imageHandler(w, req, buf, ImageSourceMetadata{}, op, ServerOptions{})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Invalid response status: %d", w.Code)
+	}
+	if info.EncodeTime < 20*time.Millisecond {
+		t.Errorf("The encoding time must be measured where the body is encoded: %s", info.EncodeTime)
+	}
+	if info.ProcessingTime < 10*time.Millisecond || info.ProcessingTime >= 30*time.Millisecond {
+		t.Errorf("The processing time must not include the encoding time: %s", info.ProcessingTime)
+	}
+}
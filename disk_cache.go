@@ -0,0 +1,328 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	diskCacheMetadataExt = ".json"
+	diskCacheTempPrefix  = ".tmp-"
+)
+
+// DiskCache is a persistent LRU cache of processed images stored in a local directory,
+// bounded by the total size in bytes of the cached image bodies.
+// Each image is stored next to a JSON metadata sidecar file. Files are written to a temporary
+// file and atomically renamed, so concurrent writers never expose partially written images.
+// The least recently used order is persisted across restarts via the image files modification time.
+// Images expire once cached for longer than the TTL, unless it is zero.
+type DiskCache struct {
+	mutex     sync.Mutex
+	dir       string
+	maxSize   int64
+	ttl       time.Duration
+	size      int64
+	entries   *list.List
+	items     map[string]*list.Element
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// DiskCacheMetadata represents the metadata sidecar of a cached image.
+type DiskCacheMetadata struct {
+	Key     string    `json:"key"`
+	Mime    string    `json:"mime"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+}
+
+type diskCacheEntry struct {
+	key  string
+	size int64
+}
+
+// NewDiskCache creates the cache directory, if required, and loads the previously cached images.
+func NewDiskCache(dir string, maxSize int64, ttl time.Duration) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	c := &DiskCache{
+		dir:     dir,
+		maxSize: maxSize,
+		ttl:     ttl,
+		entries: list.New(),
+		items:   make(map[string]*list.Element),
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load indexes the cached images in least recently used order, removing incomplete and expired ones.
+// Only the shard subdirectories and the files named after a cache key are considered,
+// so any other file in the cache directory is never indexed nor removed.
+func (c *DiskCache) load() error {
+	type cachedFile struct {
+		key     string
+		size    int64
+		modTime time.Time
+	}
+	var files []cachedFile
+
+	shards, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	for _, shard := range shards {
+		if !shard.IsDir() || !isDiskCacheShard(shard.Name()) {
+			continue
+		}
+		infos, err := ioutil.ReadDir(filepath.Join(c.dir, shard.Name()))
+		if err != nil {
+			return err
+		}
+
+		for _, info := range infos {
+			name := info.Name()
+			if info.IsDir() {
+				continue
+			}
+			if strings.HasPrefix(name, diskCacheTempPrefix) {
+				_ = os.Remove(filepath.Join(c.dir, shard.Name(), name))
+				continue
+			}
+			if key := strings.TrimSuffix(name, diskCacheMetadataExt); key != name && isDiskCacheKey(key, shard.Name()) {
+				// Remove metadata sidecars left without image
+				if _, err := os.Stat(c.path(key)); os.IsNotExist(err) {
+					_ = os.Remove(c.path(key) + diskCacheMetadataExt)
+				}
+				continue
+			}
+			if !isDiskCacheKey(name, shard.Name()) {
+				continue
+			}
+
+			meta, err := c.readMetadata(name)
+			if err != nil || meta.Size != info.Size() || isCacheExpired(meta.Created, c.ttl) {
+				c.removeFiles(name)
+				continue
+			}
+			files = append(files, cachedFile{name, info.Size(), info.ModTime()})
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.After(files[j].modTime)
+	})
+	for _, file := range files {
+		c.items[file.key] = c.entries.PushBack(&diskCacheEntry{file.key, file.size})
+		c.size += file.size
+	}
+	for _, key := range c.evict() {
+		c.removeFiles(key)
+	}
+	return nil
+}
+
+// Get returns the cached image for the given key, if present.
+func (c *DiskCache) Get(key string) (Image, bool) {
+	c.mutex.Lock()
+	_, ok := c.items[key]
+	c.mutex.Unlock()
+
+	var image Image
+	var err error = os.ErrNotExist
+	if ok {
+		image, err = c.read(key)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.items[key]
+	if ok && err == nil {
+		c.hits++
+		c.entries.MoveToFront(element)
+		now := time.Now()
+		_ = os.Chtimes(c.path(key), now, now)
+		return image, true
+	}
+
+	// Forget the image if its files were removed, are unreadable or expired
+	if ok {
+		c.remove(element)
+		c.removeFiles(key)
+	}
+	c.misses++
+	return Image{}, false
+}
+
+// Add stores the image in the cache, evicting the least recently used entries if required.
+// Images larger than the whole cache are ignored.
+func (c *DiskCache) Add(key string, image Image) {
+	size := int64(len(image.Body))
+	if size > c.maxSize {
+		return
+	}
+
+	if err := c.write(key, image); err != nil {
+		return
+	}
+
+	c.mutex.Lock()
+	if element, ok := c.items[key]; ok {
+		c.remove(element)
+	}
+	c.items[key] = c.entries.PushFront(&diskCacheEntry{key, size})
+	c.size += size
+	evicted := c.evict()
+	c.mutex.Unlock()
+
+	for _, key := range evicted {
+		c.removeFiles(key)
+	}
+}
+
+// Stats returns the cache usage statistics.
+func (c *DiskCache) Stats() CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return CacheStats{
+		Entries:   c.entries.Len(),
+		Size:      c.size,
+		MaxSize:   c.maxSize,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+}
+
+// evict removes the least recently used entries from the index until the cache fits its maximum size,
+// returning the keys whose files must be removed.
+func (c *DiskCache) evict() []string {
+	var keys []string
+	for c.size > c.maxSize {
+		keys = append(keys, c.remove(c.entries.Back()))
+		c.evictions++
+	}
+	return keys
+}
+
+func (c *DiskCache) remove(element *list.Element) string {
+	entry := c.entries.Remove(element).(*diskCacheEntry)
+	delete(c.items, entry.key)
+	c.size -= entry.size
+	return entry.key
+}
+
+func (c *DiskCache) read(key string) (Image, error) {
+	meta, err := c.readMetadata(key)
+	if err != nil {
+		return Image{}, err
+	}
+
+	buf, err := ioutil.ReadFile(c.path(key))
+	if err != nil {
+		return Image{}, err
+	}
+	if int64(len(buf)) != meta.Size || isCacheExpired(meta.Created, c.ttl) {
+		return Image{}, os.ErrNotExist
+	}
+	return Image{Body: buf, Mime: meta.Mime}, nil
+}
+
+func (c *DiskCache) readMetadata(key string) (DiskCacheMetadata, error) {
+	var meta DiskCacheMetadata
+	buf, err := ioutil.ReadFile(c.path(key) + diskCacheMetadataExt)
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(buf, &meta)
+	return meta, err
+}
+
+// write stores the image body first and the metadata sidecar afterwards,
+// so an image is only considered cached once both files are complete.
+func (c *DiskCache) write(key string, image Image) error {
+	file := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	meta, _ := json.Marshal(DiskCacheMetadata{
+		Key:     key,
+		Mime:    image.Mime,
+		Size:    int64(len(image.Body)),
+		Created: time.Now().UTC(),
+	})
+
+	if err := writeFileAtomic(file, image.Body); err != nil {
+		return err
+	}
+	return writeFileAtomic(file+diskCacheMetadataExt, meta)
+}
+
+func (c *DiskCache) removeFiles(key string) {
+	file := c.path(key)
+	_ = os.Remove(file + diskCacheMetadataExt)
+	_ = os.Remove(file)
+}
+
+// path returns the image file path, sharding the files in subdirectories by key prefix.
+func (c *DiskCache) path(key string) string {
+	if len(key) < 2 {
+		return filepath.Join(c.dir, key)
+	}
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+// isDiskCacheShard returns true if the directory name is a valid shard: the first two characters of a cache key.
+func isDiskCacheShard(name string) bool {
+	return len(name) == 2 && isLowerHex(name)
+}
+
+// isDiskCacheKey returns true if the file name is a cache key, a hex encoded SHA-256 hash, stored in the given shard.
+func isDiskCacheKey(name, shard string) bool {
+	return len(name) == 2*sha256.Size && strings.HasPrefix(name, shard) && isLowerHex(name)
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// writeFileAtomic writes the file to a temporary file in the same directory and renames it.
+func writeFileAtomic(file string, buf []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), diskCacheTempPrefix)
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(buf)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
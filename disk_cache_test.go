@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imaginary-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewDiskCache(dir, 10, 0)
+	if err != nil {
+		t.Fatalf("Cannot create the disk cache: %s", err)
+	}
+
+	cache.Add("foo", Image{Body: []byte("1234"), Mime: "image/webp"})
+	cache.Add("bar", Image{Body: []byte("1234"), Mime: "image/png"})
+
+	image, ok := cache.Get("foo")
+	if !ok || string(image.Body) != "1234" || image.Mime != "image/webp" {
+		t.Fatalf("Invalid cached image: %#v", image)
+	}
+
+	// Evicts bar, since foo has been recently used
+	cache.Add("baz", Image{Body: []byte("1234"), Mime: "image/jpeg"})
+	if _, ok := cache.Get("bar"); ok {
+		t.Fatal("Unexpected cached image: bar")
+	}
+	if _, err := os.Stat(cache.path("bar")); !os.IsNotExist(err) {
+		t.Fatal("Evicted image file must be removed")
+	}
+
+	stats := cache.Stats()
+	expected := CacheStats{Entries: 2, Size: 8, MaxSize: 10, Hits: 1, Misses: 1, Evictions: 1}
+	if stats != expected {
+		t.Fatalf("Invalid cache stats: %#v", stats)
+	}
+}
+
+// diskCacheTestKey returns a cache key for the given name, since the disk cache only loads files named after a key.
+func diskCacheTestKey(name string) string {
+	return newCacheKey("test", ImageOptions{}, name)
+}
+
+func TestDiskCacheLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imaginary-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	foo, bar, incomplete := diskCacheTestKey("foo"), diskCacheTestKey("bar"), diskCacheTestKey("incomplete")
+	cache, _ := NewDiskCache(dir, 1024, 0)
+	cache.Add(foo, Image{Body: []byte("1234"), Mime: "image/webp"})
+	cache.Add(bar, Image{Body: []byte("5678"), Mime: "image/png"})
+
+	// Leftovers of interrupted writes
+	tmp := filepath.Join(filepath.Dir(cache.path(foo)), diskCacheTempPrefix+"123")
+	_ = ioutil.WriteFile(tmp, []byte("12"), 0644)
+	_ = os.MkdirAll(filepath.Dir(cache.path(incomplete)), 0755)
+	_ = ioutil.WriteFile(cache.path(incomplete), []byte("12"), 0644)
+
+	cache, err = NewDiskCache(dir, 1024, 0)
+	if err != nil {
+		t.Fatalf("Cannot load the disk cache: %s", err)
+	}
+
+	image, ok := cache.Get(bar)
+	if !ok || string(image.Body) != "5678" || image.Mime != "image/png" {
+		t.Fatalf("Invalid cached image: %#v", image)
+	}
+	if _, ok := cache.Get(incomplete); ok {
+		t.Fatal("Unexpected cached image: incomplete")
+	}
+	if _, err := os.Stat(cache.path(incomplete)); !os.IsNotExist(err) {
+		t.Fatal("Incomplete images must be removed")
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Fatal("Temporary files must be removed")
+	}
+	if stats := cache.Stats(); stats.Entries != 2 || stats.Size != 8 {
+		t.Fatalf("Invalid cache stats: %#v", stats)
+	}
+}
+
+func TestDiskCacheLoadIgnoresOtherFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imaginary-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Files unrelated to the cache, such as a cache directory misconfigured as a data directory
+	key := diskCacheTestKey("foo")
+	other := []string{
+		filepath.Join(dir, "photo.jpg"),
+		filepath.Join(dir, "photos", "photo.jpg"),
+		filepath.Join(dir, "photos", diskCacheTempPrefix+"123"),
+		filepath.Join(dir, key[:2], "photo.jpg"),
+		filepath.Join(dir, key[:2], "photo.jpg"+diskCacheMetadataExt),
+		filepath.Join(dir, key[:2], "ff"+key[2:]),
+		filepath.Join(dir, "AB", key),
+	}
+	for _, file := range other {
+		_ = os.MkdirAll(filepath.Dir(file), 0755)
+		_ = ioutil.WriteFile(file, []byte("12"), 0644)
+	}
+
+	cache, err := NewDiskCache(dir, 1, 0)
+	if err != nil {
+		t.Fatalf("Cannot load the disk cache: %s", err)
+	}
+	if stats := cache.Stats(); stats.Entries != 0 || stats.Size != 0 {
+		t.Fatalf("Invalid cache stats: %#v", stats)
+	}
+	for _, file := range other {
+		if _, err := os.Stat(file); err != nil {
+			t.Errorf("Unrelated file must not be removed: %s", file)
+		}
+	}
+}
+
+func TestDiskCacheTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imaginary-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	foo, bar := diskCacheTestKey("foo"), diskCacheTestKey("bar")
+	cache, _ := NewDiskCache(dir, 1024, 20*time.Millisecond)
+	cache.Add(foo, Image{Body: []byte("1234"), Mime: "image/webp"})
+	cache.Add(bar, Image{Body: []byte("5678"), Mime: "image/png"})
+	if _, ok := cache.Get(foo); !ok {
+		t.Fatal("Expected cached image: foo")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := cache.Get(foo); ok {
+		t.Fatal("Unexpected expired image: foo")
+	}
+	if _, err := os.Stat(cache.path(foo)); !os.IsNotExist(err) {
+		t.Fatal("Expired image file must be removed")
+	}
+
+	// Expired images are removed when loaded as well
+	cache, err = NewDiskCache(dir, 1024, 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Cannot load the disk cache: %s", err)
+	}
+	if stats := cache.Stats(); stats.Entries != 0 {
+		t.Fatalf("Invalid cache stats: %#v", stats)
+	}
+	if _, err := os.Stat(cache.path(bar)); !os.IsNotExist(err) {
+		t.Fatal("Expired image file must be removed")
+	}
+}
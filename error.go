@@ -10,20 +10,42 @@ import (
 )
 
 var (
-	ErrNotFound             = NewError("Not found", http.StatusNotFound)
-	ErrInvalidAPIKey        = NewError("Invalid or missing API key", http.StatusUnauthorized)
-	ErrMethodNotAllowed     = NewError("HTTP method not allowed. Try with a POST or GET method (-enable-url-source flag must be defined)", http.StatusMethodNotAllowed)
-	ErrGetMethodNotAllowed  = NewError("GET method not allowed. Make sure remote URL source is enabled by using the flag: -enable-url-source", http.StatusMethodNotAllowed)
-	ErrUnsupportedMedia     = NewError("Unsupported media type", http.StatusNotAcceptable)
-	ErrOutputFormat         = NewError("Unsupported output image format", http.StatusBadRequest)
-	ErrEmptyBody            = NewError("Empty or unreadable image", http.StatusBadRequest)
-	ErrMissingParamFile     = NewError("Missing required param: file", http.StatusBadRequest)
-	ErrInvalidFilePath      = NewError("Invalid file path", http.StatusBadRequest)
-	ErrInvalidImageURL      = NewError("Unvalid image URL", http.StatusBadRequest)
-	ErrMissingImageSource   = NewError("Cannot process the image due to missing or invalid params", http.StatusBadRequest)
-	ErrNotImplemented       = NewError("Not implemented endpoint", http.StatusNotImplemented)
-	ErrInvalidURLSignature  = NewError("Invalid URL signature", http.StatusBadRequest)
-	ErrURLSignatureMismatch = NewError("URL signature mismatch", http.StatusForbidden)
+	ErrNotFound                = NewError("Not found", http.StatusNotFound)
+	ErrInvalidAPIKey           = NewError("Invalid or missing API key", http.StatusUnauthorized)
+	ErrMethodNotAllowed        = NewError("HTTP method not allowed. Try with a POST or GET method (-enable-url-source flag must be defined)", http.StatusMethodNotAllowed)
+	ErrGetMethodNotAllowed     = NewError("GET method not allowed. Make sure remote URL source is enabled by using the flag: -enable-url-source", http.StatusMethodNotAllowed)
+	ErrUnsupportedMedia        = NewError("Unsupported media type", http.StatusNotAcceptable)
+	ErrOutputFormat            = NewError("Unsupported output image format", http.StatusBadRequest)
+	ErrEmptyBody               = NewError("Empty or unreadable image", http.StatusBadRequest)
+	ErrMaxAllowedSize          = NewError("Image exceeds the maximum allowed size", http.StatusRequestEntityTooLarge)
+	ErrMissingParamFile        = NewError("Missing required param: file", http.StatusBadRequest)
+	ErrMissingParamObject      = NewError("Missing required param: object", http.StatusBadRequest)
+	ErrMissingParamBucket      = NewError("Missing required param: bucket", http.StatusBadRequest)
+	ErrInvalidBucketName       = NewError("Invalid S3 bucket name", http.StatusBadRequest)
+	ErrBucketNotAllowed        = NewError("S3 bucket not allowed", http.StatusForbidden)
+	ErrInvalidFilePath         = NewError("Invalid file path", http.StatusBadRequest)
+	ErrInvalidImageURL         = NewError("Unvalid image URL", http.StatusBadRequest)
+	ErrInvalidURLScheme        = NewError("Invalid image URL scheme. Only http and https are allowed", http.StatusBadRequest)
+	ErrRemoteAddressNotAllowed = NewError("Remote image URL resolves to a not allowed address", http.StatusForbidden)
+	ErrMissingImageSource      = NewError("Cannot process the image due to missing or invalid params", http.StatusBadRequest)
+	ErrNotImplemented          = NewError("Not implemented endpoint", http.StatusNotImplemented)
+	ErrInvalidURLSignature     = NewError("Invalid URL signature", http.StatusBadRequest)
+	ErrURLSignatureMismatch    = NewError("URL signature mismatch", http.StatusForbidden)
+	ErrURLSignatureExpired     = NewError("URL signature expired", http.StatusForbidden)
+	ErrURLSignatureUnknownKey  = NewError("Unknown URL signature key ID", http.StatusForbidden)
+	ErrMissingBearerToken      = NewError("Missing bearer token", http.StatusUnauthorized)
+	ErrAPIKeyEndpointDenied    = NewError("Endpoint not allowed for the client", http.StatusForbidden)
+	ErrAPIKeySourceNotAllowed  = NewError("Image source not allowed for the client", http.StatusForbidden)
+	ErrAPIKeyOriginNotAllowed  = NewError("Image origin not allowed for the client", http.StatusForbidden)
+	ErrAPIKeyRateLimited       = NewError("API key rate limit exceeded", http.StatusTooManyRequests)
+	ErrRateLimited             = NewError("Rate limit exceeded", http.StatusTooManyRequests)
+	ErrProcessingQueueFull     = NewError("Server busy, the processing queue is full", http.StatusServiceUnavailable)
+	ErrProcessingQueueTimeout  = NewError("Server busy, timeout waiting for a processing worker", http.StatusServiceUnavailable)
+	ErrMemoryBudgetExceeded    = NewError("Server busy, not enough memory to process the image", http.StatusServiceUnavailable)
+	ErrImageTooLargeForMemory  = NewError("Image exceeds the server memory budget", http.StatusRequestEntityTooLarge)
+	ErrInvalidRequestTimeout   = NewError("Invalid "+RequestTimeoutHeader+" header", http.StatusBadRequest)
+	ErrRequestTimeout          = NewError("Request timeout exceeded", http.StatusGatewayTimeout)
+	ErrRequestCanceled         = NewError("Request canceled by the client", StatusClientClosedRequest)
 )
 
 type Error struct {
@@ -103,6 +125,8 @@ func replyWithPlaceholder(req *http.Request, w http.ResponseWriter, errCaller Er
 }
 
 func ErrorReply(req *http.Request, w http.ResponseWriter, err Error, o ServerOptions) {
+	requestInfoFrom(req.Context()).Error = err.Message
+
 	// Reply with placeholder if required
 	if o.EnablePlaceholder || o.Placeholder != "" {
 		_ = replyWithPlaceholder(req, w, err, o)
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// maxExpressionLength and maxExpressionDepth bound the expressions, since they are parsed recursively.
+const (
+	maxExpressionLength = 256
+	maxExpressionDepth  = 32
+)
+
+// ExpressionPrefix marks a pipeline step param value as an expression evaluated against the current image,
+// such as "=min(width, 1200)".
+const ExpressionPrefix = "="
+
+// ImageVariables defines the metadata of the current image which pipeline expressions can reference.
+// Width and height are the displayed dimensions, taking into account the EXIF orientation.
+type ImageVariables struct {
+	Width       int
+	Height      int
+	Orientation int
+	Alpha       bool
+	Type        string
+}
+
+func (v ImageVariables) lookup(name string) (interface{}, bool) {
+	switch name {
+	case "width":
+		return float64(v.Width), true
+	case "height":
+		return float64(v.Height), true
+	case "orientation":
+		return float64(v.Orientation), true
+	case "alpha":
+		return v.Alpha, true
+	case "type":
+		return v.Type, true
+	}
+	return nil, false
+}
+
+// Expression is a parsed expression, evaluated to a number, a boolean or a string.
+type Expression func(ImageVariables) (interface{}, error)
+
+type expressionFunc func(args []float64) (float64, error)
+
+// expressionFuncs defines the functions supported by expressions.
+var expressionFuncs = map[string]expressionFunc{
+	"min": func(args []float64) (float64, error) {
+		if len(args) == 0 {
+			return 0, errors.New("min requires at least one argument")
+		}
+		result := args[0]
+		for _, arg := range args[1:] {
+			result = math.Min(result, arg)
+		}
+		return result, nil
+	},
+	"max": func(args []float64) (float64, error) {
+		if len(args) == 0 {
+			return 0, errors.New("max requires at least one argument")
+		}
+		result := args[0]
+		for _, arg := range args[1:] {
+			result = math.Max(result, arg)
+		}
+		return result, nil
+	},
+	"round": func(args []float64) (float64, error) {
+		if len(args) != 1 {
+			return 0, errors.New("round requires one argument")
+		}
+		return math.Round(args[0]), nil
+	},
+}
+
+// ParseExpression parses an expression made of numbers, quoted strings, true and false, the image variables
+// (width, height, orientation, alpha and type), the min, max and round functions, the arithmetic
+// operators + - * /, the comparison operators == != < <= > >= and the logical operators && || !.
+func ParseExpression(src string) (Expression, error) {
+	if len(src) > maxExpressionLength {
+		return nil, fmt.Errorf("expression exceeds the maximum length of %d bytes", maxExpressionLength)
+	}
+
+	tokens, err := tokenizeExpression(src)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %s", src, err)
+	}
+
+	p := &expressionParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %s", src, err)
+	}
+	return expr, nil
+}
+
+// EvalCondition evaluates an expression which must return a boolean.
+func (e Expression) EvalCondition(vars ImageVariables) (bool, error) {
+	value, err := e(vars)
+	if err != nil {
+		return false, err
+	}
+	result, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("condition evaluated to %v instead of a boolean", value)
+	}
+	return result, nil
+}
+
+type tokenKind int
+
+const (
+	tokenNumber tokenKind = iota
+	tokenString
+	tokenIdent
+	tokenOperator
+)
+
+type expressionToken struct {
+	kind tokenKind
+	text string
+	num  float64
+}
+
+var expressionOperators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "+", "-", "*", "/", "(", ")", ","}
+
+func tokenizeExpression(src string) ([]expressionToken, error) {
+	var tokens []expressionToken
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c) || c == '.':
+			j := i
+			for j < len(src) && (unicode.IsDigit(rune(src[j])) || src[j] == '.') {
+				j++
+			}
+			num, err := strconv.ParseFloat(src[i:j], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q", src[i:j])
+			}
+			tokens = append(tokens, expressionToken{kind: tokenNumber, text: src[i:j], num: num})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(src) && (unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j])) || src[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, expressionToken{kind: tokenIdent, text: src[i:j]})
+			i = j
+		case c == '\'' || c == '"':
+			j := strings.IndexByte(src[i+1:], src[i])
+			if j < 0 {
+				return nil, errors.New("unterminated string")
+			}
+			tokens = append(tokens, expressionToken{kind: tokenString, text: src[i+1 : i+1+j]})
+			i += j + 2
+		default:
+			var op string
+			for _, candidate := range expressionOperators {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected character %q", c)
+			}
+			tokens = append(tokens, expressionToken{kind: tokenOperator, text: op})
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+// expressionParser builds the expression by recursive descent, from the lowest to the highest precedence.
+type expressionParser struct {
+	tokens []expressionToken
+	pos    int
+	depth  int
+}
+
+// enter increments the nesting depth of parentheses, function calls and unary operators.
+func (p *expressionParser) enter() error {
+	p.depth++
+	if p.depth > maxExpressionDepth {
+		return fmt.Errorf("expression exceeds the maximum nesting depth of %d", maxExpressionDepth)
+	}
+	return nil
+}
+
+func (p *expressionParser) leave() {
+	p.depth--
+}
+
+func (p *expressionParser) accept(ops ...string) (string, bool) {
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == tokenOperator {
+		for _, op := range ops {
+			if p.tokens[p.pos].text == op {
+				p.pos++
+				return op, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (p *expressionParser) parseOr() (Expression, error) {
+	left, err := p.parseAnd()
+	for err == nil {
+		if _, ok := p.accept("||"); !ok {
+			break
+		}
+		var right Expression
+		if right, err = p.parseAnd(); err == nil {
+			left = logicalExpression(left, right, true)
+		}
+	}
+	return left, err
+}
+
+func (p *expressionParser) parseAnd() (Expression, error) {
+	left, err := p.parseNot()
+	for err == nil {
+		if _, ok := p.accept("&&"); !ok {
+			break
+		}
+		var right Expression
+		if right, err = p.parseNot(); err == nil {
+			left = logicalExpression(left, right, false)
+		}
+	}
+	return left, err
+}
+
+func (p *expressionParser) parseNot() (Expression, error) {
+	if _, ok := p.accept("!"); !ok {
+		return p.parseComparison()
+	}
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+	operand, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	return func(vars ImageVariables) (interface{}, error) {
+		result, err := operand.EvalCondition(vars)
+		return !result, err
+	}, nil
+}
+
+func (p *expressionParser) parseComparison() (Expression, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.accept("==", "!=", "<=", ">=", "<", ">")
+	if !ok {
+		return left, nil
+	}
+	right, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	return func(vars ImageVariables) (interface{}, error) {
+		a, b, err := evalOperands(vars, left, right)
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case "==":
+			return a == b, nil
+		case "!=":
+			return a != b, nil
+		}
+		x, y, err := numberOperands(op, a, b)
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case "<":
+			return x < y, nil
+		case "<=":
+			return x <= y, nil
+		case ">":
+			return x > y, nil
+		default:
+			return x >= y, nil
+		}
+	}, nil
+}
+
+func (p *expressionParser) parseAdditive() (Expression, error) {
+	left, err := p.parseMultiplicative()
+	for err == nil {
+		op, ok := p.accept("+", "-")
+		if !ok {
+			break
+		}
+		var right Expression
+		if right, err = p.parseMultiplicative(); err == nil {
+			left = arithmeticExpression(op, left, right)
+		}
+	}
+	return left, err
+}
+
+func (p *expressionParser) parseMultiplicative() (Expression, error) {
+	left, err := p.parseUnary()
+	for err == nil {
+		op, ok := p.accept("*", "/")
+		if !ok {
+			break
+		}
+		var right Expression
+		if right, err = p.parseUnary(); err == nil {
+			left = arithmeticExpression(op, left, right)
+		}
+	}
+	return left, err
+}
+
+func (p *expressionParser) parseUnary() (Expression, error) {
+	if _, ok := p.accept("-"); !ok {
+		return p.parsePrimary()
+	}
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+	operand, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	zero := func(ImageVariables) (interface{}, error) { return float64(0), nil }
+	return arithmeticExpression("-", zero, operand), nil
+}
+
+func (p *expressionParser) parsePrimary() (Expression, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, errors.New("unexpected end of expression")
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+
+	switch token.kind {
+	case tokenNumber:
+		return constantExpression(token.num), nil
+	case tokenString:
+		return constantExpression(token.text), nil
+	case tokenIdent:
+		if _, ok := p.accept("("); ok {
+			return p.parseCall(token.text)
+		}
+		switch token.text {
+		case "true":
+			return constantExpression(true), nil
+		case "false":
+			return constantExpression(false), nil
+		}
+		if _, ok := (ImageVariables{}).lookup(token.text); !ok {
+			return nil, fmt.Errorf("unknown variable %q", token.text)
+		}
+		name := token.text
+		return func(vars ImageVariables) (interface{}, error) {
+			value, _ := vars.lookup(name)
+			return value, nil
+		}, nil
+	}
+
+	if token.text == "(" {
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.accept(")"); !ok {
+			return nil, errors.New("missing closing parenthesis")
+		}
+		return expr, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", token.text)
+}
+
+func (p *expressionParser) parseCall(name string) (Expression, error) {
+	fn, ok := expressionFuncs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q", name)
+	}
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+
+	var args []Expression
+	if _, ok := p.accept(")"); !ok {
+		for {
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if _, ok := p.accept(","); ok {
+				continue
+			}
+			if _, ok := p.accept(")"); !ok {
+				return nil, fmt.Errorf("missing closing parenthesis of %s", name)
+			}
+			break
+		}
+	}
+
+	return func(vars ImageVariables) (interface{}, error) {
+		values := make([]float64, len(args))
+		for i, arg := range args {
+			value, err := arg(vars)
+			if err != nil {
+				return nil, err
+			}
+			number, ok := value.(float64)
+			if !ok {
+				return nil, fmt.Errorf("%s requires numeric arguments, got %v", name, value)
+			}
+			values[i] = number
+		}
+		return fn(values)
+	}, nil
+}
+
+func constantExpression(value interface{}) Expression {
+	return func(ImageVariables) (interface{}, error) {
+		return value, nil
+	}
+}
+
+func logicalExpression(left, right Expression, or bool) Expression {
+	return func(vars ImageVariables) (interface{}, error) {
+		result, err := left.EvalCondition(vars)
+		if err != nil || result == or {
+			return result, err
+		}
+		return right.EvalCondition(vars)
+	}
+}
+
+func arithmeticExpression(op string, left, right Expression) Expression {
+	return func(vars ImageVariables) (interface{}, error) {
+		a, b, err := evalOperands(vars, left, right)
+		if err != nil {
+			return nil, err
+		}
+		x, y, err := numberOperands(op, a, b)
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case "+":
+			return x + y, nil
+		case "-":
+			return x - y, nil
+		case "*":
+			return x * y, nil
+		}
+		if y == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return x / y, nil
+	}
+}
+
+func evalOperands(vars ImageVariables, left, right Expression) (interface{}, interface{}, error) {
+	a, err := left(vars)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := right(vars)
+	return a, b, err
+}
+
+func numberOperands(op string, a, b interface{}) (float64, float64, error) {
+	x, ok := a.(float64)
+	y, ok2 := b.(float64)
+	if !ok || !ok2 {
+		return 0, 0, fmt.Errorf("operator %s requires numbers, got %v and %v", op, a, b)
+	}
+	return x, y, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/h2non/bimg"
+)
+
+func TestParseExpression(t *testing.T) {
+	vars := ImageVariables{Width: 1600, Height: 900, Orientation: 1, Alpha: true, Type: "png"}
+
+	cases := []struct {
+		expr     string
+		expected interface{}
+	}{
+		{"min(width, 1200)", float64(1200)},
+		{"max(width, height, 2000)", float64(2000)},
+		{"round(width / 3)", float64(533)},
+		{"width * 2 - -10", float64(3210)},
+		{"(width + height) / 2", float64(1250)},
+		{"width > height", true},
+		{"width <= 1600 && height >= 1000", false},
+		{"alpha && type == 'png'", true},
+		{`type != "jpeg" || orientation > 4`, true},
+		{"!alpha", false},
+		{"!(width < height)", true},
+		{"orientation == 1", true},
+		{"true", true},
+	}
+	for _, c := range cases {
+		expr, err := ParseExpression(c.expr)
+		if err != nil {
+			t.Errorf("Cannot parse %s: %s", c.expr, err)
+			continue
+		}
+		value, err := expr(vars)
+		if err != nil || value != c.expected {
+			t.Errorf("Invalid value of %s: %v %v", c.expr, value, err)
+		}
+	}
+}
+
+func TestParseInvalidExpression(t *testing.T) {
+	for _, src := range []string{"", "width >", "foo > 1", "sqrt(width)", "min(width", "(width", "width height", "'png", "width # 2", "1..2"} {
+		if _, err := ParseExpression(src); err == nil {
+			t.Errorf("Invalid expression must be rejected: %s", src)
+		}
+	}
+}
+
+func TestParseExpressionLimits(t *testing.T) {
+	nested := func(open, close string, n int) string {
+		return strings.Repeat(open, n) + "1" + strings.Repeat(close, n)
+	}
+	for _, src := range []string{nested("(", ")", 32), nested("min(", ")", 32), strings.Repeat("!", 32) + "true", strings.Repeat("-", 32) + "1"} {
+		if _, err := ParseExpression(src); err != nil {
+			t.Errorf("Cannot parse %s: %s", src, err)
+		}
+	}
+
+	for _, src := range []string{nested("(", ")", 33), nested("min(", ")", 33), strings.Repeat("!", 33) + "true", strings.Repeat("-", 33) + "1", nested("(", ")", 500000)} {
+		if _, err := ParseExpression(src); err == nil {
+			t.Errorf("Deeply nested expressions must be rejected: %.40s", src)
+		}
+	}
+	if _, err := ParseExpression("width > " + strings.Repeat("1", 250)); err == nil {
+		t.Error("Long expressions must be rejected")
+	}
+
+	operation := PipelineOperation{Name: "resize", When: nested("(", ")", 100) + " == 1"}
+	err := parseOperationExpressions(&operation)
+	if xerr, ok := err.(Error); !ok || xerr.HTTPCode() != http.StatusBadRequest {
+		t.Fatalf("Invalid error: %v", err)
+	}
+}
+
+func TestEvalExpressionErrors(t *testing.T) {
+	vars := ImageVariables{Width: 100, Height: 100, Type: "jpeg"}
+	for _, src := range []string{"type > 1", "width + type", "min(type)", "min()", "round(1, 2)", "width / 0", "!width", "alpha || width"} {
+		expr, err := ParseExpression(src)
+		if err != nil {
+			t.Errorf("Cannot parse %s: %s", src, err)
+			continue
+		}
+		if _, err := expr.EvalCondition(vars); err == nil {
+			t.Errorf("Invalid evaluation must fail: %s", src)
+		}
+	}
+
+	expr, _ := ParseExpression("width")
+	if _, err := expr.EvalCondition(vars); err == nil {
+		t.Error("Non boolean conditions must fail")
+	}
+}
+
+func TestParseOperationExpressions(t *testing.T) {
+	operation := PipelineOperation{
+		Name: "resize",
+		When: "width > 1200",
+		Params: map[string]interface{}{
+			"width":   "=min(width, 1200)",
+			"quality": 80,
+			"text":    "foo",
+		},
+	}
+	if err := parseOperationExpressions(&operation); err != nil {
+		t.Fatalf("Cannot parse the operation expressions: %s", err)
+	}
+	if operation.condition == nil || len(operation.expressions) != 1 || operation.expressions["width"] == nil {
+		t.Fatalf("Invalid operation expressions: %#v", operation)
+	}
+	if params := staticParams(operation); len(params) != 2 || params["width"] != nil {
+		t.Fatalf("Invalid static params: %v", params)
+	}
+
+	operation.Params["width"] = "=min(width,"
+	if err := parseOperationExpressions(&operation); err == nil {
+		t.Fatal("Invalid param expressions must be rejected")
+	}
+	operation.Params["width"] = 100
+	operation.When = "foo"
+	if err := parseOperationExpressions(&operation); err == nil {
+		t.Fatal("Invalid conditions must be rejected")
+	}
+}
+
+func TestResolveOperationInvalidResults(t *testing.T) {
+	buf, _ := ioutil.ReadFile("testdata/large.jpg")
+	for _, expr := range []string{"=1 / 0", "=0 / 0", "=-10", "=10000000000 * 10000000000"} {
+		operation := PipelineOperation{Name: "resize", Params: map[string]interface{}{"width": expr}}
+		if err := parseOperationExpressions(&operation); err != nil {
+			t.Fatalf("Cannot parse the operation expressions: %s", err)
+		}
+		_, _, err := resolveOperation(operation, buf, bimg.JPEG, ImageLimits{})
+		if xerr, ok := err.(Error); !ok || xerr.HTTPCode() != http.StatusBadRequest {
+			t.Errorf("Invalid param result %s must be rejected: %v", expr, err)
+		}
+	}
+
+	// Only the dimension params cannot be negative
+	operation := PipelineOperation{Name: "rotate", Params: map[string]interface{}{"rotate": "=-90"}}
+	if err := parseOperationExpressions(&operation); err != nil {
+		t.Fatalf("Cannot parse the operation expressions: %s", err)
+	}
+	if _, _, err := resolveOperation(operation, buf, bimg.JPEG, ImageLimits{}); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
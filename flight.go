@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errFlightPanicked = errors.New("coalesced call panicked")
+
+// fetchFlight coalesces concurrent identical remote image fetches.
+var fetchFlight = &flightGroup{}
+
+// processFlight coalesces concurrent identical image transformations.
+var processFlight = &flightGroup{}
+
+// flightGroup deduplicates concurrent calls sharing the same key: only the first caller
+// runs the function, while every other caller waits for it and shares its result.
+type flightGroup struct {
+	mutex sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done    chan struct{}
+	value   interface{}
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// Do runs the function once for every set of concurrent calls with the same key.
+// The returned shared flag is true if the result was produced by another caller.
+func (g *flightGroup) Do(key string, fn func() (interface{}, error)) (value interface{}, err error, shared bool) {
+	return g.DoContext(context.Background(), key, func(context.Context) (interface{}, error) {
+		return fn()
+	})
+}
+
+// DoContext runs the function once for every set of concurrent calls with the same key,
+// returning early with the context error if the caller context is done. The function
+// context keeps the values of the first caller context, and is only canceled once
+// every caller waiting for the result is gone.
+func (g *flightGroup) DoContext(ctx context.Context, key string, fn func(context.Context) (interface{}, error)) (value interface{}, err error, shared bool) {
+	g.mutex.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	call, shared := g.calls[key]
+	if !shared {
+		callCtx, cancel := context.WithCancel(detachedContext{ctx})
+		call = &flightCall{done: make(chan struct{}), err: errFlightPanicked, cancel: cancel}
+		g.calls[key] = call
+		go g.run(callCtx, key, call, fn)
+	}
+	call.waiters++
+	g.mutex.Unlock()
+
+	select {
+	case <-call.done:
+		return call.value, call.err, shared
+	case <-ctx.Done():
+		g.mutex.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			g.forget(key, call)
+			call.cancel()
+		}
+		g.mutex.Unlock()
+		return nil, ctx.Err(), shared
+	}
+}
+
+func (g *flightGroup) run(ctx context.Context, key string, call *flightCall, fn func(context.Context) (interface{}, error)) {
+	// Release the waiters even if the function panics
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Coalesced call panicked: %v", r)
+		}
+		g.mutex.Lock()
+		g.forget(key, call)
+		g.mutex.Unlock()
+		call.cancel()
+		close(call.done)
+	}()
+
+	call.value, call.err = fn(ctx)
+}
+
+// forget removes the call, so new callers run the function again. It must be called with the mutex held.
+func (g *flightGroup) forget(key string, call *flightCall) {
+	if g.calls[key] == call {
+		delete(g.calls, key)
+	}
+}
+
+// detachedContext keeps the values of the parent context, such as the trace span,
+// but is never canceled by it.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+// flightRequestKey identifies an outbound request by its method, URL and headers,
+// so requests forwarding different credentials are never coalesced.
+// The trace context headers are ignored, since they differ on every request.
+func flightRequestKey(req *http.Request) string {
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		if name == http.CanonicalHeaderKey(TraceParentHeader) || name == http.CanonicalHeaderKey(TraceStateHeader) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(req.Method + " " + req.URL.String())
+	for _, name := range names {
+		b.WriteString("\n" + name + ": " + strings.Join(req.Header[name], ","))
+	}
+	return b.String()
+}
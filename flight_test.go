@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroupCoalescesCalls(t *testing.T) {
+	group := &flightGroup{}
+	var calls int32
+	var sharedCalls int32
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err, shared := group.Do("foo", func() (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				time.Sleep(100 * time.Millisecond)
+				return "bar", nil
+			})
+			if err != nil || value.(string) != "bar" {
+				t.Errorf("Invalid result: %v, %v", value, err)
+			}
+			if shared {
+				atomic.AddInt32(&sharedCalls, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls != 1 || sharedCalls != 9 {
+		t.Fatalf("Calls must be coalesced, got %d calls and %d shared results", calls, sharedCalls)
+	}
+
+	// Calls are not coalesced once finished
+	_, _, shared := group.Do("foo", func() (interface{}, error) { return nil, nil })
+	if shared {
+		t.Fatal("Finished calls must not be shared")
+	}
+}
+
+func TestFlightGroupSharesErrors(t *testing.T) {
+	group := &flightGroup{}
+	expected := errors.New("foo")
+	_, err, _ := group.Do("foo", func() (interface{}, error) { return nil, expected })
+	if err != expected {
+		t.Fatalf("Invalid error: %v", err)
+	}
+}
+
+func TestFlightGroupReleasesWaitersOnPanic(t *testing.T) {
+	group := &flightGroup{}
+	started := make(chan struct{})
+	done := make(chan error)
+
+	go func() {
+		defer func() { _ = recover() }()
+		_, _, _ = group.Do("foo", func() (interface{}, error) {
+			close(started)
+			time.Sleep(100 * time.Millisecond)
+			panic("foo")
+		})
+	}()
+
+	<-started
+	go func() {
+		_, err, _ := group.Do("foo", func() (interface{}, error) { return nil, nil })
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil && err != errFlightPanicked {
+			t.Fatalf("Invalid error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Waiters must be released")
+	}
+}
+
+func TestFlightGroupCancelsOnceEveryCallerIsGone(t *testing.T) {
+	group := &flightGroup{}
+	started := make(chan struct{})
+	canceled := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		close(started)
+		<-ctx.Done()
+		close(canceled)
+		return nil, ctx.Err()
+	}
+
+	first, cancelFirst := context.WithCancel(context.Background())
+	second, cancelSecond := context.WithCancel(context.Background())
+	results := make(chan error, 2)
+	go func() {
+		_, err, _ := group.DoContext(first, "foo", fn)
+		results <- err
+	}()
+	<-started
+	go func() {
+		_, err, _ := group.DoContext(second, "foo", fn)
+		results <- err
+	}()
+	for waiters := 0; waiters != 2; time.Sleep(time.Millisecond) {
+		group.mutex.Lock()
+		waiters = group.calls["foo"].waiters
+		group.mutex.Unlock()
+	}
+
+	// The call keeps running while another caller waits for it
+	cancelFirst()
+	if err := <-results; err != context.Canceled {
+		t.Fatalf("Invalid error: %v", err)
+	}
+	select {
+	case <-canceled:
+		t.Fatal("The call must not be canceled while callers are waiting")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancelSecond()
+	if err := <-results; err != context.Canceled {
+		t.Fatalf("Invalid error: %v", err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("The call must be canceled once every caller is gone")
+	}
+
+	// Canceled calls are not shared with new callers
+	_, _, shared := group.DoContext(context.Background(), "foo", func(context.Context) (interface{}, error) { return nil, nil })
+	if shared {
+		t.Fatal("Canceled calls must not be shared")
+	}
+}
+
+func TestFlightRequestKey(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "http://foo/bar.jpg", nil)
+	req.Header.Set("Authorization", "foo")
+	other, _ := http.NewRequest(http.MethodGet, "http://foo/bar.jpg", nil)
+	other.Header.Set("Authorization", "bar")
+
+	if flightRequestKey(req) == flightRequestKey(other) {
+		t.Fatal("Requests with different headers must not be coalesced")
+	}
+
+	other.Header.Set("Authorization", "foo")
+	if flightRequestKey(req) != flightRequestKey(other) {
+		t.Fatal("Identical requests must be coalesced")
+	}
+
+	req.Header.Set(TraceParentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	other.Header.Set(TraceParentHeader, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	if flightRequestKey(req) != flightRequestKey(other) {
+		t.Fatal("Requests from different traces must be coalesced")
+	}
+}
+
+func TestImageHandlerCoalescesTransformations(t *testing.T) {
+	var calls int32
+	op := func(buf []byte, opts ImageOptions) (Image, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(100 * time.Millisecond)
+		return Image{Body: []byte("processed"), Mime: "image/jpeg"}, nil
+	}
+
+	buf, _ := ioutil.ReadFile("testdata/large.jpg")
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/resize?width=300", bytes.NewReader(buf))
+			w := httptest.NewRecorder()
+			imageHandler(w, req, buf, ImageSourceMetadata{}, op, ServerOptions{})
+			if w.Code != http.StatusOK || w.Body.String() != "processed" {
+				t.Errorf("Invalid response: %d %s", w.Code, w.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("Concurrent transformations must be coalesced, got %d calls", calls)
+	}
+}
@@ -11,23 +11,27 @@ var start = time.Now()
 const MB float64 = 1.0 * 1024 * 1024
 
 type HealthStats struct {
-	Uptime               int64   `json:"uptime"`
-	AllocatedMemory      float64 `json:"allocatedMemory"`
-	TotalAllocatedMemory float64 `json:"totalAllocatedMemory"`
-	Goroutines           int     `json:"goroutines"`
-	GCCycles             uint32  `json:"completedGCCycles"`
-	NumberOfCPUs         int     `json:"cpus"`
-	HeapSys              float64 `json:"maxHeapUsage"`
-	HeapAllocated        float64 `json:"heapInUse"`
-	ObjectsInUse         uint64  `json:"objectsInUse"`
-	OSMemoryObtained     float64 `json:"OSMemoryObtained"`
+	Uptime               int64                `json:"uptime"`
+	AllocatedMemory      float64              `json:"allocatedMemory"`
+	TotalAllocatedMemory float64              `json:"totalAllocatedMemory"`
+	Goroutines           int                  `json:"goroutines"`
+	GCCycles             uint32               `json:"completedGCCycles"`
+	NumberOfCPUs         int                  `json:"cpus"`
+	HeapSys              float64              `json:"maxHeapUsage"`
+	HeapAllocated        float64              `json:"heapInUse"`
+	ObjectsInUse         uint64               `json:"objectsInUse"`
+	OSMemoryObtained     float64              `json:"OSMemoryObtained"`
+	Cache                *CacheStats          `json:"cache,omitempty"`
+	DiskCache            *CacheStats          `json:"diskCache,omitempty"`
+	ProcessingPool       *ProcessingPoolStats `json:"processingPool,omitempty"`
+	MemoryBudget         *MemoryBudgetStats   `json:"memoryBudget,omitempty"`
 }
 
 func GetHealthStats() *HealthStats {
 	mem := &runtime.MemStats{}
 	runtime.ReadMemStats(mem)
 
-	return &HealthStats{
+	stats := &HealthStats{
 		Uptime:               GetUptime(),
 		AllocatedMemory:      toMegaBytes(mem.Alloc),
 		TotalAllocatedMemory: toMegaBytes(mem.TotalAlloc),
@@ -39,6 +43,25 @@ func GetHealthStats() *HealthStats {
 		ObjectsInUse:         mem.Mallocs - mem.Frees,
 		OSMemoryObtained:     toMegaBytes(mem.Sys),
 	}
+
+	if responseCache != nil {
+		cacheStats := responseCache.Stats()
+		stats.Cache = &cacheStats
+	}
+	if diskCache != nil {
+		diskCacheStats := diskCache.Stats()
+		stats.DiskCache = &diskCacheStats
+	}
+	if processingPool != nil {
+		poolStats := processingPool.Stats()
+		stats.ProcessingPool = &poolStats
+	}
+	if memoryBudget != nil {
+		budgetStats := memoryBudget.Stats()
+		stats.MemoryBudget = &budgetStats
+	}
+
+	return stats
 }
 
 func GetUptime() int64 {
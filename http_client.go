@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// HTTPClientOptions defines the settings of the HTTP client used to fetch remote images.
+// Zero timeouts and pool sizes fallback to the defaults, while zero retries disable the retries.
+type HTTPClientOptions struct {
+	Timeout               time.Duration
+	ConnectTimeout        time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	MaxRetries            int
+	RetryBackoff          time.Duration
+	SSRFProtection        bool
+	AllowedNetworks       []*net.IPNet
+}
+
+var defaultHTTPClientOptions = HTTPClientOptions{
+	Timeout:               30 * time.Second,
+	ConnectTimeout:        10 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 15 * time.Second,
+	IdleConnTimeout:       90 * time.Second,
+	MaxIdleConns:          100,
+	MaxIdleConnsPerHost:   10,
+	MaxRetries:            2,
+	RetryBackoff:          100 * time.Millisecond,
+}
+
+var defaultHTTPClient = NewHTTPClient(defaultHTTPClientOptions)
+
+// HTTPClient performs outbound HTTP requests with an overall timeout
+// and bounded retries with exponential backoff.
+type HTTPClient struct {
+	client       *http.Client
+	guard        *SSRFGuard
+	timeout      time.Duration
+	maxRetries   int
+	retryBackoff time.Duration
+}
+
+// NewHTTPClient creates a new HTTP client with a dedicated connection pool.
+func NewHTTPClient(o HTTPClientOptions) *HTTPClient {
+	o = withHTTPClientDefaults(o)
+
+	dialer := &net.Dialer{
+		Timeout:   o.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   o.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: o.ResponseHeaderTimeout,
+		IdleConnTimeout:       o.IdleConnTimeout,
+		MaxIdleConns:          o.MaxIdleConns,
+		MaxIdleConnsPerHost:   o.MaxIdleConnsPerHost,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	c := &HTTPClient{
+		client:       &http.Client{Transport: transport},
+		timeout:      o.Timeout,
+		maxRetries:   o.MaxRetries,
+		retryBackoff: o.RetryBackoff,
+	}
+
+	if o.SSRFProtection {
+		c.guard = &SSRFGuard{AllowedNetworks: o.AllowedNetworks}
+		dialer.Control = c.guard.Control
+	}
+	c.client.CheckRedirect = c.checkRedirect
+
+	return c
+}
+
+func withHTTPClientDefaults(o HTTPClientOptions) HTTPClientOptions {
+	d := defaultHTTPClientOptions
+	if o.Timeout <= 0 {
+		o.Timeout = d.Timeout
+	}
+	if o.ConnectTimeout <= 0 {
+		o.ConnectTimeout = d.ConnectTimeout
+	}
+	if o.TLSHandshakeTimeout <= 0 {
+		o.TLSHandshakeTimeout = d.TLSHandshakeTimeout
+	}
+	if o.ResponseHeaderTimeout <= 0 {
+		o.ResponseHeaderTimeout = d.ResponseHeaderTimeout
+	}
+	if o.IdleConnTimeout <= 0 {
+		o.IdleConnTimeout = d.IdleConnTimeout
+	}
+	if o.MaxIdleConns <= 0 {
+		o.MaxIdleConns = d.MaxIdleConns
+	}
+	if o.MaxIdleConnsPerHost <= 0 {
+		o.MaxIdleConnsPerHost = d.MaxIdleConnsPerHost
+	}
+	if o.RetryBackoff <= 0 {
+		o.RetryBackoff = d.RetryBackoff
+	}
+	if o.MaxRetries < 0 {
+		o.MaxRetries = 0
+	}
+	return o
+}
+
+// Do sends the HTTP request, retrying idempotent requests on connection errors and 5xx responses.
+// The overall timeout covers every attempt and the reading of the response body.
+func (c *HTTPClient) Do(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), c.timeout)
+	req = req.WithContext(ctx)
+
+	if err := c.checkURL(req); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	backoff := c.retryBackoff
+	for attempt := 0; ; attempt++ {
+		res, err := c.client.Do(req)
+		if attempt >= c.maxRetries || !shouldRetryRequest(req, res, err) {
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			res.Body = &cancelReadCloser{res.Body, cancel}
+			return res, nil
+		}
+
+		if res != nil {
+			_, _ = io.Copy(ioutil.Discard, io.LimitReader(res.Body, 4096))
+			_ = res.Body.Close()
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			cancel()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// checkRedirect validates every redirect hop before following it.
+func (c *HTTPClient) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	return c.checkURL(req)
+}
+
+func (c *HTTPClient) checkURL(req *http.Request) error {
+	if c.guard != nil {
+		return c.guard.CheckURL(req.Context(), req.URL)
+	}
+	return checkURLScheme(req.URL)
+}
+
+func shouldRetryRequest(req *http.Request, res *http.Response, err error) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if err != nil {
+		var xerr Error
+		return req.Context().Err() == nil && !errors.As(err, &xerr)
+	}
+	return res.StatusCode >= http.StatusInternalServerError
+}
+
+// cancelReadCloser releases the request context once the response body is closed.
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelReadCloser) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// NewOriginError maps a remote fetch error to a 504 Error on timeouts or a 502 Error otherwise.
+// Errors already defined as Error, such as blocked remote addresses, are returned as is.
+func NewOriginError(message string, err error) Error {
+	var xerr Error
+	if errors.As(err, &xerr) {
+		return xerr
+	}
+	if isTimeoutError(err) {
+		return NewError(fmt.Sprintf("timeout %s: %v", message, err), http.StatusGatewayTimeout)
+	}
+	return NewError(fmt.Sprintf("error %s: %v", message, err), http.StatusBadGateway)
+}
+
+// originStatusCode maps the status code of a failed origin response to the status replied to the client.
+func originStatusCode(code int) int {
+	if code >= http.StatusInternalServerError {
+		return http.StatusBadGateway
+	}
+	return code
+}
+
+func isTimeoutError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPClientDefaultRetries(t *testing.T) {
+	if client := NewHTTPClient(defaultHTTPClientOptions); client.maxRetries != 2 {
+		t.Fatalf("Invalid default client retries: %d", client.maxRetries)
+	}
+	if value := flag.Lookup("http-client-retries").DefValue; value != strconv.Itoa(defaultHTTPClientOptions.MaxRetries) {
+		t.Fatalf("Invalid default of the retries flag: %s", value)
+	}
+	if client := NewHTTPClient(HTTPClientOptions{}); client.maxRetries != 0 {
+		t.Fatalf("Zero retries must disable the retries: %d", client.maxRetries)
+	}
+}
+
+func TestHTTPClientRetries(t *testing.T) {
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	client := NewHTTPClient(HTTPClientOptions{MaxRetries: 2, RetryBackoff: time.Millisecond})
+	req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Invalid response status: %d", res.StatusCode)
+	}
+	if attempts != 3 {
+		t.Fatalf("Invalid number of attempts: %d", attempts)
+	}
+}
+
+func TestHTTPClientNoRetryOnClientError(t *testing.T) {
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	client := NewHTTPClient(HTTPClientOptions{MaxRetries: 2, RetryBackoff: time.Millisecond})
+	req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+
+	if attempts != 1 {
+		t.Fatalf("Invalid number of attempts: %d", attempts)
+	}
+}
+
+func TestHttpImageSourceOriginErrors(t *testing.T) {
+	cases := []struct {
+		handler  http.HandlerFunc
+		expected int
+	}{
+		{func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusInternalServerError) }, http.StatusBadGateway},
+		{func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNotFound) }, http.StatusNotFound},
+		{func(w http.ResponseWriter, r *http.Request) { time.Sleep(200 * time.Millisecond) }, http.StatusGatewayTimeout},
+	}
+
+	for _, test := range cases {
+		ts := httptest.NewServer(test.handler)
+		client := NewHTTPClient(HTTPClientOptions{Timeout: 50 * time.Millisecond, MaxRetries: 1, RetryBackoff: time.Millisecond})
+		source := NewHTTPImageSource(&SourceConfig{HTTPClient: client})
+
+		r, _ := http.NewRequest(http.MethodGet, "http://foo/bar?url="+ts.URL, nil)
+		_, err := source.GetImage(r.Context(), r)
+		ts.Close()
+
+		xerr, ok := err.(Error)
+		if !ok {
+			t.Fatalf("Invalid error type: %#v", err)
+		}
+		if xerr.HTTPCode() != test.expected {
+			t.Errorf("Invalid error status: %d != %d", xerr.HTTPCode(), test.expected)
+		}
+	}
+}
@@ -1,19 +1,17 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math"
-	"mime"
-	"mime/multipart"
 	"net/http"
-	"net/textproto"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/h2non/bimg"
 )
@@ -53,6 +51,12 @@ func (o Operation) Run(buf []byte, opts ImageOptions) (Image, error) {
 	return o(buf, opts)
 }
 
+// RunContext performs the image transformation within the context of the request being served
+func (o Operation) RunContext(ctx context.Context, buf []byte, opts ImageOptions) (Image, error) {
+	opts.ctx = ctx
+	return o(buf, opts)
+}
+
 // ImageInfo represents an image details and additional metadata
 type ImageInfo struct {
 	Width       int    `json:"width"`
@@ -88,8 +92,10 @@ func Info(buf []byte, o ImageOptions) (Image, error) {
 		EXIF:        ParseEXIFFromBimg(&meta.EXIF),
 	}
 
+	encodeStart := time.Now()
 	body, _ := json.Marshal(info)
 	image.Body = body
+	observeEncode(o.Context(), encodeStart)
 
 	return image, nil
 }
@@ -106,7 +112,7 @@ func Resize(buf []byte, o ImageOptions) (Image, error) {
 		opts.Crop = !o.NoCrop
 	}
 
-	return Process(buf, opts)
+	return Process(o.Context(), buf, opts)
 }
 
 func Fit(buf []byte, o ImageOptions) (Image, error) {
@@ -156,7 +162,7 @@ func Fit(buf []byte, o ImageOptions) (Image, error) {
 	opts := BimgOptions(o)
 	opts.Embed = true
 
-	return Process(buf, opts)
+	return Process(o.Context(), buf, opts)
 }
 
 // calculateDestinationFitDimension calculates the fit area based on the image and desired fit dimensions
@@ -183,7 +189,7 @@ func Enlarge(buf []byte, o ImageOptions) (Image, error) {
 	// Since both width & height is required, we allow cropping by default.
 	opts.Crop = !o.NoCrop
 
-	return Process(buf, opts)
+	return Process(o.Context(), buf, opts)
 }
 
 func Extract(buf []byte, o ImageOptions) (Image, error) {
@@ -197,7 +203,7 @@ func Extract(buf []byte, o ImageOptions) (Image, error) {
 	opts.AreaWidth = o.AreaWidth
 	opts.AreaHeight = o.AreaHeight
 
-	return Process(buf, opts)
+	return Process(o.Context(), buf, opts)
 }
 
 func Crop(buf []byte, o ImageOptions) (Image, error) {
@@ -207,7 +213,7 @@ func Crop(buf []byte, o ImageOptions) (Image, error) {
 
 	opts := BimgOptions(o)
 	opts.Crop = true
-	return Process(buf, opts)
+	return Process(o.Context(), buf, opts)
 }
 
 func SmartCrop(buf []byte, o ImageOptions) (Image, error) {
@@ -218,7 +224,7 @@ func SmartCrop(buf []byte, o ImageOptions) (Image, error) {
 	opts := BimgOptions(o)
 	opts.Crop = true
 	opts.Gravity = bimg.GravitySmart
-	return Process(buf, opts)
+	return Process(o.Context(), buf, opts)
 }
 
 func Rotate(buf []byte, o ImageOptions) (Image, error) {
@@ -227,7 +233,7 @@ func Rotate(buf []byte, o ImageOptions) (Image, error) {
 	}
 
 	opts := BimgOptions(o)
-	return Process(buf, opts)
+	return Process(o.Context(), buf, opts)
 }
 
 func AutoRotate(buf []byte, o ImageOptions) (out Image, err error) {
@@ -258,13 +264,13 @@ func AutoRotate(buf []byte, o ImageOptions) (out Image, err error) {
 func Flip(buf []byte, o ImageOptions) (Image, error) {
 	opts := BimgOptions(o)
 	opts.Flip = true
-	return Process(buf, opts)
+	return Process(o.Context(), buf, opts)
 }
 
 func Flop(buf []byte, o ImageOptions) (Image, error) {
 	opts := BimgOptions(o)
 	opts.Flop = true
-	return Process(buf, opts)
+	return Process(o.Context(), buf, opts)
 }
 
 func Thumbnail(buf []byte, o ImageOptions) (Image, error) {
@@ -272,7 +278,7 @@ func Thumbnail(buf []byte, o ImageOptions) (Image, error) {
 		return Image{}, NewError("Missing required params: width or height", http.StatusBadRequest)
 	}
 
-	return Process(buf, BimgOptions(o))
+	return Process(o.Context(), buf, BimgOptions(o))
 }
 
 func Zoom(buf []byte, o ImageOptions) (Image, error) {
@@ -298,7 +304,7 @@ func Zoom(buf []byte, o ImageOptions) (Image, error) {
 	}
 
 	opts.Zoom = o.Factor
-	return Process(buf, opts)
+	return Process(o.Context(), buf, opts)
 }
 
 func Convert(buf []byte, o ImageOptions) (Image, error) {
@@ -310,7 +316,7 @@ func Convert(buf []byte, o ImageOptions) (Image, error) {
 	}
 	opts := BimgOptions(o)
 
-	return Process(buf, opts)
+	return Process(o.Context(), buf, opts)
 }
 
 func Watermark(buf []byte, o ImageOptions) (Image, error) {
@@ -331,15 +337,29 @@ func Watermark(buf []byte, o ImageOptions) (Image, error) {
 		opts.Watermark.Background = bimg.Color{R: o.Color[0], G: o.Color[1], B: o.Color[2]}
 	}
 
-	return Process(buf, opts)
+	return Process(o.Context(), buf, opts)
 }
 
 func WatermarkImage(buf []byte, o ImageOptions) (Image, error) {
 	if o.Image == "" {
 		return Image{}, NewError("Missing required param: image", http.StatusBadRequest)
 	}
-	response, err := http.Get(o.Image)
+	req, err := http.NewRequest(http.MethodGet, o.Image, nil)
+	if err != nil {
+		return Image{}, NewError(fmt.Sprintf("Unable to retrieve watermark image. %s", o.Image), http.StatusBadRequest)
+	}
+	if err := authorizeOrigin(o.Context(), req.URL); err != nil {
+		return Image{}, err
+	}
+	req.Header.Set("User-Agent", "imaginary/"+Version)
+
+	// Use the shared client, so the same timeouts and SSRF protection rules are applied
+	response, err := defaultHTTPClient.Do(req)
 	if err != nil {
+		var xerr Error
+		if errors.As(err, &xerr) {
+			return Image{}, xerr
+		}
 		return Image{}, NewError(fmt.Sprintf("Unable to retrieve watermark image. %s", o.Image), http.StatusBadRequest)
 	}
 	defer func() {
@@ -366,7 +386,7 @@ func WatermarkImage(buf []byte, o ImageOptions) (Image, error) {
 	opts.WatermarkImage.Buf = imageBuf
 	opts.WatermarkImage.Opacity = o.Opacity
 
-	return Process(buf, opts)
+	return Process(o.Context(), buf, opts)
 }
 
 func GaussianBlur(buf []byte, o ImageOptions) (Image, error) {
@@ -374,52 +394,294 @@ func GaussianBlur(buf []byte, o ImageOptions) (Image, error) {
 		return Image{}, NewError("Missing required param: sigma or minampl", http.StatusBadRequest)
 	}
 	opts := BimgOptions(o)
-	return Process(buf, opts)
+	return Process(o.Context(), buf, opts)
 }
 
 func Pipeline(buf []byte, o ImageOptions) (image Image, err error) {
-	if len(o.Operations) == 0 {
-		return Image{}, NewError("Missing or invalid pipeline operations JSON", http.StatusBadRequest)
+	if err := buildPipelineOperations(o.Operations); err != nil {
+		return Image{}, err
 	}
-	if len(o.Operations) > 10 {
-		return Image{}, NewError("Maximum allowed pipeline operations exceeded", http.StatusBadRequest)
+	return runPipeline(buf, o, pipelineIntermediateType())
+}
+
+// buildPipelineOperations validates the pipeline operations and builds their options, mutating the list.
+func buildPipelineOperations(operations PipelineOperations) (err error) {
+	if len(operations) == 0 {
+		return NewError("Missing or invalid pipeline operations JSON", http.StatusBadRequest)
+	}
+	if len(operations) > 10 {
+		return NewError("Maximum allowed pipeline operations exceeded", http.StatusBadRequest)
 	}
 
 	// Validate and build operations
-	for i, operation := range o.Operations {
+	for i, operation := range operations {
 		// Validate supported operation name
 		var exists bool
 		if operation.Operation, exists = OperationsMap[operation.Name]; !exists {
-			return Image{}, NewError(fmt.Sprintf("Unsupported operation name: %s", operation.Name), http.StatusBadRequest)
+			return NewError(fmt.Sprintf("Unsupported operation name: %s", operation.Name), http.StatusBadRequest)
 		}
 
-		// Parse and construct operation options
-		operation.ImageOptions, err = buildParamsFromMap(operation.Params)
+		// Parse the step condition and params expressions
+		if err = parseOperationExpressions(&operation); err != nil {
+			return err
+		}
+
+		// Parse and construct operation options, except the params depending on the current image
+		operation.ImageOptions, err = buildParamsFromMap(staticParams(operation))
 		if err != nil {
-			return Image{}, err
+			return err
 		}
 
 		// Mutate list by value
-		o.Operations[i] = operation
+		operations[i] = operation
+	}
+	return nil
+}
+
+// runPipeline reduces the image by running the operations in order. Unless the intermediate type is unknown,
+// the image is kept in that lossless type between steps and only encoded to the output type by the last step,
+// instead of being decoded and encoded again by every step.
+func runPipeline(buf []byte, o ImageOptions, intermediate bimg.ImageType) (image Image, err error) {
+	if output := pipelineOutputType(buf, o.Operations); output == bimg.UNKNOWN || !bimg.IsTypeSupportedSave(output) {
+		intermediate = bimg.UNKNOWN
 	}
 
-	// Reduce image by running multiple operations
+	// The output type is updated by every step requesting a type, regardless of the intermediate type
+	output := bimg.DetermineImageType(buf)
+	var encoding ImageOptions
+
 	image = Image{Body: buf}
-	for _, operation := range o.Operations {
-		var curImage Image
-		curImage, err = operation.Operation(image.Body, operation.ImageOptions)
+	last := len(o.Operations) - 1
+	for i, operation := range o.Operations {
+		// Stop once the request is canceled or timed out, even if failures are ignored
+		if err := o.Context().Err(); err != nil {
+			return Image{}, err
+		}
+
+		opts, run, err := resolveOperation(operation, image.Body, output, o.limits)
 		if err != nil && !operation.IgnoreFailure {
 			return Image{}, err
 		}
-		if operation.IgnoreFailure {
-			err = nil
+		if err != nil || !run {
+			continue
+		}
+		if t := ImageType(opts.Type); t != bimg.UNKNOWN {
+			output = t
+		}
+		encoding = opts
+
+		ctx, span := StartSpan(o.Context(), "pipeline.step "+operation.Name, SpanKindInternal)
+		opts.ctx = ctx
+		if intermediate != bimg.UNKNOWN {
+			if i < last {
+				opts.Type = bimg.ImageTypeName(intermediate)
+			} else {
+				opts.Type = bimg.ImageTypeName(output)
+			}
+		}
+
+		var curImage Image
+		curImage, err = operation.Operation(image.Body, opts)
+		span.RecordError(err)
+		span.Finish()
+		if err != nil && !operation.IgnoreFailure {
+			return Image{}, err
 		}
 		if err == nil {
 			image = curImage
 		}
 	}
 
-	return image, err
+	// Encode the intermediate image if the last step did not, such as when it was skipped or its failure was ignored
+	if intermediate != bimg.UNKNOWN && intermediate != output && image.Mime == GetImageMimeType(intermediate) {
+		return Process(o.Context(), image.Body, encodingOptions(encoding, output))
+	}
+
+	// Reply with the input image if every step was skipped or failed, encoded in the requested type if it differs
+	if image.Mime == "" {
+		input := bimg.DetermineImageType(buf)
+		if t := ImageType(o.Type); t != bimg.UNKNOWN && t != input {
+			return Process(o.Context(), buf, encodingOptions(o, t))
+		}
+		image.Mime = GetImageMimeType(input)
+	}
+
+	return image, nil
+}
+
+// encodingOptions returns the options to encode the image in the given type, keeping only the output settings
+// of the step options, so the transformations already applied to the image are not applied again.
+func encodingOptions(o ImageOptions, t bimg.ImageType) bimg.Options {
+	return bimg.Options{
+		Type:          t,
+		Quality:       o.Quality,
+		Compression:   o.Compression,
+		Interlace:     o.Interlace,
+		Palette:       o.Palette,
+		Speed:         o.Speed,
+		StripMetadata: o.StripMetadata,
+		NoProfile:     o.NoProfile,
+	}
+}
+
+// resolveOperation returns the options of a pipeline step, evaluating its condition and params expressions
+// against the current image, if any. The returned run flag is false if the step condition is not met.
+// The output limits are checked again once the params expressions are evaluated.
+func resolveOperation(operation PipelineOperation, buf []byte, current bimg.ImageType, limits ImageLimits) (ImageOptions, bool, error) {
+	if operation.condition == nil && len(operation.expressions) == 0 {
+		return operation.ImageOptions, true, nil
+	}
+
+	vars, err := imageVariables(buf, current)
+	if err != nil {
+		return ImageOptions{}, false, NewError("Cannot retrieve image metadata: "+err.Error(), http.StatusBadRequest)
+	}
+
+	if operation.condition != nil {
+		run, err := operation.condition.EvalCondition(vars)
+		if err != nil {
+			return ImageOptions{}, false, NewError(fmt.Sprintf("Cannot evaluate the condition of operation %s: %s", operation.Name, err), http.StatusBadRequest)
+		}
+		if !run {
+			return ImageOptions{}, false, nil
+		}
+	}
+	if len(operation.expressions) == 0 {
+		return operation.ImageOptions, true, nil
+	}
+
+	params := staticParams(operation)
+	for name, expr := range operation.expressions {
+		value, err := expr(vars)
+		if err == nil {
+			err = checkParamResult(name, value)
+		}
+		if err != nil {
+			return ImageOptions{}, false, NewError(fmt.Sprintf("Cannot evaluate the param %s of operation %s: %s", name, operation.Name, err), http.StatusBadRequest)
+		}
+		params[name] = value
+	}
+	opts, err := buildParamsFromMap(params)
+	if err != nil {
+		return ImageOptions{}, false, NewError(err.Error(), http.StatusBadRequest)
+	}
+	if limits.IsEnabled() {
+		if err := limits.checkOutput(opts, bimg.ImageSize{Width: vars.Width, Height: vars.Height}); err != nil {
+			return ImageOptions{}, false, err
+		}
+	}
+	return opts, true, nil
+}
+
+// dimensionParams are the params defining a size or a position in pixels.
+var dimensionParams = map[string]bool{
+	"width":      true,
+	"height":     true,
+	"top":        true,
+	"left":       true,
+	"areawidth":  true,
+	"areaheight": true,
+	"textwidth":  true,
+	"margin":     true,
+}
+
+// checkParamResult checks the number a param expression evaluated to is finite,
+// and not negative for dimension params.
+func checkParamResult(name string, value interface{}) error {
+	v, ok := value.(float64)
+	if !ok {
+		return nil
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return fmt.Errorf("expression evaluated to %v instead of a finite number", v)
+	}
+	if dimensionParams[name] && v < 0 {
+		return fmt.Errorf("expression evaluated to the negative dimension %v", v)
+	}
+	return nil
+}
+
+// parseOperationExpressions parses the condition of a pipeline step and its params prefixed as expressions.
+func parseOperationExpressions(operation *PipelineOperation) error {
+	if strings.TrimSpace(operation.When) != "" {
+		condition, err := ParseExpression(operation.When)
+		if err != nil {
+			return NewError(fmt.Sprintf("Invalid condition of operation %s: %s", operation.Name, err), http.StatusBadRequest)
+		}
+		operation.condition = condition
+	}
+
+	operation.expressions = nil
+	for name, value := range operation.Params {
+		src, ok := value.(string)
+		if !ok || !strings.HasPrefix(src, ExpressionPrefix) {
+			continue
+		}
+		expr, err := ParseExpression(strings.TrimPrefix(src, ExpressionPrefix))
+		if err != nil {
+			return NewError(fmt.Sprintf("Invalid param %s of operation %s: %s", name, operation.Name, err), http.StatusBadRequest)
+		}
+		if operation.expressions == nil {
+			operation.expressions = make(map[string]Expression)
+		}
+		operation.expressions[name] = expr
+	}
+	return nil
+}
+
+// staticParams returns a copy of the step params which are not expressions.
+func staticParams(operation PipelineOperation) map[string]interface{} {
+	params := make(map[string]interface{}, len(operation.Params))
+	for name, value := range operation.Params {
+		if src, ok := value.(string); !ok || !strings.HasPrefix(src, ExpressionPrefix) {
+			params[name] = value
+		}
+	}
+	return params
+}
+
+// imageVariables returns the metadata of the current image referenced by pipeline expressions.
+// The type is the one the image is encoded in once the pipeline finishes, instead of the intermediate type.
+func imageVariables(buf []byte, current bimg.ImageType) (ImageVariables, error) {
+	meta, err := bimg.Metadata(buf)
+	if err != nil {
+		return ImageVariables{}, err
+	}
+
+	vars := ImageVariables{
+		Width:       meta.Size.Width,
+		Height:      meta.Size.Height,
+		Orientation: meta.Orientation,
+		Alpha:       meta.Alpha,
+		Type:        bimg.ImageTypeName(current),
+	}
+	// Orientations 5 to 8 swap the width and height once the image is rotated
+	if vars.Orientation > 4 {
+		vars.Width, vars.Height = vars.Height, vars.Width
+	}
+	return vars, nil
+}
+
+// pipelineOutputType returns the type of the pipeline output image: the last type requested by a step,
+// or the type of the input image otherwise.
+func pipelineOutputType(buf []byte, operations PipelineOperations) bimg.ImageType {
+	output := bimg.DetermineImageType(buf)
+	for _, operation := range operations {
+		if t := ImageType(operation.ImageOptions.Type); t != bimg.UNKNOWN {
+			output = t
+		}
+	}
+	return output
+}
+
+// pipelineIntermediateType returns the lossless type used to pass the image between pipeline steps.
+// Uncompressed TIFF is cheap to encode and decode, and keeps the alpha channel and the pixel depth.
+// If not supported by libvips, every step encodes the image in the output type instead.
+func pipelineIntermediateType() bimg.ImageType {
+	if bimg.IsTypeSupported(bimg.TIFF) && bimg.IsTypeSupportedSave(bimg.TIFF) {
+		return bimg.TIFF
+	}
+	return bimg.UNKNOWN
 }
 
 func Multi(buf []byte, o ImageOptions) (image Image, err error) {
@@ -429,6 +691,9 @@ func Multi(buf []byte, o ImageOptions) (image Image, err error) {
 	if len(o.Multi) > 10 {
 		return Image{}, NewError("Maximum allowed number of tasks exceeded", http.StatusBadRequest)
 	}
+	if !isMultiFormat(o.Format) {
+		return Image{}, NewError("Unsupported multi response format: "+o.Format, http.StatusBadRequest)
+	}
 
 	// Validate and build tasks
 	var hasInfoTask bool
@@ -443,6 +708,25 @@ func Multi(buf []byte, o ImageOptions) (image Image, err error) {
 				return Image{}, NewError("Duplicate task name: "+name, http.StatusBadRequest)
 			}
 		}
+		taskNames[i] = task.Name
+
+		// Tasks with a list of operations run them as a pipeline
+		if len(task.Operations) > 0 {
+			if task.OperationName != "" {
+				return Image{}, NewError("Task cannot define both operation and operations: "+task.Name, http.StatusBadRequest)
+			}
+			if err = buildPipelineOperations(task.Operations); err != nil {
+				return Image{}, err
+			}
+			task.Operation = func(buf []byte, opts ImageOptions) (Image, error) {
+				return runPipeline(buf, opts, pipelineIntermediateType())
+			}
+			task.ImageOptions = ImageOptions{Operations: task.Operations, limits: o.limits}
+
+			// Mutate list by value
+			o.Multi[i] = task
+			continue
+		}
 
 		// Info operations are treated in a special way
 		if task.OperationName == "info" && !hasInfoTask {
@@ -470,86 +754,78 @@ func Multi(buf []byte, o ImageOptions) (image Image, err error) {
 		o.Multi[i] = task
 	}
 
-	// Perform the multiple operations in prallel
-	out := &bytes.Buffer{}
-	mw := multipart.NewWriter(out)
-	wg := sync.WaitGroup{}
-	writingLock := sync.Mutex{}
-	var errOut error
-	for _, task := range o.Multi {
-		wg.Add(1)
-		go func(task MultiTask) {
-			defer wg.Done()
-
-			res, err := task.Operation(buf, task.ImageOptions)
-			if err != nil {
-				errOut = err
-				return
-			}
-			ext := GetImageExtensionFromMime(res.Mime)
-			if ext != "" {
-				ext = "." + ext
-			}
+	results := make([]Image, len(o.Multi))
+	errs := make([]error, len(o.Multi))
+	runTask := func(i int, task MultiTask) {
+		// Skip the pending tasks once the request is canceled or timed out
+		if err := o.Context().Err(); err != nil {
+			errs[i] = err
+			return
+		}
 
-			// Only one can write at the same time.
-			writingLock.Lock()
-			defer writingLock.Unlock()
+		ctx, span := StartSpan(o.Context(), "multi.task "+task.Name, SpanKindInternal)
+		task.ImageOptions.ctx = ctx
 
-			// Check if another goroutine has errored before exiting
-			if errOut != nil {
-				return
-			}
-
-			mh := textproto.MIMEHeader{}
-			if task.OperationName == "info" {
-				mh.Set("Content-Type", "application/json")
-				mh.Set("Content-Disposition", `form-data; name="info"`)
-			} else {
-				mh.Set("Content-Type", res.Mime)
-				mh.Set("Content-Disposition",
-					fmt.Sprintf(`form-data; name="%s"; filename="%s%s"`, task.Name, task.Name, ext),
-				)
-			}
-			part, err := mw.CreatePart(mh)
-			if err != nil {
-				errOut = err
-				return
-			}
+		results[i], errs[i] = task.Operation(buf, task.ImageOptions)
+		span.RecordError(errs[i])
+		span.Finish()
+	}
 
-			written, err := part.Write(res.Body)
-			if err != nil {
-				errOut = err
-				return
-			}
-			if written != len(res.Body) {
-				errOut = fmt.Errorf("written only %d/%d bytes in part", written, len(res.Body))
-				return
+	if processingPool != nil {
+		// Perform the operations one after the other, since the request holds a single
+		// processing worker and libvips must not process more images than the pool allows
+		for i, task := range o.Multi {
+			if runTask(i, task); errs[i] != nil {
+				break
 			}
-		}(task)
+		}
+	} else {
+		// Perform the multiple operations in parallel
+		wg := sync.WaitGroup{}
+		for i, task := range o.Multi {
+			wg.Add(1)
+			go func(i int, task MultiTask) {
+				defer wg.Done()
+				runTask(i, task)
+			}(i, task)
+		}
+		wg.Wait()
 	}
-	wg.Wait()
 
-	if errOut != nil {
-		return Image{}, errOut
+	for _, err := range errs {
+		if err != nil {
+			return Image{}, err
+		}
 	}
-
-	err = mw.Close()
-	if err != nil {
+	if err := o.Context().Err(); err != nil {
 		return Image{}, err
 	}
 
-	mt := mime.FormatMediaType("multipart/form-data", map[string]string{
-		"boundary": mw.Boundary(),
-	})
-	image = Image{
-		Body: out.Bytes(),
-		Mime: mt,
+	defer observeEncode(o.Context(), time.Now())
+	switch o.Format {
+	case MultiFormatJSON:
+		return encodeMultiJSON(o.Multi, results)
+	case MultiFormatZip:
+		return encodeMultiZip(o.Multi, results)
+	default:
+		return encodeMultipart(o.Multi, results)
 	}
-
-	return image, nil
 }
 
-func Process(buf []byte, opts bimg.Options) (out Image, err error) {
+func Process(ctx context.Context, buf []byte, opts bimg.Options) (out Image, err error) {
+	// libvips cannot be interrupted, so the request is only checked before processing the image
+	if err := ctx.Err(); err != nil {
+		return Image{}, err
+	}
+
+	_, span := StartSpan(ctx, "image.process", SpanKindInternal)
+	span.SetAttribute("imaginary.input.bytes", len(buf))
+	defer func() {
+		span.SetAttribute("imaginary.output.bytes", len(out.Body))
+		span.RecordError(err)
+		span.Finish()
+	}()
+
 	defer func() {
 		if r := recover(); r != nil {
 			switch value := r.(type) {
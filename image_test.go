@@ -6,8 +6,12 @@ import (
 	"io"
 	"mime"
 	"mime/multipart"
+	"net/http"
+	"reflect"
 	"strings"
 	"testing"
+
+	"github.com/h2non/bimg"
 )
 
 func TestImageResize(t *testing.T) {
@@ -153,6 +157,149 @@ func TestImagePipelineOperations(t *testing.T) {
 	}
 }
 
+func TestImagePipelineIntermediateType(t *testing.T) {
+	var types []string
+	record := func(op Operation) Operation {
+		return func(buf []byte, o ImageOptions) (Image, error) {
+			types = append(types, o.Type)
+			return op(buf, o)
+		}
+	}
+	fail := func(buf []byte, o ImageOptions) (Image, error) {
+		return Image{}, NewError("foo", http.StatusBadRequest)
+	}
+
+	operations := PipelineOperations{
+		{Name: "resize", Operation: record(Resize), ImageOptions: ImageOptions{Width: 400}},
+		{Name: "crop", Operation: record(Crop), ImageOptions: ImageOptions{Width: 300, Height: 260}},
+		{Name: "flip", Operation: record(Flip)},
+	}
+	buf, _ := io.ReadAll(readFile("imaginary.jpg"))
+
+	img, err := runPipeline(buf, ImageOptions{Operations: operations}, bimg.TIFF)
+	if err != nil {
+		t.Fatalf("Cannot process image: %s", err)
+	}
+	if strings.Join(types, ",") != "tiff,tiff,jpeg" {
+		t.Fatalf("The image must only be encoded in the output type by the last step: %v", types)
+	}
+	if img.Mime != "image/jpeg" || assertSize(img.Body, 300, 260) != nil {
+		t.Fatalf("Invalid output image: %s", img.Mime)
+	}
+
+	// The intermediate image is encoded if the last step failure is ignored
+	operations[2] = PipelineOperation{Name: "flip", Operation: fail, IgnoreFailure: true}
+	img, err = runPipeline(buf, ImageOptions{Operations: operations}, bimg.TIFF)
+	if err != nil {
+		t.Fatalf("Cannot process image: %s", err)
+	}
+	if img.Mime != "image/jpeg" || bimg.DetermineImageType(img.Body) != bimg.JPEG {
+		t.Fatalf("Invalid output image type: %s", img.Mime)
+	}
+}
+
+func TestImagePipelineConditionalOperations(t *testing.T) {
+	operations := PipelineOperations{
+		{Name: "resize", When: "width > height", Params: map[string]interface{}{"height": 100}},
+		{Name: "resize", When: "height > width", Params: map[string]interface{}{"width": "=min(width, 200)"}},
+		{Name: "crop", Params: map[string]interface{}{"width": "=width", "height": "=round(width / 2)"}},
+		{Name: "convert", When: "type == 'png'", Params: map[string]interface{}{"type": "webp"}},
+	}
+	buf, _ := io.ReadAll(readFile("imaginary.jpg"))
+
+	// 550x740 -> 200x269 -> 200x100
+	img, err := Pipeline(buf, ImageOptions{Operations: operations})
+	if err != nil {
+		t.Fatalf("Cannot process image: %s", err)
+	}
+	if img.Mime != "image/jpeg" {
+		t.Errorf("Invalid image MIME type: %s", img.Mime)
+	}
+	if err := assertSize(img.Body, 200, 100); err != nil {
+		t.Errorf("Invalid image size: %s", err)
+	}
+
+	// The input image is returned if every step is skipped, encoded in the requested type if any
+	skipped := PipelineOperations{
+		{Name: "resize", When: "width > 10000", Params: map[string]interface{}{"width": 100}},
+		{Name: "convert", When: "alpha", Params: map[string]interface{}{"type": "webp"}},
+	}
+	img, err = Pipeline(buf, ImageOptions{Operations: skipped})
+	if err != nil {
+		t.Fatalf("Cannot process image: %s", err)
+	}
+	if img.Mime != "image/jpeg" || !bytes.Equal(img.Body, buf) {
+		t.Errorf("The input image must be returned if every step is skipped: %s", img.Mime)
+	}
+	img, err = Pipeline(buf, ImageOptions{Operations: skipped, Type: "png"})
+	if err != nil {
+		t.Fatalf("Cannot process image: %s", err)
+	}
+	if img.Mime != "image/png" || bimg.DetermineImageType(img.Body) != bimg.PNG {
+		t.Errorf("The input image must be encoded in the requested type: %s", img.Mime)
+	}
+}
+
+func TestImagePipelineIgnoredFailureAfterRotate(t *testing.T) {
+	fail := func(buf []byte, o ImageOptions) (Image, error) {
+		return Image{}, NewError("foo", http.StatusBadRequest)
+	}
+	operations := PipelineOperations{
+		{Name: "rotate", Operation: Rotate, ImageOptions: ImageOptions{Rotate: 90, Quality: 90}},
+		{Name: "blur", Operation: fail, IgnoreFailure: true},
+	}
+	buf, _ := io.ReadAll(readFile("imaginary.jpg"))
+
+	// The intermediate image is encoded without rotating it again: 550x740 -> 740x550
+	img, err := runPipeline(buf, ImageOptions{Operations: operations}, bimg.TIFF)
+	if err != nil {
+		t.Fatalf("Cannot process image: %s", err)
+	}
+	if img.Mime != "image/jpeg" {
+		t.Errorf("Invalid image MIME type: %s", img.Mime)
+	}
+	if err := assertSize(img.Body, 740, 550); err != nil {
+		t.Errorf("The image must only be rotated once: %s", err)
+	}
+}
+
+func TestEncodingOptions(t *testing.T) {
+	o := ImageOptions{Rotate: 90, Width: 300, Sigma: 2, Flip: true, Embed: true, Quality: 85, Interlace: true, StripMetadata: true}
+	opts := encodingOptions(o, bimg.WEBP)
+	expected := bimg.Options{Type: bimg.WEBP, Quality: 85, Interlace: true, StripMetadata: true}
+	if !reflect.DeepEqual(opts, expected) {
+		t.Fatalf("Only the output settings must be kept: %#v", opts)
+	}
+}
+
+func BenchmarkPipeline(b *testing.B) {
+	buf, _ := io.ReadAll(readFile("large.jpg"))
+	operations := PipelineOperations{
+		{Name: "resize", Operation: Resize, ImageOptions: ImageOptions{Width: 1600}},
+		{Name: "rotate", Operation: Rotate, ImageOptions: ImageOptions{Rotate: 90}},
+		{Name: "flip", Operation: Flip},
+		{Name: "blur", Operation: GaussianBlur, ImageOptions: ImageOptions{Sigma: 1}},
+		{Name: "crop", Operation: Crop, ImageOptions: ImageOptions{Width: 800, Height: 600}},
+	}
+
+	cases := []struct {
+		name         string
+		intermediate bimg.ImageType
+	}{
+		{"reencode", bimg.UNKNOWN},
+		{"intermediate", bimg.TIFF},
+	}
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := runPipeline(buf, ImageOptions{Operations: operations}, c.intermediate); err != nil {
+					b.Fatalf("Cannot process image: %s", err)
+				}
+			}
+		})
+	}
+}
+
 func TestImageMultiTasks(t *testing.T) {
 	tasks := []MultiTask{
 		{
@@ -249,6 +396,52 @@ func TestImageMultiTasks(t *testing.T) {
 	}
 }
 
+func TestImageMultiTaskPipelines(t *testing.T) {
+	tasks := []MultiTask{
+		{
+			Name:          "info",
+			OperationName: "info",
+		},
+		{
+			Name: "square",
+			Operations: PipelineOperations{
+				{Name: "resize", Params: map[string]interface{}{"width": 300}},
+				{Name: "crop", Params: map[string]interface{}{"width": 200, "height": 200}},
+				{Name: "convert", Params: map[string]interface{}{"type": "png"}},
+			},
+		},
+	}
+
+	buf, _ := io.ReadAll(readFile("imaginary.jpg"))
+	image, err := Multi(buf, ImageOptions{Multi: tasks, Format: MultiFormatJSON})
+	if err != nil {
+		t.Fatalf("Cannot process tasks: %s", err)
+	}
+	if image.Mime != "application/json" {
+		t.Fatalf("Invalid MIME type: %s", image.Mime)
+	}
+
+	var response MultiResponse
+	if err := json.Unmarshal(image.Body, &response); err != nil {
+		t.Fatalf("Cannot decode the response: %s", err)
+	}
+	if len(response.Tasks) != 2 {
+		t.Fatalf("Invalid number of task results: %d", len(response.Tasks))
+	}
+
+	var imageInfo ImageInfo
+	if err := json.Unmarshal(response.Tasks[0].Info, &imageInfo); err != nil || imageInfo.Width != 550 {
+		t.Errorf("Invalid image info: %s", response.Tasks[0].Info)
+	}
+	square := response.Tasks[1]
+	if square.Mime != "image/png" || square.Width != 200 || square.Height != 200 || square.Bytes != len(square.Body) {
+		t.Errorf("Invalid task result: %s %dx%d %d bytes", square.Mime, square.Width, square.Height, square.Bytes)
+	}
+	if err := assertSize(square.Body, 200, 200); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestCalculateDestinationFitDimension(t *testing.T) {
 	cases := []struct {
 		// Image
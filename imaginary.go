@@ -31,9 +31,34 @@ var (
 	aEnablePlaceholder  = flag.Bool("enable-placeholder", false, "Enable image response placeholder to be used in case of error")
 	aEnableURLSignature = flag.Bool("enable-url-signature", false, "Enable URL signature (URL-safe Base64-encoded HMAC digest)")
 	aURLSignatureKey    = flag.String("url-signature-key", "", "The URL signature key (32 characters minimum)")
+	aURLSignatureKeys   = flag.String("url-signature-keys", "", "Comma separated list of URL signature keys identified by the kid param. E.g: 2024a:key1,2024b:key2")
+	aURLSignatureParams = flag.String("url-signature-params", "", "Comma separated list of the request params covered by the URL signature. Defaults to all params")
+	aEnableS3Source     = flag.Bool("enable-s3-source", false, "Enable S3-compatible object storage image source processing")
+	aS3Endpoint         = flag.String("s3-endpoint", "", "S3-compatible endpoint URL. Defaults to AWS S3 for the configured region")
+	aS3Region           = flag.String("s3-region", "", "S3 region used to sign requests. Can also be defined via AWS_REGION [default: us-east-1]")
+	aS3Bucket           = flag.String("s3-bucket", "", "Default S3 bucket used when the bucket param is not present")
+	aS3PathStyle        = flag.Bool("s3-path-style", false, "Use path-style S3 addressing instead of virtual-hosted-style")
+	aS3AccessKey        = flag.String("s3-access-key", "", "S3 access key ID. Can also be defined via AWS_ACCESS_KEY_ID")
+	aS3SecretKey        = flag.String("s3-secret-key", "", "S3 secret access key. Can also be defined via AWS_SECRET_ACCESS_KEY")
+	aS3AllowedBuckets   = flag.String("s3-allowed-buckets", "", "Restrict the S3 buckets defined by the bucket param (separated by commas)")
 	aAllowedOrigins     = flag.String("allowed-origins", "", "Restrict remote image source processing to certain origins (separated by commas). Note: Origins are validated against host *AND* path.")
-	aMaxAllowedSize     = flag.Int("max-allowed-size", 0, "Restrict maximum size of http image source (in bytes)")
+	aDisableSSRF        = flag.Bool("disable-ssrf-protection", false, "Allow fetching remote images from loopback, private, link-local and multicast IP addresses")
+	aAllowedNetworks    = flag.String("allowed-networks", "", "Comma separated IP addresses or CIDR networks allowed to be fetched despite the SSRF protection. E.g: 10.0.0.0/8,127.0.0.1")
+	aMaxAllowedSize     = flag.Int("max-allowed-size", 0, "Restrict maximum size of image sources, enforced while reading the image (in bytes)")
+	aMemoryCacheMaxSize = flag.Int("memory-cache-max-size", 0, "Maximum size in bytes of the in-memory cache of processed images. Disabled by default")
+	aCacheDir           = flag.String("cache-dir", "", "Local directory used as persistent cache of processed images. Disabled by default")
+	aCacheMaxSize       = flag.Int64("cache-max-size", 1024*1024*1024, "Maximum size in bytes of the disk cache of processed images")
+	aCacheTTL           = flag.Int("cache-ttl", 86400, "Time in seconds processed images are kept in the in-memory and disk caches. Zero disables the expiration")
+	aMaxInputPixels     = flag.Int("max-input-pixels", 0, "Restrict maximum number of pixels (width x height) of input images")
+	aMaxOutputWidth     = flag.Int("max-output-width", 0, "Restrict maximum width of output images")
+	aMaxOutputHeight    = flag.Int("max-output-height", 0, "Restrict maximum height of output images")
+	aMaxOutputPixels    = flag.Int("max-output-pixels", 0, "Restrict maximum number of pixels (width x height) of output images")
 	aKey                = flag.String("key", "", "Define API key for authorization")
+	aAPIKeysFile        = flag.String("api-keys-file", "", "JSON file defining multiple API keys with their own scopes and limits")
+	aJWTSecrets         = flag.String("jwt-secrets", "", "Comma separated list of HMAC secrets used to verify JWT bearer tokens")
+	aJWTJWKSFile        = flag.String("jwt-jwks-file", "", "Local JWKS file with the public keys used to verify JWT bearer tokens")
+	aJWTIssuer          = flag.String("jwt-issuer", "", "Required issuer (iss claim) of the JWT bearer tokens")
+	aJWTAudience        = flag.String("jwt-audience", "", "Required audience (aud claim) of the JWT bearer tokens")
 	aMount              = flag.String("mount", "", "Mount server local directory")
 	aCertFile           = flag.String("certfile", "", "TLS certificate file path")
 	aKeyFile            = flag.String("keyfile", "", "TLS private key file path")
@@ -42,15 +67,40 @@ var (
 	aPlaceholder        = flag.String("placeholder", "", "Image path to image custom placeholder to be used in case of error. Recommended minimum image size is: 1200x1200")
 	aPlaceholderStatus  = flag.Int("placeholder-status", 0, "HTTP status returned when use -placeholder flag")
 	aDisableEndpoints   = flag.String("disable-endpoints", "", "Comma separated endpoints to disable. E.g: form,crop,rotate,health")
+	aSources            = flag.String("sources", "", "Comma separated image sources to enable, in order of precedence. E.g: fs,http,payload")
+	aDisableSources     = flag.String("disable-sources", "", "Comma separated image sources to disable. E.g: fs,http")
 	aHTTPCacheTTL       = flag.Int("http-cache-ttl", -1, "The TTL in seconds")
 	aReadTimeout        = flag.Int("http-read-timeout", 60, "HTTP read timeout in seconds")
 	aWriteTimeout       = flag.Int("http-write-timeout", 60, "HTTP write timeout in seconds")
+	aClientTimeout      = flag.Int("http-client-timeout", 30, "Remote image fetching overall timeout in seconds, including retries")
+	aClientConnTimeout  = flag.Int("http-client-connect-timeout", 10, "Remote image fetching connect timeout in seconds")
+	aClientTLSTimeout   = flag.Int("http-client-tls-timeout", 10, "Remote image fetching TLS handshake timeout in seconds")
+	aClientHdrTimeout   = flag.Int("http-client-header-timeout", 15, "Remote image fetching response headers timeout in seconds")
+	aClientRetries      = flag.Int("http-client-retries", defaultHTTPClientOptions.MaxRetries, "Maximum retries of remote image fetching on connection errors or 5xx responses")
+	aClientBackoff      = flag.Int("http-client-retry-backoff", 100, "Initial exponential backoff between remote image fetching retries in milliseconds")
+	aClientIdleConns    = flag.Int("http-client-max-idle-conns", 100, "Maximum idle connections kept in the remote image fetching pool")
+	aClientIdlePerHost  = flag.Int("http-client-max-idle-conns-per-host", 10, "Maximum idle connections per host kept in the remote image fetching pool")
+	aClientIdleTimeout  = flag.Int("http-client-idle-timeout", 90, "Remote image fetching idle connections timeout in seconds")
 	aConcurrency        = flag.Int("concurrency", 0, "Throttle concurrency limit per second")
 	aBurst              = flag.Int("burst", 100, "Throttle burst max cache size")
+	aProcessWorkers     = flag.Int("processing-workers", 0, "Maximum number of images processed at the same time")
+	aProcessQueue       = flag.Int("processing-queue", 100, "Maximum number of requests waiting for a processing worker")
+	aProcessTimeout     = flag.Int("processing-queue-timeout", 10, "Maximum time in seconds waiting for a processing worker")
+	aMemoryBudget       = flag.Int("memory-budget", 0, "Memory budget in megabytes. New image processing waits or is rejected if the projected memory usage exceeds it")
+	aRateLimitBy        = flag.String("rate-limit-by", "", "Comma separated list of classes identifying the throttled clients, in precedence order: key, ip or header:<name>")
+	aRateLimitQuotas    = flag.String("rate-limit-quotas", "", "Comma separated list of throttle quotas by client class, as requests per second and optional burst. E.g: key=100/200,ip=10/20")
+	aTrustedProxies     = flag.String("trusted-proxies", "", "Comma separated IP addresses or CIDR networks of the proxies trusted to define the client IP via X-Forwarded-For")
 	aMRelease           = flag.Int("mrelease", 30, "OS memory release interval in seconds")
 	aCpus               = flag.Int("cpus", runtime.GOMAXPROCS(-1), "Number of cpu cores to use")
 	aLogLevel           = flag.String("log-level", "info", "Define log level for http-server. E.g: info,warning,error")
+	aLogFormat          = flag.String("log-format", LogFormatApache, "Define access log format for http-server. E.g: apache,json")
 	aReturnSize         = flag.Bool("return-size", false, "Return the image size in the HTTP headers")
+	aEnableServerTiming = flag.Bool("enable-server-timing", false, "Return the processing stages timing and the input image details in the HTTP headers")
+	aTracingExporter    = flag.String("tracing-exporter", "", "Distributed tracing spans exporter. E.g: otlp,stdout,file. Disabled by default")
+	aTracingEndpoint    = flag.String("tracing-endpoint", "", "OTLP/HTTP traces endpoint used by the otlp tracing exporter")
+	aTracingFile        = flag.String("tracing-file", "", "File path used by the file tracing exporter")
+	aTracingServiceName = flag.String("tracing-service-name", "imaginary", "Service name reported in the exported traces")
+	aTracingSampleRatio = flag.Float64("tracing-sample-ratio", 1, "Ratio of the traces sampled when the request carries no trace context")
 )
 
 const usage = `imaginary %s
@@ -62,13 +112,18 @@ Usage:
   imaginary -path-prefix /api/v1
   imaginary -enable-url-source
   imaginary -disable-endpoints form,health,crop,rotate
+  imaginary -mount ./images -enable-url-source -sources http,fs
   imaginary -enable-url-source -allowed-origins http://localhost,http://server.com
   imaginary -enable-url-source -enable-auth-forwarding
   imaginary -enable-url-source -authorization "Basic AwDJdL2DbwrD=="
   imaginary -enable-placeholder
   imaginary -enable-url-source -placeholder ./placeholder.jpg
   imaginary -enable-url-signature -url-signature-key 4f46feebafc4b5e988f131c4ff8b5997
+  imaginary sign -key 4f46feebafc4b5e988f131c4ff8b5997 -expires 1h "/resize?width=300&url=http://foo/bar.jpg"
+  imaginary verify -key 4f46feebafc4b5e988f131c4ff8b5997 "/resize?width=300&url=http://foo/bar.jpg&sign=..."
   imaginary -enable-url-source -forward-headers X-Custom,X-Token
+  imaginary -enable-url-source -allowed-networks 10.0.0.0/8
+  imaginary -enable-s3-source -s3-endpoint http://localhost:9000 -s3-path-style -s3-bucket images
   imaginary -h | -help
   imaginary -v | -version
 
@@ -82,19 +137,65 @@ Options:
   -cors                      Enable CORS support [default: false]
   -gzip                      Enable gzip compression (deprecated) [default: false]
   -disable-endpoints         Comma separated endpoints to disable. E.g: form,crop,rotate,health [default: ""]
+  -sources <names>           Comma separated image sources to enable, in order of precedence [default: fs,http,payload]
+  -disable-sources <names>   Comma separated image sources to disable. E.g: fs,http [default: ""]
   -key <key>                 Define API key for authorization
+  -api-keys-file <path>      JSON file defining multiple API keys with their own scopes and limits
+  -jwt-secrets <list>        Comma separated list of HMAC secrets used to verify JWT bearer tokens.
+                             Or can use the environment variable JWT_SECRETS.
+  -jwt-jwks-file <path>      Local JWKS file with the public keys used to verify JWT bearer tokens
+  -jwt-issuer <value>        Required issuer (iss claim) of the JWT bearer tokens
+  -jwt-audience <value>      Required audience (aud claim) of the JWT bearer tokens
   -mount <path>              Mount server local directory
   -http-cache-ttl <num>      The TTL in seconds. Adds caching headers to locally served files.
   -http-read-timeout <num>   HTTP read timeout in seconds [default: 30]
   -http-write-timeout <num>  HTTP write timeout in seconds [default: 30]
+  -http-client-timeout <num> Remote image fetching overall timeout in seconds, including retries [default: 30]
+  -http-client-connect-timeout <num>
+                             Remote image fetching connect timeout in seconds [default: 10]
+  -http-client-tls-timeout <num>
+                             Remote image fetching TLS handshake timeout in seconds [default: 10]
+  -http-client-header-timeout <num>
+                             Remote image fetching response headers timeout in seconds [default: 15]
+  -http-client-retries <num> Maximum retries on connection errors or 5xx responses [default: 2]
+  -http-client-retry-backoff <ms>
+                             Initial exponential backoff between retries in milliseconds [default: 100]
+  -http-client-max-idle-conns <num>
+                             Maximum idle connections kept in the remote fetching pool [default: 100]
+  -http-client-max-idle-conns-per-host <num>
+                             Maximum idle connections per host kept in the remote fetching pool [default: 10]
+  -http-client-idle-timeout <num>
+                             Remote fetching idle connections timeout in seconds [default: 90]
   -enable-url-source         Enable remote HTTP URL image source processing
   -enable-placeholder        Enable image response placeholder to be used in case of error [default: false]
   -enable-auth-forwarding    Forwards X-Forward-Authorization or Authorization header to the image source server. -enable-url-source flag must be defined. Tip: secure your server from public access to prevent attack vectors
   -forward-headers           Forwards custom headers to the image source server. -enable-url-source flag must be defined.
   -enable-url-signature      Enable URL signature (URL-safe Base64-encoded HMAC digest) [default: false]
   -url-signature-key         The URL signature key (32 characters minimum)
+  -url-signature-keys        Comma separated list of URL signature keys identified by the kid param. E.g: 2024a:key1,2024b:key2
+                             Or can use the environment variable URL_SIGNATURE_KEYS.
+  -url-signature-params      Comma separated list of the request params covered by the URL signature [default: all]
+  -enable-s3-source          Enable S3-compatible object storage image source processing (?bucket=..&object=..)
+  -s3-endpoint <url>         S3-compatible endpoint URL [default: https://s3.<region>.amazonaws.com]
+  -s3-region <region>        S3 region used to sign requests. Or AWS_REGION env var [default: us-east-1]
+  -s3-bucket <name>          Default S3 bucket used when the bucket param is not present
+  -s3-path-style             Use path-style S3 addressing instead of virtual-hosted-style [default: false]
+  -s3-access-key <key>       S3 access key ID. Or AWS_ACCESS_KEY_ID env var
+  -s3-secret-key <key>       S3 secret access key. Or AWS_SECRET_ACCESS_KEY env var
+  -s3-allowed-buckets        Restrict the S3 buckets defined by the bucket param (separated by commas)
   -allowed-origins <urls>    Restrict remote image source processing to certain origins (separated by commas)
-  -max-allowed-size <bytes>  Restrict maximum size of http image source (in bytes)
+  -disable-ssrf-protection   Allow fetching remote images from loopback, private, link-local and multicast IP addresses [default: false]
+  -allowed-networks <cidrs>  Comma separated IP addresses or CIDR networks allowed to be fetched despite the SSRF protection
+  -max-allowed-size <bytes>  Restrict maximum size of image sources (in bytes). Replies with 413 if exceeded
+  -memory-cache-max-size <bytes>
+                             Maximum size in bytes of the in-memory cache of processed images [default: disabled]
+  -cache-dir <path>          Local directory used as persistent cache of processed images [default: disabled]
+  -cache-max-size <bytes>    Maximum size in bytes of the disk cache of processed images [default: 1073741824]
+  -cache-ttl <seconds>       Time processed images are kept in the in-memory and disk caches. Zero disables the expiration [default: 86400]
+  -max-input-pixels <num>    Restrict maximum number of pixels (width x height) of input images [default: disabled]
+  -max-output-width <num>    Restrict maximum width of output images [default: disabled]
+  -max-output-height <num>   Restrict maximum height of output images [default: disabled]
+  -max-output-pixels <num>   Restrict maximum number of pixels (width x height) of output images [default: disabled]
   -certfile <path>           TLS certificate file path
   -keyfile <path>            TLS private key file path
   -authorization <value>     Defines a constant Authorization header value passed to all the image source servers. -enable-url-source flag must be defined. This overwrites authorization headers forwarding behavior via X-Forward-Authorization
@@ -102,19 +203,51 @@ Options:
   -placeholder-status <code> HTTP status returned when use -placeholder flag
   -concurrency <num>         Throttle concurrency limit per second [default: disabled]
   -burst <num>               Throttle burst max cache size [default: 100]
+  -processing-workers <num>  Maximum number of images processed at the same time [default: disabled]
+  -processing-queue <num>    Maximum number of requests waiting for a processing worker [default: 100]
+  -processing-queue-timeout <num>
+                             Maximum time in seconds waiting for a processing worker [default: 10]
+  -memory-budget <num>       Memory budget in megabytes. New image processing waits up to -processing-queue-timeout
+                             or is rejected if the projected memory usage exceeds it [default: disabled]
+  -rate-limit-by <list>      Comma separated list of classes identifying the throttled clients, in precedence order:
+                             key, ip or header:<name>. E.g: key,ip [default: disabled, all clients share the limit]
+  -rate-limit-quotas <list>  Comma separated list of throttle quotas by client class, as requests per second
+                             and optional burst. E.g: key=100/200,ip=10/20 [default: -concurrency and -burst]
+  -trusted-proxies <cidrs>   Comma separated IP addresses or CIDR networks of the proxies trusted to define
+                             the client IP via X-Forwarded-For
   -mrelease <num>            OS memory release interval in seconds [default: 30]
   -cpus <num>                Number of used cpu cores.
                              (default for current machine is %d cores)
   -log-level                 Set log level for http-server. E.g: info,warning,error [default: info].
                              Or can use the environment variable GOLANG_LOG=info.
+  -log-format                Set access log format for http-server. E.g: apache,json [default: apache].
   -return-size               Return the image size with X-Width and X-Height HTTP header. [default: disabled].
+  -enable-server-timing      Return the Server-Timing header and the input image details HTTP headers. [default: disabled].
+  -tracing-exporter <name>   Distributed tracing spans exporter. E.g: otlp,stdout,file [default: disabled]
+  -tracing-endpoint <url>    OTLP/HTTP traces endpoint [default: http://localhost:4318/v1/traces].
+                             Or can use the environment variable OTEL_EXPORTER_OTLP_TRACES_ENDPOINT.
+  -tracing-file <path>       File path where the file tracing exporter writes the spans
+  -tracing-service-name      Service name reported in the exported traces [default: imaginary].
+                             Or can use the environment variable OTEL_SERVICE_NAME.
+  -tracing-sample-ratio      Ratio of the new traces being sampled, between 0 and 1 [default: 1]
 `
 
 type URLSignature struct {
-	Key string
+	Key  string
+	Keys map[string]string
 }
 
 func main() {
+	// Run the URL signature subcommands, if required
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "sign":
+			os.Exit(signCommand(os.Args[2:], os.Stdout, os.Stderr))
+		case "verify":
+			os.Exit(verifyCommand(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+
 	flag.Usage = func() {
 		_, _ = fmt.Fprintf(os.Stderr, usage, Version, runtime.NumCPU())
 	}
@@ -131,7 +264,10 @@ func main() {
 	runtime.GOMAXPROCS(*aCpus)
 
 	port := getPort(*aPort)
-	urlSignature := getURLSignature(*aURLSignatureKey)
+	urlSignature, err := getURLSignature(*aURLSignatureKey, *aURLSignatureKeys)
+	if err != nil {
+		exitWithError("invalid URL signature keys: %s", err)
+	}
 
 	opts := ServerOptions{
 		Port:               port,
@@ -142,9 +278,12 @@ func main() {
 		EnablePlaceholder:  *aEnablePlaceholder,
 		EnableURLSignature: *aEnableURLSignature,
 		URLSignatureKey:    urlSignature.Key,
+		URLSignatureKeys:   urlSignature.Keys,
+		URLSignatureParams: parseURLSignatureParams(*aURLSignatureParams),
 		PathPrefix:         *aPathPrefix,
 		APIKey:             *aKey,
 		Concurrency:        *aConcurrency,
+		MemoryBudget:       int64(*aMemoryBudget) * 1024 * 1024,
 		Burst:              *aBurst,
 		Mount:              *aMount,
 		CertFile:           *aCertFile,
@@ -158,8 +297,53 @@ func main() {
 		ForwardHeaders:     parseForwardHeaders(*aForwardHeaders),
 		AllowedOrigins:     parseOrigins(*aAllowedOrigins),
 		MaxAllowedSize:     *aMaxAllowedSize,
+		MemoryCacheMaxSize: *aMemoryCacheMaxSize,
+		CacheDir:           *aCacheDir,
+		CacheMaxSize:       *aCacheMaxSize,
+		CacheTTL:           time.Duration(*aCacheTTL) * time.Second,
 		LogLevel:           getLogLevel(*aLogLevel),
+		LogFormat:          *aLogFormat,
 		ReturnSize:         *aReturnSize,
+		EnableServerTiming: *aEnableServerTiming,
+		Tracing: TracingOptions{
+			Exporter:    *aTracingExporter,
+			Endpoint:    getTracingEndpoint(*aTracingEndpoint),
+			File:        *aTracingFile,
+			ServiceName: getTracingServiceName(*aTracingServiceName),
+			SampleRatio: *aTracingSampleRatio,
+		},
+		Limits: ImageLimits{
+			MaxInputPixels:  *aMaxInputPixels,
+			MaxOutputWidth:  *aMaxOutputWidth,
+			MaxOutputHeight: *aMaxOutputHeight,
+			MaxOutputPixels: *aMaxOutputPixels,
+		},
+		Processing: ProcessingOptions{
+			Workers:      *aProcessWorkers,
+			Queue:        *aProcessQueue,
+			QueueTimeout: time.Duration(*aProcessTimeout) * time.Second,
+		},
+		HTTPClient: HTTPClientOptions{
+			Timeout:               time.Duration(*aClientTimeout) * time.Second,
+			ConnectTimeout:        time.Duration(*aClientConnTimeout) * time.Second,
+			TLSHandshakeTimeout:   time.Duration(*aClientTLSTimeout) * time.Second,
+			ResponseHeaderTimeout: time.Duration(*aClientHdrTimeout) * time.Second,
+			IdleConnTimeout:       time.Duration(*aClientIdleTimeout) * time.Second,
+			MaxIdleConns:          *aClientIdleConns,
+			MaxIdleConnsPerHost:   *aClientIdlePerHost,
+			MaxRetries:            *aClientRetries,
+			RetryBackoff:          time.Duration(*aClientBackoff) * time.Millisecond,
+			SSRFProtection:        !*aDisableSSRF,
+		},
+		S3: getS3Options(S3Options{
+			Enabled:   *aEnableS3Source,
+			Endpoint:  *aS3Endpoint,
+			Region:    *aS3Region,
+			Bucket:    *aS3Bucket,
+			PathStyle: *aS3PathStyle,
+			AccessKey: *aS3AccessKey,
+			SecretKey: *aS3SecretKey,
+		}),
 	}
 
 	// Show warning if gzip flag is passed
@@ -182,11 +366,94 @@ func main() {
 		checkHTTPCacheTTL(*aHTTPCacheTTL)
 	}
 
+	// Read the API keys file, if present
+	if *aAPIKeysFile != "" {
+		keys, err := LoadAPIKeys(*aAPIKeysFile)
+		if err != nil {
+			exitWithError("cannot read the API keys file: %s", err)
+		}
+		opts.APIKeys = keys
+	}
+
+	// Create the JWT bearer token verifier, if enabled
+	if jwtOptions := getJWTOptions(); jwtOptions.IsEnabled() {
+		verifier, err := NewJWTVerifier(jwtOptions)
+		if err != nil {
+			exitWithError("invalid JWT options: %s", err)
+		}
+		opts.JWT = verifier
+	}
+
 	// Parse endpoint names to disabled, if present
 	if *aDisableEndpoints != "" {
 		opts.Endpoints = parseEndpoints(*aDisableEndpoints)
 	}
 
+	// Validate the access log format
+	if *aLogFormat != LogFormatApache && *aLogFormat != LogFormatJSON {
+		exitWithError("unsupported log format: %s", *aLogFormat)
+	}
+
+	// Parse networks allowed by the SSRF protection, if present
+	if *aAllowedNetworks != "" {
+		networks, err := parseNetworks(*aAllowedNetworks)
+		if err != nil {
+			exitWithError("cannot parse allowed networks: %s", err)
+		}
+		opts.HTTPClient.AllowedNetworks = networks
+	}
+
+	// Parse and validate the S3 buckets, if present
+	if *aS3Bucket != "" && !isValidS3BucketName(*aS3Bucket) {
+		exitWithError("invalid S3 bucket name: %s", *aS3Bucket)
+	}
+	if *aS3AllowedBuckets != "" {
+		buckets := parseBuckets(*aS3AllowedBuckets)
+		for _, bucket := range buckets {
+			if !isValidS3BucketName(bucket) {
+				exitWithError("invalid S3 bucket name: %s", bucket)
+			}
+		}
+		opts.S3.AllowedBuckets = buckets
+	}
+
+	// Validate the cache TTL
+	if *aCacheTTL < 0 {
+		exitWithError("cache TTL must be positive")
+	}
+
+	// Validate the processing pool params
+	if *aProcessWorkers < 0 || *aProcessQueue < 0 || *aProcessTimeout < 0 || *aMemoryBudget < 0 {
+		exitWithError("processing pool params must be positive")
+	}
+
+	// Parse the throttle client classes and quotas, if present
+	if *aRateLimitBy != "" || *aRateLimitQuotas != "" || *aTrustedProxies != "" {
+		by, err := parseRateLimitBy(*aRateLimitBy)
+		if err != nil {
+			exitWithError("%s", err)
+		}
+		quotas, err := parseRateLimitQuotas(*aRateLimitQuotas, by)
+		if err != nil {
+			exitWithError("%s", err)
+		}
+		proxies, err := parseNetworks(*aTrustedProxies)
+		if err != nil {
+			exitWithError("cannot parse trusted proxies: %s", err)
+		}
+		opts.RateLimit = RateLimitOptions{By: by, Quotas: quotas, TrustedProxies: proxies}
+	}
+
+	// Parse image sources precedence and disabled sources, if present
+	if *aSources != "" {
+		opts.Sources = parseSources(*aSources)
+		checkSources(opts.Sources)
+	}
+	if *aDisableSources != "" {
+		opts.DisabledSources = parseSources(*aDisableSources)
+		checkSources(opts.DisabledSources)
+	}
+
 	// Read placeholder image, if required
 	if *aPlaceholder != "" {
 		buf, err := ioutil.ReadFile(*aPlaceholder)
@@ -207,13 +474,18 @@ func main() {
 
 	// Check URL signature key, if required
 	if *aEnableURLSignature {
-		if urlSignature.Key == "" {
+		if urlSignature.Key == "" && len(urlSignature.Keys) == 0 {
 			exitWithError("URL signature key is required")
 		}
 
-		if len(urlSignature.Key) < 32 {
+		if urlSignature.Key != "" && len(urlSignature.Key) < 32 {
 			exitWithError("URL signature key must be a minimum of 32 characters")
 		}
+		for kid, key := range urlSignature.Keys {
+			if len(key) < 32 {
+				exitWithError("URL signature key %s must be a minimum of 32 characters", kid)
+			}
+		}
 	}
 
 	debug("imaginary server listening on port :%d/%s", opts.Port, strings.TrimPrefix(opts.PathPrefix, "/"))
@@ -221,6 +493,20 @@ func main() {
 	// Load image source providers
 	LoadSources(opts)
 
+	// Create the processed images caches, if enabled
+	if err := LoadResponseCache(opts); err != nil {
+		exitWithError("cannot create the cache: %s", err)
+	}
+
+	// Create the bounded processing pool and the memory budget, if enabled
+	LoadProcessingPool(opts)
+	LoadMemoryBudget(opts)
+
+	// Create the distributed tracing exporter, if enabled
+	if err := LoadTracer(opts); err != nil {
+		exitWithError("cannot start tracing: %s", err)
+	}
+
 	// Start the server
 	Server(opts)
 }
@@ -235,12 +521,37 @@ func getPort(port int) int {
 	return port
 }
 
-func getURLSignature(key string) URLSignature {
+func getURLSignature(key, keys string) (URLSignature, error) {
 	if keyEnv := os.Getenv("URL_SIGNATURE_KEY"); keyEnv != "" {
 		key = keyEnv
 	}
+	if keysEnv := os.Getenv("URL_SIGNATURE_KEYS"); keysEnv != "" {
+		keys = keysEnv
+	}
 
-	return URLSignature{key}
+	parsed, err := parseURLSignatureKeys(keys)
+	return URLSignature{key, parsed}, err
+}
+
+// parseURLSignatureKeys parses a list of key ID and key pairs, such as: 2024a:key1,2024b:key2
+func parseURLSignatureKeys(input string) (map[string]string, error) {
+	keys := map[string]string{}
+	for i, pair := range strings.Split(input, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kid, key, ok := strings.Cut(pair, ":")
+		if !ok || kid == "" || key == "" {
+			// Only report the position of the pair, since it may be a key missing its ID
+			return nil, fmt.Errorf("invalid key ID and key pair at position %d", i+1)
+		}
+		if _, exists := keys[kid]; exists {
+			return nil, fmt.Errorf("duplicate key ID: %s", kid)
+		}
+		keys[kid] = key
+	}
+	return keys, nil
 }
 
 func getLogLevel(logLevel string) string {
@@ -250,6 +561,26 @@ func getLogLevel(logLevel string) string {
 	return logLevel
 }
 
+func getTracingEndpoint(endpoint string) string {
+	if endpoint != "" {
+		return endpoint
+	}
+	if endpointEnv := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); endpointEnv != "" {
+		return endpointEnv
+	}
+	if endpointEnv := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpointEnv != "" {
+		return strings.TrimSuffix(endpointEnv, "/") + "/v1/traces"
+	}
+	return DefaultOTLPEndpoint
+}
+
+func getTracingServiceName(name string) string {
+	if nameEnv := os.Getenv("OTEL_SERVICE_NAME"); nameEnv != "" {
+		name = nameEnv
+	}
+	return name
+}
+
 func showUsage() {
 	flag.Usage()
 	os.Exit(1)
@@ -297,6 +628,31 @@ func parseForwardHeaders(forwardHeaders string) []string {
 	return headers
 }
 
+func getJWTOptions() JWTOptions {
+	secrets := *aJWTSecrets
+	if secretsEnv := os.Getenv("JWT_SECRETS"); secretsEnv != "" {
+		secrets = secretsEnv
+	}
+
+	o := JWTOptions{JWKSFile: *aJWTJWKSFile, Issuer: *aJWTIssuer, Audience: *aJWTAudience}
+	for _, secret := range strings.Split(secrets, ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			o.Secrets = append(o.Secrets, secret)
+		}
+	}
+	return o
+}
+
+func parseURLSignatureParams(input string) []string {
+	var params []string
+	for _, param := range strings.Split(input, ",") {
+		if param = strings.TrimSpace(param); param != "" {
+			params = append(params, param)
+		}
+	}
+	return params
+}
+
 func parseOrigins(origins string) []*url.URL {
 	var urls []*url.URL
 	if origins == "" {
@@ -333,6 +689,35 @@ func parseEndpoints(input string) Endpoints {
 	return endpoints
 }
 
+func parseBuckets(input string) []string {
+	var buckets []string
+	for _, bucket := range strings.Split(input, ",") {
+		if bucket = strings.TrimSpace(bucket); bucket != "" {
+			buckets = append(buckets, bucket)
+		}
+	}
+	return buckets
+}
+
+func parseSources(input string) []ImageSourceType {
+	var sources []ImageSourceType
+	for _, source := range strings.Split(input, ",") {
+		source = strings.ToLower(strings.TrimSpace(source))
+		if source != "" {
+			sources = append(sources, ImageSourceType(source))
+		}
+	}
+	return sources
+}
+
+func checkSources(sources []ImageSourceType) {
+	for _, source := range sources {
+		if !IsSourceRegistered(source) {
+			exitWithError("unknown image source: %s", source)
+		}
+	}
+}
+
 func memoryRelease(interval int) {
 	ticker := time.NewTicker(time.Duration(interval) * time.Second)
 	go func() {
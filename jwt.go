@@ -0,0 +1,388 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// jwtLeeway defines the tolerated clock skew when checking the token expiration and not before claims.
+const jwtLeeway = 30 * time.Second
+
+var (
+	errJWTMalformed        = errors.New("malformed token")
+	errJWTUnsupportedAlg   = errors.New("unsupported signing algorithm")
+	errJWTInvalidSignature = errors.New("invalid token signature")
+	errJWTMissingExpiry    = errors.New("missing token expiration")
+	errJWTExpired          = errors.New("token expired")
+	errJWTNotYetValid      = errors.New("token not valid yet")
+	errJWTInvalidIssuer    = errors.New("invalid token issuer")
+	errJWTInvalidAudience  = errors.New("invalid token audience")
+)
+
+// JWTOptions defines the JWT bearer token authentication settings.
+type JWTOptions struct {
+	Secrets  []string
+	JWKSFile string
+	Issuer   string
+	Audience string
+}
+
+// IsEnabled returns true if any token verification key is defined.
+func (o JWTOptions) IsEnabled() bool {
+	return len(o.Secrets) > 0 || o.JWKSFile != ""
+}
+
+// JWTClaims defines the supported token claims. Empty endpoints and origins claims allow everything.
+type JWTClaims struct {
+	Subject   string      `json:"sub"`
+	Issuer    string      `json:"iss"`
+	Audience  jwtAudience `json:"aud"`
+	ExpiresAt *int64      `json:"exp"`
+	NotBefore *int64      `json:"nbf"`
+	Endpoints []string    `json:"endpoints"`
+	Origins   []string    `json:"origins"`
+}
+
+// jwtAudience supports both single and multiple audience claims.
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = jwtAudience{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+	*a = multiple
+	return nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwtKey is a token verification key, optionally identified by a key ID.
+type jwtKey struct {
+	id  string
+	key interface{}
+}
+
+// JWTVerifier verifies JWT bearer tokens signed with HMAC secrets or the public keys of a JWKS file.
+type JWTVerifier struct {
+	keys     []jwtKey
+	issuer   string
+	audience string
+}
+
+// NewJWTVerifier creates a new token verifier with the configured secrets and JWKS file keys.
+func NewJWTVerifier(o JWTOptions) (*JWTVerifier, error) {
+	v := &JWTVerifier{issuer: o.Issuer, audience: o.Audience}
+	for _, secret := range o.Secrets {
+		if len(secret) < 32 {
+			return nil, errors.New("JWT secrets must be a minimum of 32 characters")
+		}
+		v.keys = append(v.keys, jwtKey{key: []byte(secret)})
+	}
+
+	if o.JWKSFile != "" {
+		buf, err := ioutil.ReadFile(o.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := parseJWKS(buf)
+		if err != nil {
+			return nil, err
+		}
+		v.keys = append(v.keys, keys...)
+	}
+
+	if len(v.keys) == 0 {
+		return nil, errors.New("missing JWT verification keys")
+	}
+	return v, nil
+}
+
+// Verify checks the token signature and registered claims, returning its claims if valid.
+func (v *JWTVerifier) Verify(token string, now time.Time) (*JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errJWTMalformed
+	}
+
+	var header jwtHeader
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, errJWTMalformed
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errJWTMalformed
+	}
+
+	if err := v.verifySignature(header, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	claims := &JWTClaims{}
+	if err := decodeJWTSegment(parts[1], claims); err != nil {
+		return nil, errJWTMalformed
+	}
+	return claims, v.verifyClaims(claims, now)
+}
+
+func (v *JWTVerifier) verifySignature(header jwtHeader, signed string, signature []byte) error {
+	hashFunc, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return errJWTUnsupportedAlg
+	}
+
+	for _, key := range v.keys {
+		if header.Kid != "" && key.id != "" && key.id != header.Kid {
+			continue
+		}
+		if verifyJWTSignature(header.Alg, hashFunc, key.key, signed, signature) {
+			return nil
+		}
+	}
+	return errJWTInvalidSignature
+}
+
+// jwtAlgorithms maps the supported signing algorithms to their hash function.
+// The none algorithm is deliberately not supported.
+var jwtAlgorithms = map[string]crypto.Hash{
+	"HS256": crypto.SHA256,
+	"HS384": crypto.SHA384,
+	"HS512": crypto.SHA512,
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"PS256": crypto.SHA256,
+	"PS384": crypto.SHA384,
+	"PS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+	"EdDSA": 0,
+}
+
+// verifyJWTSignature verifies the signature with the given key. The key type must match the algorithm
+// to prevent algorithm confusion attacks, such as HMAC tokens signed with a public key.
+func verifyJWTSignature(alg string, hashFunc crypto.Hash, key interface{}, signed string, signature []byte) bool {
+	switch k := key.(type) {
+	case []byte:
+		if !strings.HasPrefix(alg, "HS") {
+			return false
+		}
+		mac := hmac.New(jwtHashConstructor(hashFunc), k)
+		_, _ = mac.Write([]byte(signed))
+		return hmac.Equal(signature, mac.Sum(nil))
+	case *rsa.PublicKey:
+		digest := jwtDigest(hashFunc, signed)
+		switch {
+		case strings.HasPrefix(alg, "RS"):
+			return rsa.VerifyPKCS1v15(k, hashFunc, digest, signature) == nil
+		case strings.HasPrefix(alg, "PS"):
+			return rsa.VerifyPSS(k, hashFunc, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(k, jwtDigest(hashFunc, signed), r, s)
+	case ed25519.PublicKey:
+		return alg == "EdDSA" && ed25519.Verify(k, []byte(signed), signature)
+	}
+	return false
+}
+
+func jwtHashConstructor(h crypto.Hash) func() hash.Hash {
+	switch h {
+	case crypto.SHA384:
+		return sha512.New384
+	case crypto.SHA512:
+		return sha512.New
+	}
+	return sha256.New
+}
+
+func jwtDigest(h crypto.Hash, signed string) []byte {
+	hasher := jwtHashConstructor(h)()
+	_, _ = hasher.Write([]byte(signed))
+	return hasher.Sum(nil)
+}
+
+func (v *JWTVerifier) verifyClaims(claims *JWTClaims, now time.Time) error {
+	if claims.ExpiresAt == nil {
+		return errJWTMissingExpiry
+	}
+	if now.Add(-jwtLeeway).Unix() >= *claims.ExpiresAt {
+		return errJWTExpired
+	}
+	if claims.NotBefore != nil && now.Add(jwtLeeway).Unix() < *claims.NotBefore {
+		return errJWTNotYetValid
+	}
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return errJWTInvalidIssuer
+	}
+	if v.audience != "" {
+		for _, audience := range claims.Audience {
+			if audience == v.audience {
+				return nil
+			}
+		}
+		return errJWTInvalidAudience
+	}
+	return nil
+}
+
+// scope returns the client scope defined by the token claims. The scope is represented
+// as an API key, so the endpoints and origins restrictions are enforced in the same way.
+func (c *JWTClaims) scope() (*APIKey, error) {
+	scope := &APIKey{Name: c.Subject, Endpoints: c.Endpoints}
+	for i, endpoint := range scope.Endpoints {
+		scope.Endpoints[i] = strings.ToLower(strings.TrimPrefix(endpoint, "/"))
+	}
+	for _, origin := range c.Origins {
+		origins := parseOrigins(origin)
+		if len(origins) != 1 || len(origins[0].Host) < 2 {
+			return nil, fmt.Errorf("invalid origins claim: %s", origin)
+		}
+		scope.origins = append(scope.origins, origins[0])
+	}
+	return scope, nil
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	buf, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
+
+// bearerToken returns the token of the Authorization bearer header, if present.
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// jwk represents a JSON Web Key, as defined by RFC 7517.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// parseJWKS parses the supported verification keys of a JWK set: RSA, EC, Ed25519 and symmetric keys.
+func parseJWKS(buf []byte) ([]jwtKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(buf, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make([]jwtKey, 0, len(set.Keys))
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWKS key %d: %s", i, err)
+		}
+		keys = append(keys, jwtKey{id: k.Kid, key: key})
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeJWKInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJWKInt(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := decodeJWKInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid EC point")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil || len(secret) < 32 {
+			return nil, errors.New("symmetric keys must be a minimum of 32 bytes")
+		}
+		return secret, nil
+	}
+	return nil, fmt.Errorf("unsupported key type: %s", k.Kty)
+}
+
+func decodeJWKInt(value string) (*big.Int, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(buf) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(buf), nil
+}
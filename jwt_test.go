@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testJWTSecret = "4f46feebafc4b5e988f131c4ff8b5997"
+
+func encodeTestJWT(t *testing.T, header, claims map[string]interface{}) string {
+	t.Helper()
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	return base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+}
+
+func signTestJWT(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	t.Helper()
+	header := map[string]interface{}{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	signed := encodeTestJWT(t, header, claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	var err error
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest[:])
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(k, []byte(signed))
+	}
+	if err != nil {
+		t.Fatalf("Cannot sign the token: %s", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func testJWTClaims(extra map[string]interface{}) map[string]interface{} {
+	claims := map[string]interface{}{"sub": "frontend", "exp": time.Now().Add(time.Hour).Unix()}
+	for name, value := range extra {
+		claims[name] = value
+	}
+	return claims
+}
+
+func writeTestJWKS(t *testing.T, keys ...map[string]string) string {
+	t.Helper()
+	buf, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := ioutil.WriteFile(path, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestJWTVerifierHMAC(t *testing.T) {
+	verifier, err := NewJWTVerifier(JWTOptions{Secrets: []string{"another-secret-of-32-characters!", testJWTSecret}})
+	if err != nil {
+		t.Fatalf("Cannot create the verifier: %s", err)
+	}
+	now := time.Now()
+	key := []byte(testJWTSecret)
+
+	cases := []struct {
+		token string
+		err   error
+	}{
+		{signTestJWT(t, "HS256", "", key, testJWTClaims(nil)), nil},
+		{signTestJWT(t, "HS256", "", key, testJWTClaims(map[string]interface{}{"exp": now.Add(-time.Minute).Unix()})), errJWTExpired},
+		{signTestJWT(t, "HS256", "", key, testJWTClaims(map[string]interface{}{"exp": now.Add(-10 * time.Second).Unix()})), nil},
+		{signTestJWT(t, "HS256", "", key, testJWTClaims(map[string]interface{}{"nbf": now.Add(time.Minute).Unix()})), errJWTNotYetValid},
+		{signTestJWT(t, "HS256", "", key, map[string]interface{}{"sub": "frontend"}), errJWTMissingExpiry},
+		{signTestJWT(t, "HS256", "", []byte("wrong-secret-of-32-characters!!!"), testJWTClaims(nil)), errJWTInvalidSignature},
+		{encodeTestJWT(t, map[string]interface{}{"alg": "none"}, testJWTClaims(nil)) + ".", errJWTUnsupportedAlg},
+		{"foo.bar", errJWTMalformed},
+	}
+	for i, c := range cases {
+		if _, err := verifier.Verify(c.token, now); err != c.err {
+			t.Errorf("Invalid verification of token %d: %v", i, err)
+		}
+	}
+
+	if _, err := NewJWTVerifier(JWTOptions{Secrets: []string{"short"}}); err == nil {
+		t.Fatal("Short secrets must be rejected")
+	}
+}
+
+func TestJWTVerifierJWKS(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPublic, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	encode := func(buf []byte) string {
+		return base64.RawURLEncoding.EncodeToString(buf)
+	}
+
+	path := writeTestJWKS(t,
+		map[string]string{"kty": "RSA", "kid": "rsa", "n": encode(rsaKey.N.Bytes()), "e": encode(big.NewInt(int64(rsaKey.E)).Bytes())},
+		map[string]string{"kty": "EC", "kid": "ec", "crv": "P-256", "x": encode(ecKey.X.Bytes()), "y": encode(ecKey.Y.Bytes())},
+		map[string]string{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": encode(edPublic)},
+		map[string]string{"kty": "oct", "kid": "hmac", "k": encode([]byte(testJWTSecret))},
+		map[string]string{"kty": "RSA", "kid": "enc", "use": "enc"},
+	)
+	verifier, err := NewJWTVerifier(JWTOptions{JWKSFile: path, Issuer: "https://auth.example.org", Audience: "imaginary"})
+	if err != nil {
+		t.Fatalf("Cannot create the verifier: %s", err)
+	}
+
+	claims := testJWTClaims(map[string]interface{}{"iss": "https://auth.example.org", "aud": []string{"imaginary", "other"}})
+	cases := []struct {
+		token string
+		err   error
+	}{
+		{signTestJWT(t, "RS256", "rsa", rsaKey, claims), nil},
+		{signTestJWT(t, "RS256", "", rsaKey, claims), nil},
+		{signTestJWT(t, "ES256", "ec", ecKey, claims), nil},
+		{signTestJWT(t, "EdDSA", "ed", edKey, claims), nil},
+		{signTestJWT(t, "HS256", "hmac", []byte(testJWTSecret), claims), nil},
+		{signTestJWT(t, "RS256", "ec", rsaKey, claims), errJWTInvalidSignature},
+		{signTestJWT(t, "ES256", "rsa", ecKey, claims), errJWTInvalidSignature},
+		// Algorithm confusion: an HMAC token signed with the RSA public key
+		{signTestJWT(t, "HS256", "rsa", rsaKey.N.Bytes(), claims), errJWTInvalidSignature},
+		{signTestJWT(t, "RS256", "rsa", rsaKey, testJWTClaims(map[string]interface{}{"iss": "https://evil.org", "aud": "imaginary"})), errJWTInvalidIssuer},
+		{signTestJWT(t, "RS256", "rsa", rsaKey, testJWTClaims(map[string]interface{}{"iss": "https://auth.example.org", "aud": "other"})), errJWTInvalidAudience},
+	}
+	for i, c := range cases {
+		if _, err := verifier.Verify(c.token, time.Now()); err != c.err {
+			t.Errorf("Invalid verification of token %d: %v", i, err)
+		}
+	}
+
+	invalid := []map[string]string{
+		{"kty": "EC", "crv": "P-256", "x": encode(ecKey.X.Bytes()), "y": encode(ecKey.X.Bytes())},
+		{"kty": "oct", "k": encode([]byte("short"))},
+		{"kty": "foo"},
+	}
+	for _, key := range invalid {
+		if _, err := NewJWTVerifier(JWTOptions{JWKSFile: writeTestJWKS(t, key)}); err == nil {
+			t.Errorf("Invalid JWKS key must be rejected: %v", key)
+		}
+	}
+	if _, err := NewJWTVerifier(JWTOptions{JWKSFile: filepath.Join(os.TempDir(), "missing-jwks.json")}); err == nil {
+		t.Fatal("Missing JWKS file must be rejected")
+	}
+}
+
+func TestAuthorizeClientBearerToken(t *testing.T) {
+	verifier, _ := NewJWTVerifier(JWTOptions{Secrets: []string{testJWTSecret}})
+	key := []byte(testJWTSecret)
+	scoped := testJWTClaims(map[string]interface{}{"endpoints": []string{"resize"}, "origins": []string{"https://cdn.example.org/images/"}})
+
+	var authorized *APIKey
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorized = apiKeyFrom(r.Context())
+	})
+
+	cases := []struct {
+		path, auth string
+		o          ServerOptions
+		status     int
+	}{
+		{"/crop", "Bearer " + signTestJWT(t, "HS256", "", key, testJWTClaims(nil)), ServerOptions{JWT: verifier}, http.StatusOK},
+		{"/resize", "Bearer " + signTestJWT(t, "HS256", "", key, scoped), ServerOptions{JWT: verifier}, http.StatusOK},
+		{"/crop", "bearer " + signTestJWT(t, "HS256", "", key, scoped), ServerOptions{JWT: verifier}, http.StatusForbidden},
+		{"/crop", "Bearer " + signTestJWT(t, "HS256", "", key, map[string]interface{}{}), ServerOptions{JWT: verifier}, http.StatusUnauthorized},
+		{"/crop", "", ServerOptions{JWT: verifier}, http.StatusUnauthorized},
+		{"/crop", "Basic Zm9vOmJhcg==", ServerOptions{JWT: verifier, APIKey: "master-secret-key"}, http.StatusUnauthorized},
+		// Without JWT authentication, the Authorization header is ignored
+		{"/crop", "Bearer " + signTestJWT(t, "HS256", "", key, testJWTClaims(nil)), ServerOptions{APIKey: "master-secret-key"}, http.StatusUnauthorized},
+	}
+	for i, c := range cases {
+		authorized = nil
+		req := httptest.NewRequest(http.MethodGet, c.path, nil)
+		if c.auth != "" {
+			req.Header.Set("Authorization", c.auth)
+		}
+		w := httptest.NewRecorder()
+		authorizeClient(next, c.o).ServeHTTP(w, req)
+
+		if w.Code != c.status {
+			t.Errorf("Invalid response status of case %d: %d", i, w.Code)
+		}
+		if w.Code == http.StatusOK && authorized == nil {
+			t.Errorf("Missing token scope in the request context of case %d", i)
+		}
+		if w.Code == http.StatusUnauthorized && c.o.JWT != nil && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("Missing WWW-Authenticate header of case %d", i)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/resize?url=https://example.org/foo.jpg", nil)
+	req.Header.Set("Authorization", "Bearer "+signTestJWT(t, "HS256", "", key, scoped))
+	authorizeClient(next, ServerOptions{JWT: verifier}).ServeHTTP(httptest.NewRecorder(), req)
+	if authorized == nil || authorized.Name != "frontend" {
+		t.Fatal("Missing token scope in the request context")
+	}
+	if err := authorizeSource(req.WithContext(withAPIKey(req.Context(), authorized)), ImageSourceTypeHTTP); err != ErrAPIKeyOriginNotAllowed {
+		t.Fatalf("The origins claim must restrict the image origins: %v", err)
+	}
+}
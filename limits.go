@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/h2non/bimg"
+)
+
+// ImageLimits defines the maximum allowed input and output image dimensions.
+// Zero values disable the corresponding limit.
+type ImageLimits struct {
+	MaxInputPixels  int
+	MaxOutputWidth  int
+	MaxOutputHeight int
+	MaxOutputPixels int
+}
+
+// IsEnabled returns true if at least one limit is defined.
+func (l ImageLimits) IsEnabled() bool {
+	return l.MaxInputPixels > 0 || l.MaxOutputWidth > 0 || l.MaxOutputHeight > 0 || l.MaxOutputPixels > 0
+}
+
+// CheckInput validates the input image dimensions. Only the image header
+// is read by libvips at this point, so the image is never fully decoded.
+func (l ImageLimits) CheckInput(buf []byte) (bimg.ImageSize, error) {
+	size, err := bimg.Size(buf)
+	if err != nil {
+		// Unreadable images will fail later on with a more meaningful error
+		return bimg.ImageSize{}, nil
+	}
+
+	pixels := int64(size.Width) * int64(size.Height)
+	if l.MaxInputPixels > 0 && pixels > int64(l.MaxInputPixels) {
+		return size, NewError(fmt.Sprintf("Image dimensions %dx%d exceed the maximum allowed input pixels: %d", size.Width, size.Height, l.MaxInputPixels), http.StatusUnprocessableEntity)
+	}
+	return size, nil
+}
+
+// CheckOptions validates the requested output dimensions against the limits,
+// including the ones defined by pipeline operations and multi tasks.
+// The input size is used to estimate the output dimensions when only one of them is defined.
+func (l ImageLimits) CheckOptions(o ImageOptions, input bimg.ImageSize) error {
+	if err := l.checkOutput(o, input); err != nil {
+		return err
+	}
+
+	// Params expressions are checked once evaluated against the current image
+	for _, operation := range o.Operations {
+		if opts, err := buildParamsFromMap(staticParams(operation)); err == nil {
+			if err := l.checkOutput(opts, input); err != nil {
+				return err
+			}
+		}
+	}
+	for _, task := range o.Multi {
+		if opts, err := buildParamsFromMap(task.Params); err == nil {
+			if err := l.checkOutput(opts, input); err != nil {
+				return err
+			}
+		}
+		if err := l.CheckOptions(ImageOptions{Operations: task.Operations}, input); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l ImageLimits) checkOutput(o ImageOptions, input bimg.ImageSize) error {
+	width, height := int64(o.Width), int64(o.Height)
+	if o.Factor > 0 {
+		width, height = int64(input.Width)*int64(o.Factor), int64(input.Height)*int64(o.Factor)
+	}
+
+	if l.MaxOutputWidth > 0 && width > int64(l.MaxOutputWidth) {
+		return NewError(fmt.Sprintf("Output width %d exceeds the maximum allowed: %d", width, l.MaxOutputWidth), http.StatusBadRequest)
+	}
+	if l.MaxOutputHeight > 0 && height > int64(l.MaxOutputHeight) {
+		return NewError(fmt.Sprintf("Output height %d exceeds the maximum allowed: %d", height, l.MaxOutputHeight), http.StatusBadRequest)
+	}
+
+	// Estimate the missing dimension preserving the input aspect ratio
+	if input.Width > 0 && input.Height > 0 {
+		if width > 0 && height == 0 {
+			height = width * int64(input.Height) / int64(input.Width)
+		} else if height > 0 && width == 0 {
+			width = height * int64(input.Width) / int64(input.Height)
+		}
+	}
+
+	if l.MaxOutputPixels > 0 && width*height > int64(l.MaxOutputPixels) {
+		return NewError(fmt.Sprintf("Output dimensions %dx%d exceed the maximum allowed output pixels: %d", width, height, l.MaxOutputPixels), http.StatusBadRequest)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/h2non/bimg"
+)
+
+func TestImageLimitsCheckOptions(t *testing.T) {
+	limits := ImageLimits{MaxOutputWidth: 1000, MaxOutputHeight: 800, MaxOutputPixels: 500000}
+	input := bimg.ImageSize{Width: 2000, Height: 1000}
+
+	cases := []struct {
+		name    string
+		options ImageOptions
+		valid   bool
+	}{
+		{"Within limits", ImageOptions{Width: 800, Height: 600}, true},
+		{"Exceeds width", ImageOptions{Width: 1001}, false},
+		{"Exceeds height", ImageOptions{Height: 801}, false},
+		{"Exceeds pixels", ImageOptions{Width: 1000, Height: 800}, false},
+		{"Exceeds estimated pixels", ImageOptions{Width: 1000}, true},
+		{"Exceeds zoom factor", ImageOptions{Factor: 2}, false},
+		{"Exceeds pipeline operation", ImageOptions{Operations: PipelineOperations{
+			{Name: "resize", Params: map[string]interface{}{"width": 100000}},
+		}}, false},
+		{"Exceeds pipeline operation with expressions", ImageOptions{Operations: PipelineOperations{
+			{Name: "resize", Params: map[string]interface{}{"width": "=width", "height": 900}},
+		}}, false},
+		{"Exceeds multi task", ImageOptions{Multi: []MultiTask{
+			{Name: "foo", OperationName: "enlarge", Params: map[string]interface{}{"width": 900, "height": 700}},
+		}}, false},
+		{"Exceeds multi task pipeline", ImageOptions{Multi: []MultiTask{
+			{Name: "foo", Operations: PipelineOperations{{Name: "resize", Params: map[string]interface{}{"height": 801}}}},
+		}}, false},
+	}
+
+	for _, test := range cases {
+		err := limits.CheckOptions(test.options, input)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+		if !test.valid {
+			xerr, ok := err.(Error)
+			if !ok || xerr.HTTPCode() != http.StatusBadRequest {
+				t.Errorf("%s: invalid error: %v", test.name, err)
+			}
+		}
+	}
+}
+
+func TestImageLimitsCheckOperationExpressions(t *testing.T) {
+	limits := ImageLimits{MaxOutputWidth: 1000}
+	operation := PipelineOperation{Name: "resize", Params: map[string]interface{}{"width": "=500 * 3"}}
+	if err := parseOperationExpressions(&operation); err != nil {
+		t.Fatalf("Cannot parse the operation expressions: %s", err)
+	}
+
+	// Expressions are only checked once evaluated
+	if err := limits.CheckOptions(ImageOptions{Operations: PipelineOperations{operation}}, bimg.ImageSize{}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	buf, _ := ioutil.ReadFile("testdata/large.jpg")
+	_, _, err := resolveOperation(operation, buf, bimg.JPEG, limits)
+	if err == nil || !strings.Contains(err.Error(), "Output width 1500 exceeds") {
+		t.Fatalf("Evaluated params exceeding the limits must be rejected: %v", err)
+	}
+}
+
+func TestImageLimitsCheckInput(t *testing.T) {
+	buf, _ := ioutil.ReadFile("testdata/large.jpg")
+
+	_, err := ImageLimits{MaxInputPixels: 1920 * 1080}.CheckInput(buf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	_, err = ImageLimits{MaxInputPixels: 1920*1080 - 1}.CheckInput(buf)
+	xerr, ok := err.(Error)
+	if !ok || xerr.HTTPCode() != http.StatusUnprocessableEntity {
+		t.Fatalf("Invalid error: %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -10,6 +11,12 @@ import (
 
 const formatPattern = "%s - - [%s] \"%s\" %d %d %.4f\n"
 
+// Supported access log formats
+const (
+	LogFormatApache = "apache"
+	LogFormatJSON   = "json"
+)
+
 // LogRecord implements an Apache-compatible HTTP logging
 type LogRecord struct {
 	http.ResponseWriter
@@ -17,8 +24,39 @@ type LogRecord struct {
 	responseBytes         int64
 	ip                    string
 	method, uri, protocol string
+	endpoint              string
 	time                  time.Time
 	elapsedTime           time.Duration
+	info                  *RequestInfo
+}
+
+// LogEntry represents a JSON access log entry
+type LogEntry struct {
+	Time           string          `json:"time"`
+	RequestID      string          `json:"requestId"`
+	IP             string          `json:"ip"`
+	Method         string          `json:"method"`
+	URI            string          `json:"uri"`
+	Protocol       string          `json:"protocol"`
+	Endpoint       string          `json:"endpoint"`
+	APIKeyName     string          `json:"apiKeyName,omitempty"`
+	TokenSubject   string          `json:"tokenSubject,omitempty"`
+	Status         int             `json:"status"`
+	Bytes          int64           `json:"bytes"`
+	Duration       float64         `json:"duration"`
+	SourceType     ImageSourceType `json:"sourceType,omitempty"`
+	Source         string          `json:"source,omitempty"`
+	InputFormat    string          `json:"inputFormat,omitempty"`
+	InputWidth     int             `json:"inputWidth,omitempty"`
+	InputHeight    int             `json:"inputHeight,omitempty"`
+	InputBytes     int             `json:"inputBytes,omitempty"`
+	OutputFormat   string          `json:"outputFormat,omitempty"`
+	OutputWidth    int             `json:"outputWidth,omitempty"`
+	OutputHeight   int             `json:"outputHeight,omitempty"`
+	OutputBytes    int             `json:"outputBytes,omitempty"`
+	FetchTime      float64         `json:"fetchTime,omitempty"`
+	ProcessingTime float64         `json:"processingTime,omitempty"`
+	Error          string          `json:"error,omitempty"`
 }
 
 // Log writes a log entry in the passed io.Writer stream
@@ -28,6 +66,39 @@ func (r *LogRecord) Log(out io.Writer) {
 	_, _ = fmt.Fprintf(out, formatPattern, r.ip, timeFormat, request, r.status, r.responseBytes, r.elapsedTime.Seconds())
 }
 
+// LogJSON writes a JSON log entry, including the request details, in the passed io.Writer stream
+func (r *LogRecord) LogJSON(out io.Writer) {
+	info := r.info
+	body, _ := json.Marshal(LogEntry{
+		Time:           r.time.Format(time.RFC3339Nano),
+		RequestID:      info.ID,
+		IP:             r.ip,
+		Method:         r.method,
+		URI:            r.uri,
+		Protocol:       r.protocol,
+		Endpoint:       r.endpoint,
+		Status:         r.status,
+		Bytes:          r.responseBytes,
+		Duration:       r.elapsedTime.Seconds(),
+		APIKeyName:     info.APIKeyName,
+		TokenSubject:   info.TokenSubject,
+		SourceType:     info.SourceType,
+		Source:         info.Source,
+		InputFormat:    info.InputFormat,
+		InputWidth:     info.InputWidth,
+		InputHeight:    info.InputHeight,
+		InputBytes:     info.InputBytes,
+		OutputFormat:   info.OutputFormat,
+		OutputWidth:    info.OutputWidth,
+		OutputHeight:   info.OutputHeight,
+		OutputBytes:    info.OutputBytes,
+		FetchTime:      info.FetchTime.Seconds(),
+		ProcessingTime: info.ProcessingTime.Seconds(),
+		Error:          info.Error,
+	})
+	_, _ = out.Write(append(body, '\n'))
+}
+
 // Write acts like a proxy passing the given bytes buffer to the ResponseWritter
 // and additionally counting the passed amount of bytes for logging usage.
 func (r *LogRecord) Write(p []byte) (int, error) {
@@ -44,14 +115,15 @@ func (r *LogRecord) WriteHeader(status int) {
 
 // LogHandler maps the HTTP handler with a custom io.Writer compatible stream
 type LogHandler struct {
-	handler    http.Handler
-	io         io.Writer
-	logLevel   string
+	handler   http.Handler
+	io        io.Writer
+	logLevel  string
+	logFormat string
 }
 
-// NewLog creates a new logger
-func NewLog(handler http.Handler, io io.Writer, logLevel string) http.Handler {
-	return &LogHandler{handler, io, logLevel}
+// NewLog creates a new logger writing entries in the given format, either apache or json
+func NewLog(handler http.Handler, io io.Writer, logLevel, logFormat string) http.Handler {
+	return &LogHandler{handler, io, logLevel, logFormat}
 }
 
 // Implements the required method as standard HTTP handler, serving the request.
@@ -61,6 +133,10 @@ func (h *LogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		clientIP = clientIP[:colon]
 	}
 
+	// Accept or generate the request ID, and echo it in the response
+	info := &RequestInfo{ID: getRequestID(r)}
+	w.Header().Set(RequestIDHeader, info.ID)
+
 	record := &LogRecord{
 		ResponseWriter: w,
 		ip:             clientIP,
@@ -68,27 +144,37 @@ func (h *LogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		method:         r.Method,
 		uri:            r.RequestURI,
 		protocol:       r.Proto,
+		endpoint:       operationName(r),
 		status:         http.StatusOK,
 		elapsedTime:    time.Duration(0),
+		info:           info,
 	}
 
 	startTime := time.Now()
-	h.handler.ServeHTTP(record, r)
+	h.handler.ServeHTTP(record, r.WithContext(withRequestInfo(r.Context(), info)))
 	finishTime := time.Now()
 
 	record.time = finishTime.UTC()
 	record.elapsedTime = finishTime.Sub(startTime)
 
-	switch h.logLevel{
+	switch h.logLevel {
 	case "error":
 		if record.status >= http.StatusInternalServerError {
-			record.Log(h.io)
+			h.log(record)
 		}
 	case "warning":
 		if record.status >= http.StatusBadRequest {
-			record.Log(h.io)
+			h.log(record)
 		}
 	case "info":
-		record.Log(h.io)
+		h.log(record)
+	}
+}
+
+func (h *LogHandler) log(record *LogRecord) {
+	if h.logFormat == LogFormatJSON {
+		record.LogJSON(h.io)
+		return
 	}
+	record.Log(h.io)
 }
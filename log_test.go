@@ -1,10 +1,13 @@
 package main
 
 import (
+	"encoding/json"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 type fakeWriter func([]byte) (int, error)
@@ -21,7 +24,7 @@ func TestLogInfo(t *testing.T) {
 	})
 
 	noopHandler := func(w http.ResponseWriter, r *http.Request) {}
-	log := NewLog(http.HandlerFunc(noopHandler), writer, "info")
+	log := NewLog(http.HandlerFunc(noopHandler), writer, "info", LogFormatApache)
 
 	ts := httptest.NewServer(log)
 	defer ts.Close()
@@ -47,7 +50,7 @@ func TestLogError(t *testing.T) {
 	})
 
 	noopHandler := func(w http.ResponseWriter, r *http.Request) {}
-	log := NewLog(http.HandlerFunc(noopHandler), writer, "error")
+	log := NewLog(http.HandlerFunc(noopHandler), writer, "error", LogFormatApache)
 
 	ts := httptest.NewServer(log)
 	defer ts.Close()
@@ -62,3 +65,59 @@ func TestLogError(t *testing.T) {
 		t.Fatalf("Invalid log output: %s", data)
 	}
 }
+
+func TestLogJSON(t *testing.T) {
+	var buf []byte
+	writer := fakeWriter(func(b []byte) (int, error) {
+		buf = b
+		return 0, nil
+	})
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		info := requestInfoFrom(r.Context())
+		info.SourceType = ImageSourceTypeHTTP
+		info.Source = "http://foo/bar.jpg"
+		info.FetchTime = 2 * time.Second
+		ErrorReply(r, w, ErrEmptyBody, ServerOptions{})
+	}
+	log := NewLog(http.HandlerFunc(handler), writer, "info", LogFormatJSON)
+
+	ts := httptest.NewServer(log)
+	defer ts.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/resize", nil)
+	req.Header.Set(RequestIDHeader, "foo-123")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Header.Get(RequestIDHeader) != "foo-123" {
+		t.Fatalf("Invalid request ID header: %s", res.Header.Get(RequestIDHeader))
+	}
+
+	var entry LogEntry
+	if err := json.Unmarshal(buf, &entry); err != nil {
+		t.Fatalf("Invalid log output: %s", buf)
+	}
+	if entry.RequestID != "foo-123" || entry.Endpoint != "resize" || entry.Status != http.StatusBadRequest ||
+		entry.SourceType != ImageSourceTypeHTTP || entry.Source != "http://foo/bar.jpg" ||
+		entry.FetchTime != 2 || entry.Error != ErrEmptyBody.Message {
+		t.Fatalf("Invalid log entry: %#v", entry)
+	}
+}
+
+func TestLogGeneratesRequestID(t *testing.T) {
+	noopHandler := func(w http.ResponseWriter, r *http.Request) {}
+	log := NewLog(http.HandlerFunc(noopHandler), ioutil.Discard, "info", LogFormatApache)
+
+	for _, id := range []string{"", "invalid id", strings.Repeat("a", maxRequestIDLength+1)} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(RequestIDHeader, id)
+		w := httptest.NewRecorder()
+		log.ServeHTTP(w, req)
+
+		if generated := w.Header().Get(RequestIDHeader); len(generated) != 32 {
+			t.Fatalf("Invalid generated request ID: %s", generated)
+		}
+	}
+}
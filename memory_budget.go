@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"runtime"
+	d "runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/h2non/bimg"
+)
+
+// bytesPerPixel defines the memory of a decoded pixel, assuming 4 bands of 8 bits.
+const bytesPerPixel = 4
+
+// memoryBudgetRecheckInterval defines how often waiting requests check the memory usage again,
+// since it can decrease without any request finishing, such as after a garbage collection.
+const memoryBudgetRecheckInterval = 100 * time.Millisecond
+
+// memoryBudget sheds the image processing exceeding the memory budget, if enabled.
+var memoryBudget *MemoryBudget
+
+// MemoryBudget admits new image processing only if the projected memory usage, as the current
+// process memory plus the estimated memory of the images being processed not allocated yet, fits in the budget.
+// Otherwise requests wait until enough memory is released, up to the wait timeout.
+type MemoryBudget struct {
+	limit       int64
+	waitTimeout time.Duration
+	usage       func() int64
+
+	mu       sync.Mutex
+	reserved int64
+	base     int64 // process memory when the first of the images being processed was admitted
+	rejected int64
+	released chan struct{}
+	freed    time.Time
+}
+
+// MemoryBudgetStats defines the usage of the memory budget, in megabytes.
+type MemoryBudgetStats struct {
+	Budget   float64 `json:"budget"`
+	Usage    float64 `json:"usage"`
+	Reserved float64 `json:"reserved"`
+	Rejected int64   `json:"rejected"`
+}
+
+// LoadMemoryBudget creates the memory budget, if enabled.
+func LoadMemoryBudget(o ServerOptions) {
+	memoryBudget = nil
+	if o.MemoryBudget > 0 {
+		memoryBudget = NewMemoryBudget(o.MemoryBudget, o.Processing.QueueTimeout)
+	}
+}
+
+// NewMemoryBudget creates a new memory budget in bytes. A zero wait timeout waits until the request is canceled.
+func NewMemoryBudget(limit int64, waitTimeout time.Duration) *MemoryBudget {
+	return &MemoryBudget{
+		limit:       limit,
+		waitTimeout: waitTimeout,
+		usage:       currentMemoryUsage,
+		released:    make(chan struct{}),
+	}
+}
+
+// Reserve waits until the estimated memory cost of a request fits in the budget,
+// returning the function to release it once the image is processed.
+func (b *MemoryBudget) Reserve(ctx context.Context, cost int64) (func(), error) {
+	if cost > b.limit {
+		b.reject()
+		return nil, ErrImageTooLargeForMemory
+	}
+
+	var timeout <-chan time.Time
+	if b.waitTimeout > 0 {
+		timer := time.NewTimer(b.waitTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		b.mu.Lock()
+		usage := b.usage()
+		if usage+b.pending(usage)+cost <= b.limit {
+			if b.reserved == 0 {
+				b.base = usage
+			}
+			b.reserved += cost
+			b.mu.Unlock()
+			return func() { b.release(cost) }, nil
+		}
+		released := b.released
+		b.mu.Unlock()
+
+		// Return the unused memory to the OS, as done by the -mrelease ticker, so it is not projected anymore
+		b.freeOSMemory()
+
+		select {
+		case <-released:
+		case <-time.After(memoryBudgetRecheckInterval):
+		case <-timeout:
+			b.reject()
+			return nil, ErrMemoryBudgetExceeded
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// pending returns the reserved memory not included in the process memory yet. The memory growth
+// since the first of the images being processed was admitted is assumed to be allocated by them,
+// so the memory of the images being processed is not counted twice.
+func (b *MemoryBudget) pending(usage int64) int64 {
+	allocated := usage - b.base
+	if allocated < 0 {
+		allocated = 0
+	}
+	if allocated >= b.reserved {
+		return 0
+	}
+	return b.reserved - allocated
+}
+
+func (b *MemoryBudget) release(cost int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reserved -= cost
+	close(b.released)
+	b.released = make(chan struct{})
+}
+
+func (b *MemoryBudget) reject() {
+	b.mu.Lock()
+	b.rejected++
+	b.mu.Unlock()
+	metrics.IncQueueRejected("memory")
+}
+
+// freeOSMemory forces the release of the unused memory to the OS, at most once per second.
+func (b *MemoryBudget) freeOSMemory() {
+	b.mu.Lock()
+	if time.Since(b.freed) < time.Second {
+		b.mu.Unlock()
+		return
+	}
+	b.freed = time.Now()
+	b.mu.Unlock()
+	d.FreeOSMemory()
+}
+
+// RetryAfter returns the seconds a rejected client should wait before retrying.
+func (b *MemoryBudget) RetryAfter() int {
+	if seconds := ceilSeconds(b.waitTimeout.Seconds()); seconds > 0 {
+		return seconds
+	}
+	return 1
+}
+
+// Stats returns the current usage of the memory budget.
+func (b *MemoryBudget) Stats() MemoryBudgetStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return MemoryBudgetStats{
+		Budget:   toMegaBytes(uint64(b.limit)),
+		Usage:    toMegaBytes(uint64(b.usage())),
+		Reserved: toMegaBytes(uint64(b.reserved)),
+		Rejected: b.rejected,
+	}
+}
+
+// currentMemoryUsage returns the resident memory of the process, including the memory allocated
+// by libvips. If not available, the memory obtained from the OS by the Go runtime is returned.
+func currentMemoryUsage() int64 {
+	if buf, err := ioutil.ReadFile("/proc/self/statm"); err == nil {
+		if fields := strings.Fields(string(buf)); len(fields) > 1 {
+			if pages, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+				return pages * int64(os.Getpagesize())
+			}
+		}
+	}
+	mem := &runtime.MemStats{}
+	runtime.ReadMemStats(mem)
+	return int64(mem.Sys)
+}
+
+// estimateMemoryCost estimates the memory required to process an image, as the encoded input image
+// plus the decoded input and output images. The output size defaults to the input size if not defined.
+// Pipeline steps run one after the other, so only the largest step counts, using the static params
+// of each step. Multi tasks run in parallel unless the processing pool is enabled, in which case
+// only the largest task counts too.
+func estimateMemoryCost(buf []byte, input bimg.ImageSize, opts ImageOptions) int64 {
+	return int64(len(buf)) + estimateDecodedPixels(input, opts)*bytesPerPixel
+}
+
+func estimateDecodedPixels(input bimg.ImageSize, opts ImageOptions) int64 {
+	var pixels int64
+	switch {
+	case len(opts.Multi) > 0:
+		for _, task := range opts.Multi {
+			taskOpts := ImageOptions{Operations: task.Operations}
+			if len(task.Operations) == 0 {
+				taskOpts, _ = buildParamsFromMap(task.Params)
+			}
+			task := estimateDecodedPixels(input, taskOpts)
+			switch {
+			case processingPool == nil:
+				// Tasks run in parallel, so all of them count
+				pixels += task
+			case task > pixels:
+				// Tasks run one after the other, so only the largest task counts
+				pixels = task
+			}
+		}
+	case len(opts.Operations) > 0:
+		// Each step processes the output of the previous one
+		for _, operation := range opts.Operations {
+			stepOpts, err := buildParamsFromMap(staticParams(operation))
+			if err != nil {
+				stepOpts = ImageOptions{}
+			}
+			output := estimateOutputSize(input, stepOpts)
+			if step := imagePixels(input) + imagePixels(output); step > pixels {
+				pixels = step
+			}
+			input = output
+		}
+	default:
+		pixels = imagePixels(input) + imagePixels(estimateOutputSize(input, opts))
+	}
+	return pixels
+}
+
+func estimateOutputSize(input bimg.ImageSize, opts ImageOptions) bimg.ImageSize {
+	output := bimg.ImageSize{Width: opts.Width, Height: opts.Height}
+	switch {
+	case output.Width == 0 && output.Height == 0:
+		output = input
+	case output.Width == 0 && input.Height > 0:
+		output.Width = input.Width * output.Height / input.Height
+	case output.Height == 0 && input.Width > 0:
+		output.Height = input.Height * output.Width / input.Width
+	}
+	return output
+}
+
+func imagePixels(size bimg.ImageSize) int64 {
+	return int64(size.Width) * int64(size.Height)
+}
+
+// reserveMemory waits until the memory cost of the request fits in the memory budget, if enabled.
+func reserveMemory(ctx context.Context, cost int64) (func(), error) {
+	if memoryBudget == nil {
+		return func() {}, nil
+	}
+	return memoryBudget.Reserve(ctx, cost)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/h2non/bimg"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	budget := NewMemoryBudget(1000, time.Second)
+	usage := int64(400)
+	budget.usage = func() int64 { return usage }
+
+	release, err := budget.Reserve(context.Background(), 500)
+	if err != nil {
+		t.Fatalf("Cannot reserve memory: %s", err)
+	}
+
+	// Wait until the reserved memory is released
+	reserved := make(chan error)
+	go func() {
+		release, err := budget.Reserve(context.Background(), 500)
+		if err == nil {
+			release()
+		}
+		reserved <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	release()
+	if err := <-reserved; err != nil {
+		t.Fatalf("Cannot reserve the released memory: %s", err)
+	}
+
+	if _, err := budget.Reserve(context.Background(), 1001); err != ErrImageTooLargeForMemory {
+		t.Fatalf("Expected image too large error: %v", err)
+	}
+
+	stats := budget.Stats()
+	if stats.Reserved != 0 || stats.Rejected != 1 {
+		t.Fatalf("Invalid memory budget stats: %#v", stats)
+	}
+}
+
+func TestMemoryBudgetTimeout(t *testing.T) {
+	budget := NewMemoryBudget(1000, 20*time.Millisecond)
+	budget.usage = func() int64 { return 800 }
+
+	if _, err := budget.Reserve(context.Background(), 500); err != ErrMemoryBudgetExceeded {
+		t.Fatalf("Expected memory budget exceeded error: %v", err)
+	}
+
+	// The memory usage can decrease without any request finishing
+	usage := make(chan int64, 1)
+	usage <- 800
+	budget.usage = func() int64 {
+		select {
+		case value := <-usage:
+			return value
+		default:
+			return 0
+		}
+	}
+	budget.waitTimeout = time.Second
+	if _, err := budget.Reserve(context.Background(), 500); err != nil {
+		t.Fatalf("Cannot reserve memory after the usage decreased: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	budget.usage = func() int64 { return 800 }
+	if _, err := budget.Reserve(ctx, 500); err != context.Canceled {
+		t.Fatalf("Expected canceled context error: %v", err)
+	}
+}
+
+func TestMemoryBudgetAllocatedReservations(t *testing.T) {
+	budget := NewMemoryBudget(1000, 20*time.Millisecond)
+	usage := int64(200)
+	budget.usage = func() int64 { return usage }
+
+	if _, err := budget.Reserve(context.Background(), 400); err != nil {
+		t.Fatalf("Cannot reserve memory: %s", err)
+	}
+	if _, err := budget.Reserve(context.Background(), 500); err != ErrMemoryBudgetExceeded {
+		t.Fatalf("Expected memory budget exceeded error: %v", err)
+	}
+
+	// The image being processed allocated its reserved memory, which must not be counted twice
+	usage = 600
+	if _, err := budget.Reserve(context.Background(), 400); err != nil {
+		t.Fatalf("Cannot reserve memory once the reserved memory is allocated: %s", err)
+	}
+
+	// Partially allocated reservations are still counted
+	usage = 700
+	if _, err := budget.Reserve(context.Background(), 200); err != ErrMemoryBudgetExceeded {
+		t.Fatalf("Expected memory budget exceeded error: %v", err)
+	}
+}
+
+func TestEstimateMemoryCost(t *testing.T) {
+	input := bimg.ImageSize{Width: 1000, Height: 500}
+	cases := []struct {
+		opts     ImageOptions
+		expected int64
+	}{
+		{ImageOptions{}, 100 + 2*1000*500*bytesPerPixel},
+		{ImageOptions{Width: 200}, 100 + (1000*500+200*100)*bytesPerPixel},
+		{ImageOptions{Height: 1000}, 100 + (1000*500+2000*1000)*bytesPerPixel},
+		{ImageOptions{Width: 300, Height: 300}, 100 + (1000*500+300*300)*bytesPerPixel},
+	}
+	for _, c := range cases {
+		if cost := estimateMemoryCost(make([]byte, 100), input, c.opts); cost != c.expected {
+			t.Errorf("Invalid memory cost of %dx%d: %d", c.opts.Width, c.opts.Height, cost)
+		}
+	}
+}
+
+func TestEstimateMemoryCostOperations(t *testing.T) {
+	input := bimg.ImageSize{Width: 1000, Height: 500}
+	resize := func(params map[string]interface{}) PipelineOperation {
+		return PipelineOperation{Name: "resize", Params: params}
+	}
+
+	// Multi tasks count all the tasks, since they run in parallel
+	opts := ImageOptions{Multi: []MultiTask{
+		{Name: "small", OperationName: "resize", Params: map[string]interface{}{"width": 200}},
+		{Name: "large", OperationName: "enlarge", Params: map[string]interface{}{"width": 2000, "height": 1000}},
+		{Name: "steps", Operations: PipelineOperations{resize(map[string]interface{}{"width": 100})}},
+	}}
+	expected := 100 + (1000*500+200*100+1000*500+2000*1000+1000*500+100*50)*bytesPerPixel
+	if cost := estimateMemoryCost(make([]byte, 100), input, opts); cost != int64(expected) {
+		t.Errorf("Invalid memory cost of parallel multi tasks: %d != %d", cost, expected)
+	}
+
+	// Multi tasks count the largest task with the processing pool, since they run one after the other
+	LoadProcessingPool(ServerOptions{Processing: ProcessingOptions{Workers: 1}})
+	expected = 100 + (1000*500+2000*1000)*bytesPerPixel
+	if cost := estimateMemoryCost(make([]byte, 100), input, opts); cost != int64(expected) {
+		t.Errorf("Invalid memory cost of sequential multi tasks: %d != %d", cost, expected)
+	}
+	LoadProcessingPool(ServerOptions{})
+
+	// Pipeline steps count the largest step, ignoring the params expressions
+	opts = ImageOptions{Operations: PipelineOperations{
+		resize(map[string]interface{}{"width": 4000}),
+		resize(map[string]interface{}{"width": 100}),
+		resize(map[string]interface{}{"width": "=min(width, 8000)"}),
+	}}
+	expected = 100 + (1000*500+4000*2000)*bytesPerPixel
+	if cost := estimateMemoryCost(make([]byte, 100), input, opts); cost != int64(expected) {
+		t.Errorf("Invalid memory cost of pipeline steps: %d != %d", cost, expected)
+	}
+}
+
+func TestReplyServerBusyMemoryBudget(t *testing.T) {
+	LoadMemoryBudget(ServerOptions{MemoryBudget: 1024, Processing: ProcessingOptions{QueueTimeout: 3 * time.Second}})
+	defer LoadMemoryBudget(ServerOptions{})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/resize", nil)
+	if !replyServerBusy(w, req, ErrMemoryBudgetExceeded, ServerOptions{}) {
+		t.Fatal("The memory budget error must be replied")
+	}
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "3" {
+		t.Fatalf("Invalid response: %d %v", w.Code, w.Header())
+	}
+	if GetHealthStats().MemoryBudget == nil {
+		t.Fatal("Missing memory budget health stats")
+	}
+}
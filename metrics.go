@@ -0,0 +1,376 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MetricsContentType is the content type of the Prometheus text exposition format.
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// labelValueEscaper escapes the label values as defined by the Prometheus text format.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// defaultBuckets defines the upper bounds in seconds of the latency histograms buckets.
+var defaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metrics stores the server metrics exposed by the /metrics endpoint.
+var metrics = NewMetrics()
+
+// Metrics defines the server metrics, exposed in Prometheus text format.
+type Metrics struct {
+	inFlight        int64
+	requests        *counterVec
+	requestDuration *histogramVec
+	responseBytes   *counterVec
+	sourceBytes     *counterVec
+	sourceDuration  *histogramVec
+	sourceErrors    *counterVec
+	processDuration *histogramVec
+	throttled       *counterVec
+	queueWait       *histogramVec
+	queueRejected   *counterVec
+	spansDropped    *counterVec
+}
+
+// NewMetrics creates a new set of server metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:        newCounterVec("imaginary_http_requests_total", "Total number of HTTP requests.", "endpoint", "status"),
+		requestDuration: newHistogramVec("imaginary_http_request_duration_seconds", "HTTP request latency in seconds.", "endpoint", "status"),
+		responseBytes:   newCounterVec("imaginary_http_response_bytes_total", "Total number of HTTP response body bytes.", "endpoint"),
+		sourceBytes:     newCounterVec("imaginary_source_bytes_total", "Total number of image bytes read from the image sources.", "source"),
+		sourceDuration:  newHistogramVec("imaginary_source_fetch_duration_seconds", "Image source fetch latency in seconds.", "source"),
+		sourceErrors:    newCounterVec("imaginary_source_fetch_errors_total", "Total number of image source fetch errors.", "source"),
+		processDuration: newHistogramVec("imaginary_processing_duration_seconds", "Image processing time in seconds.", "operation"),
+		throttled:       newCounterVec("imaginary_throttled_requests_total", "Total number of requests rejected by the throttle."),
+		queueWait:       newHistogramVec("imaginary_processing_queue_wait_seconds", "Time waited in the processing queue in seconds."),
+		queueRejected:   newCounterVec("imaginary_processing_rejected_total", "Total number of requests rejected by the processing pool.", "reason"),
+		spansDropped:    newCounterVec("imaginary_tracing_spans_dropped_total", "Total number of tracing spans dropped without being exported.", "reason"),
+	}
+}
+
+// ObserveSourceFetch records an image source fetch.
+func (m *Metrics) ObserveSourceFetch(source ImageSourceType, size int, duration time.Duration, err error) {
+	m.sourceDuration.Observe(duration.Seconds(), string(source))
+	if err != nil {
+		m.sourceErrors.Inc(string(source))
+		return
+	}
+	m.sourceBytes.Add(float64(size), string(source))
+}
+
+// ObserveProcessing records the image processing time of an operation.
+func (m *Metrics) ObserveProcessing(operation string, duration time.Duration) {
+	m.processDuration.Observe(duration.Seconds(), operation)
+}
+
+// IncThrottled records a request rejected by the throttle.
+func (m *Metrics) IncThrottled() {
+	m.throttled.Inc()
+}
+
+// ObserveQueueWait records the time a request waited for a free processing worker.
+func (m *Metrics) ObserveQueueWait(duration time.Duration) {
+	m.queueWait.Observe(duration.Seconds())
+}
+
+// IncQueueRejected records a request rejected by the processing pool, either due to a full queue or a timeout.
+func (m *Metrics) IncQueueRejected(reason string) {
+	m.queueRejected.Inc(reason)
+}
+
+// AddDroppedSpans records tracing spans dropped, either due to a full export queue or an export error.
+func (m *Metrics) AddDroppedSpans(reason string, count int) {
+	m.spansDropped.Add(float64(count), reason)
+}
+
+// WriteTo writes the metrics in Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+
+	m.requests.write(&b)
+	m.requestDuration.write(&b)
+	writeMetric(&b, "imaginary_http_requests_in_flight", "gauge", "Number of HTTP requests being served.", float64(atomic.LoadInt64(&m.inFlight)))
+	m.responseBytes.write(&b)
+	m.sourceBytes.write(&b)
+	m.sourceDuration.write(&b)
+	m.sourceErrors.write(&b)
+	m.processDuration.write(&b)
+	m.throttled.write(&b)
+	m.queueWait.write(&b)
+	m.queueRejected.write(&b)
+	m.spansDropped.write(&b)
+	writeProcessingPoolMetrics(&b)
+	writeMemoryBudgetMetrics(&b)
+	writeCacheMetrics(&b)
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// writeProcessingPoolMetrics writes the usage of the processing pool, if enabled.
+func writeProcessingPoolMetrics(b *strings.Builder) {
+	if processingPool == nil {
+		return
+	}
+	stats := processingPool.Stats()
+	writeMetric(b, "imaginary_processing_workers", "gauge", "Number of processing workers.", float64(stats.Workers))
+	writeMetric(b, "imaginary_processing_workers_active", "gauge", "Number of busy processing workers.", float64(stats.Active))
+	writeMetric(b, "imaginary_processing_queue_depth", "gauge", "Number of requests waiting for a processing worker.", float64(stats.Queued))
+}
+
+// writeMemoryBudgetMetrics writes the usage of the memory budget, if enabled.
+func writeMemoryBudgetMetrics(b *strings.Builder) {
+	if memoryBudget == nil {
+		return
+	}
+	memoryBudget.mu.Lock()
+	reserved := memoryBudget.reserved
+	memoryBudget.mu.Unlock()
+	writeMetric(b, "imaginary_memory_budget_bytes", "gauge", "Memory budget in bytes.", float64(memoryBudget.limit))
+	writeMetric(b, "imaginary_memory_usage_bytes", "gauge", "Resident memory of the process in bytes.", float64(memoryBudget.usage()))
+	writeMetric(b, "imaginary_memory_reserved_bytes", "gauge", "Estimated memory of the images being processed in bytes.", float64(reserved))
+}
+
+// writeCacheMetrics writes the usage of the enabled caches of processed images.
+func writeCacheMetrics(b *strings.Builder) {
+	caches := map[string]CacheStats{}
+	if responseCache != nil {
+		caches["memory"] = responseCache.Stats()
+	}
+	if diskCache != nil {
+		caches["disk"] = diskCache.Stats()
+	}
+	if len(caches) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(caches))
+	for name := range caches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	series := []struct {
+		name, kind, help string
+		value            func(CacheStats) float64
+	}{
+		{"imaginary_cache_hits_total", "counter", "Total number of cache hits.", func(s CacheStats) float64 { return float64(s.Hits) }},
+		{"imaginary_cache_misses_total", "counter", "Total number of cache misses.", func(s CacheStats) float64 { return float64(s.Misses) }},
+		{"imaginary_cache_hit_ratio", "gauge", "Ratio of cache hits over the total cache lookups.", cacheHitRatio},
+		{"imaginary_cache_evictions_total", "counter", "Total number of cache evictions.", func(s CacheStats) float64 { return float64(s.Evictions) }},
+		{"imaginary_cache_entries", "gauge", "Number of cached images.", func(s CacheStats) float64 { return float64(s.Entries) }},
+		{"imaginary_cache_size_bytes", "gauge", "Total size of the cached images in bytes.", func(s CacheStats) float64 { return float64(s.Size) }},
+	}
+	for _, metric := range series {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+		for _, name := range names {
+			fmt.Fprintf(b, "%s{cache=\"%s\"} %s\n", metric.name, name, formatMetricValue(metric.value(caches[name])))
+		}
+	}
+}
+
+func cacheHitRatio(s CacheStats) float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// metricsController exposes the server metrics in Prometheus text format.
+func metricsController(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", MetricsContentType)
+	_, _ = metrics.WriteTo(w)
+}
+
+// instrumentHandler records the HTTP requests metrics, labeled by the matched route pattern
+// in order to keep the labels cardinality bounded.
+func instrumentHandler(mux *http.ServeMux, m *Metrics) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, endpoint := mux.Handler(r)
+		if endpoint == "" {
+			endpoint = "unknown"
+		}
+
+		atomic.AddInt64(&m.inFlight, 1)
+		defer atomic.AddInt64(&m.inFlight, -1)
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		mux.ServeHTTP(recorder, r)
+
+		status := strconv.Itoa(recorder.status)
+		m.requests.Inc(endpoint, status)
+		m.requestDuration.Observe(time.Since(start).Seconds(), endpoint, status)
+		m.responseBytes.Add(float64(recorder.bytes), endpoint)
+	})
+}
+
+// statusRecorder records the response status code and body size.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	written, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(written)
+	return written, err
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// counterVec is a counter partitioned by label values.
+type counterVec struct {
+	mutex  sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (c *counterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *counterVec) Add(delta float64, values ...string) {
+	key := formatLabels(c.labels, values)
+	c.mutex.Lock()
+	c.values[key] += delta
+	c.mutex.Unlock()
+}
+
+func (c *counterVec) write(b *strings.Builder) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(b, "%s 0\n", c.name)
+	}
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(b, "%s%s %s\n", c.name, key, formatMetricValue(c.values[key]))
+	}
+}
+
+// histogramVec is a histogram partitioned by label values.
+type histogramVec struct {
+	mutex   sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: defaultBuckets, values: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) Observe(value float64, values ...string) {
+	key := formatLabels(h.labels, values)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += value
+}
+
+func (h *histogramVec) write(b *strings.Builder) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		hist := h.values[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, withLabel(key, "le", formatMetricValue(bound)), hist.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, withLabel(key, "le", "+Inf"), hist.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", h.name, key, formatMetricValue(hist.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", h.name, key, hist.count)
+	}
+}
+
+func writeMetric(b *strings.Builder, name, kind, help string, value float64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, kind, name, formatMetricValue(value))
+}
+
+// formatLabels formats the label pairs, such as {endpoint="/resize",status="200"}.
+func formatLabels(labels, values []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(labels))
+	for i, label := range labels {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = label + "=\"" + labelValueEscaper.Replace(value) + "\""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// withLabel appends a label pair to the formatted labels.
+func withLabel(labels, name, value string) string {
+	pair := name + "=\"" + labelValueEscaper.Replace(value) + "\""
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return strings.TrimSuffix(labels, "}") + "," + pair + "}"
+}
+
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	m := NewMetrics()
+	m.ObserveSourceFetch(ImageSourceTypeHTTP, 1024, 20*time.Millisecond, nil)
+	m.ObserveSourceFetch(ImageSourceTypeHTTP, 0, time.Second, errors.New("foo"))
+	m.ObserveProcessing("resize", 200*time.Millisecond)
+	m.IncThrottled()
+
+	var b strings.Builder
+	_, _ = m.WriteTo(&b)
+	output := b.String()
+
+	expected := []string{
+		"# TYPE imaginary_source_fetch_duration_seconds histogram",
+		`imaginary_source_fetch_duration_seconds_bucket{source="http",le="0.025"} 1`,
+		`imaginary_source_fetch_duration_seconds_bucket{source="http",le="1"} 2`,
+		`imaginary_source_fetch_duration_seconds_bucket{source="http",le="+Inf"} 2`,
+		`imaginary_source_fetch_duration_seconds_count{source="http"} 2`,
+		`imaginary_source_bytes_total{source="http"} 1024`,
+		`imaginary_source_fetch_errors_total{source="http"} 1`,
+		`imaginary_processing_duration_seconds_bucket{operation="resize",le="0.1"} 0`,
+		`imaginary_processing_duration_seconds_bucket{operation="resize",le="0.25"} 1`,
+		"imaginary_throttled_requests_total 1",
+		"imaginary_http_requests_in_flight 0",
+	}
+	for _, line := range expected {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("Missing metric line: %s", line)
+		}
+	}
+}
+
+func TestFormatLabels(t *testing.T) {
+	labels := formatLabels([]string{"foo", "bar"}, []string{`a"b`, "c\\d\ne"})
+	if labels != `{foo="a\"b",bar="c\\d\ne"}` {
+		t.Fatalf("Invalid labels: %s", labels)
+	}
+	if formatLabels(nil, nil) != "" {
+		t.Fatal("Empty labels must not be formatted")
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	ts := httptest.NewServer(NewServerMux(ServerOptions{HTTPCacheTTL: -1}))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/health")
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	res.Body.Close()
+
+	res, err = http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != MetricsContentType {
+		t.Fatalf("Invalid response: %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+
+	body, _ := ioutil.ReadAll(res.Body)
+	if !strings.Contains(string(body), `imaginary_http_requests_total{endpoint="/health",status="200"}`) {
+		t.Fatalf("Missing request metrics: %s", body)
+	}
+}
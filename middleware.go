@@ -1,9 +1,6 @@
 package main
 
 import (
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/base64"
 	"fmt"
 	"net/http"
 	"strings"
@@ -11,8 +8,6 @@ import (
 
 	"github.com/h2non/bimg"
 	"github.com/rs/cors"
-	"github.com/throttled/throttled/v2"
-	"github.com/throttled/throttled/v2/store/memstore"
 )
 
 func Middleware(fn func(http.ResponseWriter, *http.Request), o ServerOptions) http.Handler {
@@ -21,20 +16,21 @@ func Middleware(fn func(http.ResponseWriter, *http.Request), o ServerOptions) ht
 	if len(o.Endpoints) > 0 {
 		next = filterEndpoint(next, o)
 	}
-	if o.Concurrency > 0 {
+	if o.Concurrency > 0 || len(o.RateLimit.Quotas) > 0 {
 		next = throttle(next, o)
 	}
 	if o.CORS {
 		next = cors.Default().Handler(next)
 	}
-	if o.APIKey != "" {
+	if o.APIKey != "" || o.APIKeys != nil || o.JWT != nil {
 		next = authorizeClient(next, o)
 	}
 	if o.HTTPCacheTTL >= 0 {
 		next = setCacheHeaders(next, o.HTTPCacheTTL)
 	}
+	next = requestTimeout(next, o)
 
-	return validate(defaultHeaders(next), o)
+	return traceSpan("middleware", validate(defaultHeaders(next), o))
 }
 
 func ImageMiddleware(o ServerOptions) func(Operation) http.Handler {
@@ -66,23 +62,11 @@ func throttleError(err error) http.Handler {
 }
 
 func throttle(next http.Handler, o ServerOptions) http.Handler {
-	store, err := memstore.New(65536)
+	limiter, err := newClientRateLimiter(o)
 	if err != nil {
 		return throttleError(err)
 	}
-
-	quota := throttled.RateQuota{MaxRate: throttled.PerSec(o.Concurrency), MaxBurst: o.Burst}
-	rateLimiter, err := throttled.NewGCRARateLimiter(store, quota)
-	if err != nil {
-		return throttleError(err)
-	}
-
-	httpRateLimiter := throttled.HTTPRateLimiter{
-		RateLimiter: rateLimiter,
-		VaryBy:      &throttled.VaryBy{Method: true},
-	}
-
-	return httpRateLimiter.RateLimit(next)
+	return limiter.Handler(next, o)
 }
 
 func validate(next http.Handler, o ServerOptions) http.Handler {
@@ -104,7 +88,7 @@ func validateImage(next http.Handler, o ServerOptions) http.Handler {
 			return
 		}
 
-		if r.Method == http.MethodGet && o.Mount == "" && !o.EnableURLSource {
+		if r.Method == http.MethodGet && o.Mount == "" && !o.EnableURLSource && !o.S3.Enabled {
 			ErrorReply(r, w, ErrGetMethodNotAllowed, o)
 			return
 		}
@@ -115,20 +99,82 @@ func validateImage(next http.Handler, o ServerOptions) http.Handler {
 
 func authorizeClient(next http.Handler, o ServerOptions) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// JWT bearer tokens are accepted as an alternative to API keys, if enabled
+		if token := bearerToken(r); o.JWT != nil && token != "" {
+			authorizeBearerToken(next, w, r, token, o)
+			return
+		}
+
 		key := r.Header.Get("API-Key")
 		if key == "" {
 			key = r.URL.Query().Get("key")
 		}
 
-		if key != o.APIKey {
+		if o.APIKey != "" && key == o.APIKey {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Enforce the scopes and limits of the keys defined in the API keys file
+		apiKey, ok := o.APIKeys.Lookup(key)
+		if !ok {
+			if o.JWT != nil {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				if o.APIKey == "" && o.APIKeys == nil {
+					ErrorReply(r, w, ErrMissingBearerToken, o)
+					return
+				}
+			}
 			ErrorReply(r, w, ErrInvalidAPIKey, o)
 			return
 		}
+		requestInfoFrom(r.Context()).APIKeyName = apiKey.Name
 
-		next.ServeHTTP(w, r)
+		authorizeScope(next, w, r, apiKey, o)
 	})
 }
 
+// authorizeBearerToken verifies the JWT bearer token of the request and enforces the scope defined by its claims.
+func authorizeBearerToken(next http.Handler, w http.ResponseWriter, r *http.Request, token string, o ServerOptions) {
+	claims, err := o.JWT.Verify(token, time.Now())
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		ErrorReply(r, w, NewError("Invalid bearer token: "+err.Error(), http.StatusUnauthorized), o)
+		return
+	}
+	requestInfoFrom(r.Context()).TokenSubject = claims.Subject
+
+	scope, err := claims.scope()
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		ErrorReply(r, w, NewError("Invalid bearer token: "+err.Error(), http.StatusUnauthorized), o)
+		return
+	}
+	authorizeScope(next, w, r, scope, o)
+}
+
+// authorizeScope enforces the endpoints and rate limit of the client scope,
+// storing it in the request context for the image source and output limits checks.
+func authorizeScope(next http.Handler, w http.ResponseWriter, r *http.Request, scope *APIKey, o ServerOptions) {
+	if !isPublicPath(r.URL.Path) && !scope.AllowsEndpoint(operationName(r)) {
+		ErrorReply(r, w, ErrAPIKeyEndpointDenied, o)
+		return
+	}
+
+	allowed, err := scope.allow(w)
+	if err != nil {
+		ErrorReply(r, w, NewError("rate limit error: "+err.Error(), http.StatusInternalServerError), o)
+		return
+	}
+	if !allowed {
+		metrics.IncThrottled()
+		ErrorReply(r, w, ErrAPIKeyRateLimited, o)
+		return
+	}
+
+	next.ServeHTTP(w, r.WithContext(withAPIKey(r.Context(), scope)))
+}
+
 func defaultHeaders(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Server", fmt.Sprintf("imaginary %s (bimg %s)", Version, bimg.Version))
@@ -160,30 +206,13 @@ func getCacheControl(ttl int) string {
 }
 
 func isPublicPath(path string) bool {
-	return path == "/" || path == "/health"
+	return path == "/" || path == "/health" || path == "/metrics"
 }
 
 func validateURLSignature(next http.Handler, o ServerOptions) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Retrieve and remove URL signature from request parameters
-		query := r.URL.Query()
-		sign := query.Get("sign")
-		query.Del("sign")
-
-		// Compute expected URL signature
-		h := hmac.New(sha256.New, []byte(o.URLSignatureKey))
-		_, _ = h.Write([]byte(r.URL.Path))
-		_, _ = h.Write([]byte(query.Encode()))
-		expectedSign := h.Sum(nil)
-
-		urlSign, err := base64.RawURLEncoding.DecodeString(sign)
-		if err != nil {
-			ErrorReply(r, w, ErrInvalidURLSignature, o)
-			return
-		}
-
-		if !hmac.Equal(urlSign, expectedSign) {
-			ErrorReply(r, w, ErrURLSignatureMismatch, o)
+		if err := checkURLSignature(r.URL.Path, r.URL.Query(), o); err != nil {
+			ErrorReply(r, w, err.(Error), o)
 			return
 		}
 
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+
+	"github.com/h2non/bimg"
+)
+
+// Supported response formats of the multi endpoint, defined by the format param.
+const (
+	MultiFormatMultipart = "multipart"
+	MultiFormatJSON      = "json"
+	MultiFormatZip       = "zip"
+)
+
+// MultiTaskResult defines the result of a task in the JSON response of the multi endpoint.
+// The body is encoded in base64, except for the info task whose details are returned as is.
+type MultiTaskResult struct {
+	Name   string          `json:"name"`
+	Mime   string          `json:"mime"`
+	Width  int             `json:"width,omitempty"`
+	Height int             `json:"height,omitempty"`
+	Bytes  int             `json:"bytes"`
+	Body   []byte          `json:"body,omitempty"`
+	Info   json.RawMessage `json:"info,omitempty"`
+}
+
+// MultiResponse defines the JSON response of the multi endpoint, with the task results in the requested order.
+type MultiResponse struct {
+	Tasks []MultiTaskResult `json:"tasks"`
+}
+
+func isMultiFormat(format string) bool {
+	switch format {
+	case "", MultiFormatMultipart, MultiFormatJSON, MultiFormatZip:
+		return true
+	}
+	return false
+}
+
+// multiFileName returns the file name of a task result, with the extension of the image type.
+func multiFileName(task MultiTask, res Image) string {
+	if res.Mime == "application/json" {
+		return task.Name + ".json"
+	}
+	if ext := GetImageExtensionFromMime(res.Mime); ext != "" {
+		return task.Name + "." + ext
+	}
+	return task.Name
+}
+
+func encodeMultipart(tasks []MultiTask, results []Image) (Image, error) {
+	out := &bytes.Buffer{}
+	mw := multipart.NewWriter(out)
+	for i, task := range tasks {
+		res := results[i]
+
+		mh := textproto.MIMEHeader{}
+		if task.OperationName == "info" {
+			mh.Set("Content-Type", "application/json")
+			mh.Set("Content-Disposition", `form-data; name="info"`)
+		} else {
+			mh.Set("Content-Type", res.Mime)
+			mh.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, task.Name, multiFileName(task, res)))
+		}
+		part, err := mw.CreatePart(mh)
+		if err != nil {
+			return Image{}, err
+		}
+		if _, err := part.Write(res.Body); err != nil {
+			return Image{}, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return Image{}, err
+	}
+
+	mt := mime.FormatMediaType("multipart/form-data", map[string]string{
+		"boundary": mw.Boundary(),
+	})
+	return Image{Body: out.Bytes(), Mime: mt}, nil
+}
+
+func encodeMultiJSON(tasks []MultiTask, results []Image) (Image, error) {
+	response := MultiResponse{Tasks: make([]MultiTaskResult, len(tasks))}
+	for i, task := range tasks {
+		res := results[i]
+		result := MultiTaskResult{Name: task.Name, Mime: res.Mime, Bytes: len(res.Body)}
+		if res.Mime == "application/json" {
+			result.Info = res.Body
+		} else {
+			result.Body = res.Body
+			if size, err := bimg.Size(res.Body); err == nil {
+				result.Width, result.Height = size.Width, size.Height
+			}
+		}
+		response.Tasks[i] = result
+	}
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		return Image{}, err
+	}
+	return Image{Body: body, Mime: "application/json"}, nil
+}
+
+func encodeMultiZip(tasks []MultiTask, results []Image) (Image, error) {
+	out := &bytes.Buffer{}
+	zw := zip.NewWriter(out)
+	for i, task := range tasks {
+		res := results[i]
+
+		// Encoded images are already compressed
+		method := zip.Store
+		if res.Mime == "application/json" {
+			method = zip.Deflate
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: multiFileName(task, res), Method: method})
+		if err != nil {
+			return Image{}, err
+		}
+		if _, err := w.Write(res.Body); err != nil {
+			return Image{}, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return Image{}, err
+	}
+	return Image{Body: out.Bytes(), Mime: "application/zip"}, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func multiTestResults() ([]MultiTask, []Image) {
+	tasks := []MultiTask{
+		{Name: "info", OperationName: "info"},
+		{Name: "small", OperationName: "resize"},
+	}
+	results := []Image{
+		{Body: []byte(`{"width":550}`), Mime: "application/json"},
+		{Body: []byte("webp data"), Mime: "image/webp"},
+	}
+	return tasks, results
+}
+
+func TestEncodeMultiJSON(t *testing.T) {
+	tasks, results := multiTestResults()
+	image, err := encodeMultiJSON(tasks, results)
+	if err != nil {
+		t.Fatalf("Cannot encode the results: %s", err)
+	}
+	if image.Mime != "application/json" {
+		t.Fatalf("Invalid MIME type: %s", image.Mime)
+	}
+
+	var response MultiResponse
+	if err := json.Unmarshal(image.Body, &response); err != nil {
+		t.Fatalf("Cannot decode the response: %s", err)
+	}
+	if len(response.Tasks) != 2 || response.Tasks[0].Name != "info" || response.Tasks[1].Name != "small" {
+		t.Fatalf("The task results must be returned in order: %s", image.Body)
+	}
+	if info := response.Tasks[0]; string(info.Info) != `{"width":550}` || info.Body != nil || info.Bytes != 13 {
+		t.Fatalf("Invalid info result: %s", image.Body)
+	}
+	if small := response.Tasks[1]; string(small.Body) != "webp data" || small.Mime != "image/webp" || small.Bytes != 9 {
+		t.Fatalf("Invalid image result: %s", image.Body)
+	}
+	if !strings.Contains(string(image.Body), `"body":"d2VicCBkYXRh"`) {
+		t.Fatalf("The image body must be encoded in base64: %s", image.Body)
+	}
+}
+
+func TestEncodeMultiZip(t *testing.T) {
+	tasks, results := multiTestResults()
+	image, err := encodeMultiZip(tasks, results)
+	if err != nil {
+		t.Fatalf("Cannot encode the results: %s", err)
+	}
+	if image.Mime != "application/zip" {
+		t.Fatalf("Invalid MIME type: %s", image.Mime)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(image.Body), int64(len(image.Body)))
+	if err != nil {
+		t.Fatalf("Cannot read the archive: %s", err)
+	}
+	expected := map[string]string{"info.json": `{"width":550}`, "small.webp": "webp data"}
+	if len(zr.File) != len(expected) {
+		t.Fatalf("Invalid number of files: %d", len(zr.File))
+	}
+	for _, file := range zr.File {
+		r, err := file.Open()
+		if err != nil {
+			t.Fatalf("Cannot open %s: %s", file.Name, err)
+		}
+		data, _ := io.ReadAll(r)
+		_ = r.Close()
+		if string(data) != expected[file.Name] {
+			t.Errorf("Invalid contents of %s: %s", file.Name, data)
+		}
+	}
+}
+
+func TestMultiInvalidTasks(t *testing.T) {
+	operations := PipelineOperations{{Name: "resize", Params: map[string]interface{}{"width": 100}}}
+	cases := []struct {
+		name  string
+		opts  ImageOptions
+		error string
+	}{
+		{"Invalid format", ImageOptions{Format: "xml", Multi: []MultiTask{{Name: "foo", OperationName: "resize"}}}, "Unsupported multi response format"},
+		{"Duplicate names", ImageOptions{Multi: []MultiTask{{Name: "foo", OperationName: "flip"}, {Name: "FOO", OperationName: "flop"}}}, "Duplicate task name"},
+		{"Duplicate non adjacent names", ImageOptions{Multi: []MultiTask{{Name: "foo", OperationName: "flip"}, {Name: "bar", OperationName: "flop"}, {Name: "foo", OperationName: "flip"}}}, "Duplicate task name"},
+		{"Operation and operations", ImageOptions{Multi: []MultiTask{{Name: "foo", OperationName: "resize", Operations: operations}}}, "both operation and operations"},
+		{"Invalid operations", ImageOptions{Multi: []MultiTask{{Name: "foo", Operations: PipelineOperations{{Name: "foo"}}}}}, "Unsupported operation name"},
+	}
+	for _, c := range cases {
+		_, err := Multi(nil, c.opts)
+		if err == nil || !strings.Contains(err.Error(), c.error) {
+			t.Errorf("%s: invalid error: %v", c.name, err)
+		}
+		if xerr, ok := err.(Error); !ok || xerr.HTTPCode() != http.StatusBadRequest {
+			t.Errorf("%s: invalid error status: %v", c.name, err)
+		}
+	}
+}
+
+func TestMultiTasksConcurrency(t *testing.T) {
+	var active, maxActive int32
+	flip := OperationsMap["flip"]
+	OperationsMap["flip"] = func(buf []byte, o ImageOptions) (Image, error) {
+		n := atomic.AddInt32(&active, 1)
+		for {
+			max := atomic.LoadInt32(&maxActive)
+			if n <= max || atomic.CompareAndSwapInt32(&maxActive, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&active, -1)
+		return Image{Body: buf, Mime: "image/jpeg"}, nil
+	}
+	defer func() { OperationsMap["flip"] = flip }()
+
+	run := func() int32 {
+		atomic.StoreInt32(&maxActive, 0)
+		var tasks []MultiTask
+		for _, name := range []string{"a", "b", "c", "d"} {
+			tasks = append(tasks, MultiTask{Name: name, OperationName: "flip"})
+		}
+		if _, err := Multi([]byte("foo"), ImageOptions{Format: MultiFormatZip, Multi: tasks}); err != nil {
+			t.Fatalf("Cannot process the tasks: %s", err)
+		}
+		return atomic.LoadInt32(&maxActive)
+	}
+
+	if maxActive := run(); maxActive < 2 {
+		t.Errorf("Tasks must run in parallel without processing pool: %d", maxActive)
+	}
+
+	LoadProcessingPool(ServerOptions{Processing: ProcessingOptions{Workers: 1}})
+	defer LoadProcessingPool(ServerOptions{})
+	if maxActive := run(); maxActive != 1 {
+		t.Errorf("Tasks must not run in parallel with the processing pool: %d", maxActive)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"strconv"
 	"strings"
 
@@ -50,6 +51,21 @@ type ImageOptions struct {
 	Colorspace    bimg.Interpretation
 	Operations    PipelineOperations
 	Multi         []MultiTask
+	Format        string
+
+	// ctx is the context of the request being processed
+	ctx context.Context
+
+	// limits are the output limits checked once the pipeline params expressions are evaluated
+	limits ImageLimits
+}
+
+// Context returns the context of the request being processed, or an empty context if unset.
+func (o ImageOptions) Context() context.Context {
+	if o.ctx == nil {
+		return context.Background()
+	}
+	return o.ctx
 }
 
 // IsDefinedField holds boolean ImageOptions fields. If true it means the field was specified in the request. This
@@ -72,9 +88,14 @@ type IsDefinedField struct {
 type PipelineOperation struct {
 	Name          string                 `json:"operation"`
 	IgnoreFailure bool                   `json:"ignore_failure"`
+	When          string                 `json:"when,omitempty"`
 	Params        map[string]interface{} `json:"params"`
 	ImageOptions  ImageOptions           `json:"-"`
 	Operation     Operation              `json:"-"`
+
+	// Parsed step condition and params expressions, evaluated against the current image
+	condition   Expression
+	expressions map[string]Expression
 }
 
 // PipelineOperations defines the expected interface for a list of operations.
@@ -85,6 +106,7 @@ type MultiTask struct {
 	Name          string                 `json:"name"`
 	OperationName string                 `json:"operation"`
 	Params        map[string]interface{} `json:"params"`
+	Operations    PipelineOperations     `json:"operations,omitempty"`
 	ImageOptions  ImageOptions           `json:"-"`
 	Operation     Operation              `json:"-"`
 }
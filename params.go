@@ -54,6 +54,7 @@ var paramTypeCoercions = map[string]Coercion{
 	"minampl":     coerceMinAmpl,
 	"operations":  coerceOperations,
 	"tasks":       coerceTasks,
+	"format":      coerceFormat,
 	"interlace":   coerceInterlace,
 	"aspectratio": coerceAspectRatio,
 	"palette":     coercePalette,
@@ -66,6 +67,10 @@ func coerceTypeInt(param interface{}) (int, error) {
 	}
 
 	if v, ok := param.(float64); ok {
+		// Reject the numbers which cannot be converted, such as the results of params expressions
+		if math.IsNaN(v) || v <= math.MinInt || v >= math.MaxInt {
+			return 0, ErrUnsupportedValue
+		}
 		return int(v), nil
 	}
 
@@ -353,6 +358,12 @@ func coerceTasks(io *ImageOptions, param interface{}) (err error) {
 	return err
 }
 
+func coerceFormat(io *ImageOptions, param interface{}) (err error) {
+	io.Format, err = coerceTypeString(param)
+	io.Format = strings.ToLower(io.Format)
+	return err
+}
+
 func coerceInterlace(io *ImageOptions, param interface{}) (err error) {
 	io.Interlace, err = coerceTypeBool(param)
 	io.IsDefinedField.Interlace = true
@@ -291,6 +291,10 @@ func TestCoerceTypeFns(t *testing.T) {
 			{Input: int(200), Expect: 200},
 			{Input: float64(200), Expect: 200},
 			{Input: false, Expect: 0, Err: ErrUnsupportedValue},
+			{Input: math.NaN(), Expect: 0, Err: ErrUnsupportedValue},
+			{Input: math.Inf(1), Expect: 0, Err: ErrUnsupportedValue},
+			{Input: float64(1e20), Expect: 0, Err: ErrUnsupportedValue},
+			{Input: float64(-1e20), Expect: 0, Err: ErrUnsupportedValue},
 		}
 
 		for _, tc := range cases {
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// processingPool bounds the number of images processed by libvips at the same time, if enabled.
+var processingPool *ProcessingPool
+
+// ProcessingOptions defines the bounded processing pool settings. Zero workers disable the bound.
+type ProcessingOptions struct {
+	Workers      int
+	Queue        int
+	QueueTimeout time.Duration
+}
+
+// ProcessingPool limits the simultaneous image processing to a fixed number of workers.
+// Requests wait for a free worker in a bounded queue, and are rejected if the queue
+// is full or no worker is freed before the queue wait timeout.
+type ProcessingPool struct {
+	workers     chan struct{}
+	maxQueue    int64
+	waitTimeout time.Duration
+
+	queued   int64
+	rejected int64
+	waited   int64
+	waitTime int64
+}
+
+// ProcessingPoolStats defines the usage of the processing pool.
+type ProcessingPoolStats struct {
+	Workers       int     `json:"workers"`
+	Active        int     `json:"active"`
+	Queued        int64   `json:"queued"`
+	MaxQueue      int64   `json:"maxQueue"`
+	Rejected      int64   `json:"rejected"`
+	AverageWaitMs float64 `json:"averageWaitMs"`
+}
+
+// LoadProcessingPool creates the bounded processing pool, if enabled.
+func LoadProcessingPool(o ServerOptions) {
+	processingPool = nil
+	if o.Processing.Workers > 0 {
+		processingPool = NewProcessingPool(o.Processing.Workers, o.Processing.Queue, o.Processing.QueueTimeout)
+	}
+}
+
+// NewProcessingPool creates a new processing pool. A zero wait timeout waits until the request is canceled.
+func NewProcessingPool(workers, maxQueue int, waitTimeout time.Duration) *ProcessingPool {
+	return &ProcessingPool{
+		workers:     make(chan struct{}, workers),
+		maxQueue:    int64(maxQueue),
+		waitTimeout: waitTimeout,
+	}
+}
+
+// Acquire waits for a free worker, returning the function to release it once the image is processed.
+func (p *ProcessingPool) Acquire(ctx context.Context) (func(), error) {
+	release := func() { <-p.workers }
+	select {
+	case p.workers <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	if atomic.AddInt64(&p.queued, 1) > p.maxQueue {
+		atomic.AddInt64(&p.queued, -1)
+		p.reject("queue_full")
+		return nil, ErrProcessingQueueFull
+	}
+	defer atomic.AddInt64(&p.queued, -1)
+
+	start := time.Now()
+	var timeout <-chan time.Time
+	if p.waitTimeout > 0 {
+		timer := time.NewTimer(p.waitTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case p.workers <- struct{}{}:
+		wait := time.Since(start)
+		atomic.AddInt64(&p.waited, 1)
+		atomic.AddInt64(&p.waitTime, int64(wait))
+		metrics.ObserveQueueWait(wait)
+		return release, nil
+	case <-timeout:
+		p.reject("timeout")
+		return nil, ErrProcessingQueueTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *ProcessingPool) reject(reason string) {
+	atomic.AddInt64(&p.rejected, 1)
+	metrics.IncQueueRejected(reason)
+}
+
+// RetryAfter returns the seconds a rejected client should wait before retrying.
+func (p *ProcessingPool) RetryAfter() int {
+	if seconds := ceilSeconds(p.waitTimeout.Seconds()); seconds > 0 {
+		return seconds
+	}
+	return 1
+}
+
+// Stats returns the current usage of the processing pool.
+func (p *ProcessingPool) Stats() ProcessingPoolStats {
+	stats := ProcessingPoolStats{
+		Workers:  cap(p.workers),
+		Active:   len(p.workers),
+		Queued:   atomic.LoadInt64(&p.queued),
+		MaxQueue: p.maxQueue,
+		Rejected: atomic.LoadInt64(&p.rejected),
+	}
+	if waited := atomic.LoadInt64(&p.waited); waited > 0 {
+		average := time.Duration(atomic.LoadInt64(&p.waitTime) / waited)
+		stats.AverageWaitMs = toFixed(float64(average)/float64(time.Millisecond), 2)
+	}
+	return stats
+}
+
+// acquireProcessingWorker waits for a free worker of the processing pool, if enabled.
+func acquireProcessingWorker(ctx context.Context) (func(), error) {
+	if processingPool == nil {
+		return func() {}, nil
+	}
+	return processingPool.Acquire(ctx)
+}
+
+// replyServerBusy replies the error with the Retry-After header if the request was rejected
+// by the processing pool or the memory budget.
+func replyServerBusy(w http.ResponseWriter, r *http.Request, err error, o ServerOptions) bool {
+	switch err {
+	case ErrProcessingQueueFull, ErrProcessingQueueTimeout:
+		w.Header().Set("Retry-After", strconv.Itoa(processingPool.RetryAfter()))
+	case ErrMemoryBudgetExceeded:
+		w.Header().Set("Retry-After", strconv.Itoa(memoryBudget.RetryAfter()))
+	case ErrImageTooLargeForMemory:
+	default:
+		return false
+	}
+	ErrorReply(r, w, err.(Error), o)
+	return true
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProcessingPool(t *testing.T) {
+	pool := NewProcessingPool(1, 1, time.Second)
+
+	release, err := pool.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Cannot acquire a free worker: %s", err)
+	}
+
+	// Wait in the queue until the worker is released
+	acquired := make(chan error)
+	go func() {
+		release, err := pool.Acquire(context.Background())
+		if err == nil {
+			release()
+		}
+		acquired <- err
+	}()
+	for pool.Stats().Queued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The queue is full
+	if _, err := pool.Acquire(context.Background()); err != ErrProcessingQueueFull {
+		t.Fatalf("Expected full queue error: %v", err)
+	}
+
+	release()
+	if err := <-acquired; err != nil {
+		t.Fatalf("Cannot acquire the released worker: %s", err)
+	}
+
+	stats := pool.Stats()
+	if stats.Workers != 1 || stats.Active != 0 || stats.Queued != 0 || stats.Rejected != 1 {
+		t.Fatalf("Invalid pool stats: %#v", stats)
+	}
+}
+
+func TestProcessingPoolTimeout(t *testing.T) {
+	pool := NewProcessingPool(1, 10, 10*time.Millisecond)
+	release, _ := pool.Acquire(context.Background())
+	defer release()
+
+	if _, err := pool.Acquire(context.Background()); err != ErrProcessingQueueTimeout {
+		t.Fatalf("Expected queue timeout error: %v", err)
+	}
+	if pool.RetryAfter() != 1 {
+		t.Fatalf("Invalid Retry-After seconds: %d", pool.RetryAfter())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := NewProcessingPool(1, 10, 0).Acquire(ctx); err != nil {
+		t.Fatal("A free worker must be acquired regardless of the context")
+	}
+	pool = NewProcessingPool(1, 10, 0)
+	_, _ = pool.Acquire(context.Background())
+	if _, err := pool.Acquire(ctx); err != context.Canceled {
+		t.Fatalf("Expected canceled context error: %v", err)
+	}
+}
+
+func TestReplyServerBusy(t *testing.T) {
+	LoadProcessingPool(ServerOptions{Processing: ProcessingOptions{Workers: 1, QueueTimeout: 5 * time.Second}})
+	defer LoadProcessingPool(ServerOptions{})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/resize", nil)
+	if !replyServerBusy(w, req, ErrProcessingQueueFull, ServerOptions{}) {
+		t.Fatal("The full queue error must be replied")
+	}
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "5" {
+		t.Fatalf("Invalid response: %d %v", w.Code, w.Header())
+	}
+	if replyServerBusy(httptest.NewRecorder(), req, ErrEmptyBody, ServerOptions{}) {
+		t.Fatal("Other errors must not be replied")
+	}
+
+	var b strings.Builder
+	_, _ = metrics.WriteTo(&b)
+	if !strings.Contains(b.String(), "imaginary_processing_workers 1\n") {
+		t.Fatal("Missing processing pool metrics")
+	}
+	if GetHealthStats().ProcessingPool == nil {
+		t.Fatal("Missing processing pool health stats")
+	}
+}
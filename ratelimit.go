@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/throttled/throttled/v2"
+	"github.com/throttled/throttled/v2/store/memstore"
+)
+
+// Rate limit key classes, identifying the clients by API key or JWT subject, IP address or a request header.
+const (
+	RateLimitByKey    = "key"
+	RateLimitByIP     = "ip"
+	RateLimitByHeader = "header:"
+
+	// rateLimitGlobal is the class of the requests not identified by any class, limited all together.
+	rateLimitGlobal = "global"
+)
+
+// RateLimitOptions defines how the throttle identifies and limits the clients.
+type RateLimitOptions struct {
+	// By lists the key classes in precedence order, such as key, ip or header:X-Client-ID.
+	// The first class identifying the client applies. If empty, all the clients share the same limit.
+	By []string
+	// Quotas defines the quota of each key class. Classes without quota use the -concurrency and -burst limit.
+	Quotas map[string]RateLimitQuota
+	// TrustedProxies lists the networks of the proxies allowed to define the client IP via X-Forwarded-For.
+	TrustedProxies []*net.IPNet
+}
+
+// RateLimitQuota defines the maximum requests per second and burst of a key class.
+type RateLimitQuota struct {
+	Rate  int
+	Burst int
+}
+
+// clientRateLimiter limits the requests of every client separately, with a rate limiter per key class.
+type clientRateLimiter struct {
+	by             []string
+	limiters       map[string]throttled.RateLimiter
+	trustedProxies []*net.IPNet
+	apiKey         string
+}
+
+func newClientRateLimiter(o ServerOptions) (*clientRateLimiter, error) {
+	l := &clientRateLimiter{
+		by:             o.RateLimit.By,
+		limiters:       map[string]throttled.RateLimiter{},
+		trustedProxies: o.RateLimit.TrustedProxies,
+		apiKey:         o.APIKey,
+	}
+
+	for _, class := range append([]string{rateLimitGlobal}, l.by...) {
+		quota, ok := o.RateLimit.Quotas[class]
+		if !ok {
+			quota = RateLimitQuota{Rate: o.Concurrency, Burst: o.Burst}
+		}
+		if quota.Rate <= 0 {
+			continue
+		}
+
+		store, err := memstore.New(65536)
+		if err != nil {
+			return nil, err
+		}
+		limiter, err := throttled.NewGCRARateLimiter(store, throttled.RateQuota{MaxRate: throttled.PerSec(quota.Rate), MaxBurst: quota.Burst})
+		if err != nil {
+			return nil, err
+		}
+		l.limiters[class] = limiter
+	}
+	return l, nil
+}
+
+// clientKey returns the key class and the key identifying the client of the request.
+func (l *clientRateLimiter) clientKey(r *http.Request) (string, string) {
+	for _, class := range l.by {
+		var id string
+		switch {
+		case class == RateLimitByKey:
+			id = l.authorizedClient(r)
+		case class == RateLimitByIP:
+			id = clientIP(r, l.trustedProxies)
+		case strings.HasPrefix(class, RateLimitByHeader):
+			id = r.Header.Get(strings.TrimPrefix(class, RateLimitByHeader))
+		}
+		if id != "" {
+			return class, id
+		}
+	}
+	return rateLimitGlobal, r.Method
+}
+
+// authorizedClient returns the name of the API key or the subject of the JWT bearer token of the request, if any.
+func (l *clientRateLimiter) authorizedClient(r *http.Request) string {
+	info := requestInfoFrom(r.Context())
+	switch {
+	case info.APIKeyName != "":
+		return "key:" + info.APIKeyName
+	case info.TokenSubject != "":
+		return "token:" + info.TokenSubject
+	case l.apiKey != "" && (r.Header.Get("API-Key") == l.apiKey || r.URL.Query().Get("key") == l.apiKey):
+		return "-key"
+	}
+	return ""
+}
+
+// Handler rate limits the requests by client, replying 429 with the Retry-After header when exceeded.
+func (l *clientRateLimiter) Handler(next http.Handler, o ServerOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		class, key := l.clientKey(r)
+		limiter, ok := l.limiters[class]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		limited, result, err := limiter.RateLimit(key, 1)
+		if err != nil {
+			ErrorReply(r, w, NewError("rate limit error: "+err.Error(), http.StatusInternalServerError), o)
+			return
+		}
+		setRateLimitHeaders(w, result, limited)
+		if limited {
+			metrics.IncThrottled()
+			ErrorReply(r, w, ErrRateLimited, o)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setRateLimitHeaders sets the RateLimit-* response headers, and Retry-After if the request was limited.
+func setRateLimitHeaders(w http.ResponseWriter, result throttled.RateLimitResult, limited bool) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.ResetAfter.Seconds())))
+	if limited {
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter.Seconds())))
+	}
+}
+
+// ceilSeconds rounds up the seconds, so clients never retry too early.
+func ceilSeconds(seconds float64) int {
+	s := int(seconds)
+	if float64(s) < seconds {
+		s++
+	}
+	return s
+}
+
+// clientIP returns the IP address of the client. The X-Forwarded-For header is only
+// honored if the request comes from a trusted proxy, skipping any other trusted proxy.
+func clientIP(r *http.Request, trustedProxies []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(net.ParseIP(host), trustedProxies) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			break
+		}
+		host = ip.String()
+		if !isTrustedProxy(ip, trustedProxies) {
+			break
+		}
+	}
+	return host
+}
+
+func isTrustedProxy(ip net.IP, trustedProxies []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRateLimitBy parses the list of rate limit key classes, such as: key,header:X-Client-ID,ip
+func parseRateLimitBy(input string) ([]string, error) {
+	var classes []string
+	for _, class := range strings.Split(input, ",") {
+		class = strings.TrimSpace(class)
+		switch {
+		case class == "":
+			continue
+		case class == RateLimitByKey || class == RateLimitByIP:
+		case strings.HasPrefix(class, RateLimitByHeader) && len(class) > len(RateLimitByHeader):
+			class = RateLimitByHeader + http.CanonicalHeaderKey(strings.TrimPrefix(class, RateLimitByHeader))
+		default:
+			return nil, fmt.Errorf("invalid rate limit key class: %s", class)
+		}
+		classes = append(classes, class)
+	}
+	return classes, nil
+}
+
+// parseRateLimitQuotas parses the quotas by key class, defined as requests per second and an optional burst,
+// such as: key=100/200,ip=10/20
+func parseRateLimitQuotas(input string, classes []string) (map[string]RateLimitQuota, error) {
+	quotas := map[string]RateLimitQuota{}
+	for _, pair := range strings.Split(input, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid rate limit quota: %s", pair)
+		}
+		class, err := parseRateLimitBy(parts[0])
+		if err != nil || len(class) != 1 || !containsString(classes, class[0]) {
+			return nil, fmt.Errorf("rate limit quota class must be defined in -rate-limit-by: %s", parts[0])
+		}
+
+		var quota RateLimitQuota
+		values := strings.SplitN(parts[1], "/", 2)
+		if quota.Rate, err = strconv.Atoi(values[0]); err != nil || quota.Rate <= 0 {
+			return nil, fmt.Errorf("invalid rate limit quota: %s", pair)
+		}
+		if len(values) == 2 {
+			if quota.Burst, err = strconv.Atoi(values[1]); err != nil || quota.Burst < 0 {
+				return nil, fmt.Errorf("invalid rate limit quota burst: %s", pair)
+			}
+		}
+		quotas[class[0]] = quota
+	}
+	return quotas, nil
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies := mustParseNetworks("10.0.0.0/8")
+
+	cases := []struct {
+		remoteAddr, forwarded, expected string
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		{"192.0.2.1:1234", "198.51.100.1", "192.0.2.1"},
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+		{"10.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		{"10.0.0.1:1234", "203.0.113.1, 198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		{"10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"10.0.0.1:1234", "foo, 198.51.100.1", "198.51.100.1"},
+		{"10.0.0.1:1234", "198.51.100.1, foo", "10.0.0.1"},
+		{"[2001:db8::1]:1234", "", "2001:db8::1"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/resize", nil)
+		req.RemoteAddr = c.remoteAddr
+		if c.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		if ip := clientIP(req, proxies); ip != c.expected {
+			t.Errorf("Invalid client IP of %s via %q: %s", c.remoteAddr, c.forwarded, ip)
+		}
+	}
+}
+
+func TestParseRateLimitOptions(t *testing.T) {
+	by, err := parseRateLimitBy("key, header:x-client-id,ip")
+	if err != nil {
+		t.Fatalf("Cannot parse the rate limit classes: %s", err)
+	}
+	if len(by) != 3 || by[1] != "header:X-Client-Id" {
+		t.Fatalf("Invalid rate limit classes: %v", by)
+	}
+
+	quotas, err := parseRateLimitQuotas("key=100/200, header:X-Client-ID=50, ip=10/20", by)
+	if err != nil {
+		t.Fatalf("Cannot parse the rate limit quotas: %s", err)
+	}
+	if quotas["key"] != (RateLimitQuota{100, 200}) || quotas["header:X-Client-Id"] != (RateLimitQuota{50, 0}) || quotas["ip"] != (RateLimitQuota{10, 20}) {
+		t.Fatalf("Invalid rate limit quotas: %v", quotas)
+	}
+
+	for _, input := range []string{"foo", "header:", "ip,cookie"} {
+		if _, err := parseRateLimitBy(input); err == nil {
+			t.Errorf("Invalid rate limit classes must be rejected: %s", input)
+		}
+	}
+	for _, input := range []string{"key", "key=0", "key=foo", "key=10/-1", "global=10", "header:X-Foo=10"} {
+		if _, err := parseRateLimitQuotas(input, by); err == nil {
+			t.Errorf("Invalid rate limit quotas must be rejected: %s", input)
+		}
+	}
+}
+
+func TestThrottleByClient(t *testing.T) {
+	o := ServerOptions{
+		Concurrency: 1,
+		Burst:       1,
+		RateLimit: RateLimitOptions{
+			By:     []string{"header:X-Client-Id", "ip"},
+			Quotas: map[string]RateLimitQuota{"header:X-Client-Id": {Rate: 1, Burst: 2}},
+		},
+	}
+	handler := throttle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), o)
+
+	request := func(remoteAddr, client string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/resize", nil)
+		req.RemoteAddr = remoteAddr
+		if client != "" {
+			req.Header.Set("X-Client-ID", client)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Burst of one request per IP address
+	if w := request("192.0.2.1:1234", ""); w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "2" {
+		t.Fatalf("Invalid response: %d %v", w.Code, w.Header())
+	}
+	if w := request("192.0.2.1:1234", ""); w.Code != http.StatusOK {
+		t.Fatalf("Invalid response status: %d", w.Code)
+	}
+	w := request("192.0.2.1:1234", "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Invalid response status: %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "1" || w.Header().Get("RateLimit-Remaining") != "0" {
+		t.Fatalf("Invalid rate limit headers: %v", w.Header())
+	}
+
+	// Other clients are not affected by the noisy one
+	if w := request("192.0.2.2:1234", ""); w.Code != http.StatusOK {
+		t.Fatalf("Invalid response status of another IP: %d", w.Code)
+	}
+	for i := 0; i < 3; i++ {
+		if w := request("192.0.2.1:1234", "batch"); w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "3" {
+			t.Fatalf("Invalid response of the client class quota: %d %v", w.Code, w.Header())
+		}
+	}
+}
+
+func TestRateLimitAuthorizedClient(t *testing.T) {
+	l := &clientRateLimiter{by: []string{RateLimitByKey}, apiKey: "master-secret-key"}
+
+	req := httptest.NewRequest(http.MethodGet, "/resize?key=master-secret-key", nil)
+	if class, key := l.clientKey(req); class != RateLimitByKey || key != "-key" {
+		t.Fatalf("Invalid client key: %s %s", class, key)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/resize", nil)
+	req = req.WithContext(withRequestInfo(req.Context(), &RequestInfo{TokenSubject: "frontend"}))
+	if class, key := l.clientKey(req); class != RateLimitByKey || key != "token:frontend" {
+		t.Fatalf("Invalid client key: %s %s", class, key)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/resize", nil)
+	if class, key := l.clientKey(req); class != rateLimitGlobal || key != http.MethodGet {
+		t.Fatalf("Unidentified clients must share the global limit: %s %s", class, key)
+	}
+}
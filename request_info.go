@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// RequestIDHeader is the request and response header carrying the request ID.
+const RequestIDHeader = "X-Request-ID"
+
+const maxRequestIDLength = 128
+
+type requestInfoKey struct{}
+
+// RequestInfo collects the details of an image request while it is being served, such as
+// the image source, the input and output images and the time spent on each stage.
+// It is only meant to be written by the goroutine serving the request.
+type RequestInfo struct {
+	ID             string
+	APIKeyName     string
+	TokenSubject   string
+	SourceType     ImageSourceType
+	Source         string
+	InputFormat    string
+	InputWidth     int
+	InputHeight    int
+	InputBytes     int
+	OutputFormat   string
+	OutputWidth    int
+	OutputHeight   int
+	OutputBytes    int
+	FetchTime      time.Duration
+	DetectTime     time.Duration
+	ParamsTime     time.Duration
+	QueueTime      time.Duration
+	ProcessingTime time.Duration
+	EncodeTime     time.Duration
+	Error          string
+}
+
+// withRequestInfo returns a copy of the context storing the given request info.
+func withRequestInfo(ctx context.Context, info *RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// requestInfoFrom returns the info of the request being served. A detached info
+// is returned if the request is not tracked, so callers never need to check it.
+func requestInfoFrom(ctx context.Context) *RequestInfo {
+	if info, ok := ctx.Value(requestInfoKey{}).(*RequestInfo); ok {
+		return info
+	}
+	return &RequestInfo{}
+}
+
+// getRequestID returns the request ID received in the X-Request-ID header, if valid, or generates a new one.
+func getRequestID(r *http.Request) string {
+	if id := r.Header.Get(RequestIDHeader); isValidRequestID(id) {
+		return id
+	}
+	return newRequestID()
+}
+
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	buf := make([]byte, 16)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// sourceLocation returns the image location requested to the given source, such as the remote URL.
+func sourceLocation(sourceType ImageSourceType, r *http.Request) string {
+	query := r.URL.Query()
+	switch sourceType {
+	case ImageSourceTypeHTTP:
+		return query.Get(URLQueryKey)
+	case ImageSourceTypeFileSystem:
+		return query.Get("file")
+	case ImageSourceTypeS3:
+		if bucket := query.Get(S3BucketQueryKey); bucket != "" {
+			return bucket + "/" + query.Get(S3ObjectQueryKey)
+		}
+		return query.Get(S3ObjectQueryKey)
+	}
+	return ""
+}
@@ -18,10 +18,17 @@ type ServerOptions struct {
 	Port               int
 	Burst              int
 	Concurrency        int
+	RateLimit          RateLimitOptions
+	Processing         ProcessingOptions
+	MemoryBudget       int64
 	HTTPCacheTTL       int
 	HTTPReadTimeout    int
 	HTTPWriteTimeout   int
 	MaxAllowedSize     int
+	MemoryCacheMaxSize int
+	CacheMaxSize       int64
+	CacheDir           string
+	CacheTTL           time.Duration
 	CORS               bool
 	Gzip               bool // deprecated
 	AuthForwarding     bool
@@ -29,9 +36,13 @@ type ServerOptions struct {
 	EnablePlaceholder  bool
 	EnableURLSignature bool
 	URLSignatureKey    string
+	URLSignatureKeys   map[string]string
+	URLSignatureParams []string
 	Address            string
 	PathPrefix         string
 	APIKey             string
+	APIKeys            *APIKeys
+	JWT                *JWTVerifier
 	Mount              string
 	CertFile           string
 	KeyFile            string
@@ -41,9 +52,17 @@ type ServerOptions struct {
 	ForwardHeaders     []string
 	PlaceholderImage   []byte
 	Endpoints          Endpoints
+	Sources            []ImageSourceType
+	DisabledSources    []ImageSourceType
+	S3                 S3Options
+	HTTPClient         HTTPClientOptions
+	Limits             ImageLimits
 	AllowedOrigins     []*url.URL
 	LogLevel           string
+	LogFormat          string
+	Tracing            TracingOptions
 	ReturnSize         bool
+	EnableServerTiming bool
 }
 
 // Endpoints represents a list of endpoint names to disable.
@@ -63,7 +82,7 @@ func (e Endpoints) IsValid(r *http.Request) bool {
 
 func Server(o ServerOptions) {
 	addr := o.Address + ":" + strconv.Itoa(o.Port)
-	handler := NewLog(NewServerMux(o), os.Stdout, o.LogLevel)
+	handler := NewLog(NewServerMux(o), os.Stdout, o.LogLevel, o.LogFormat)
 
 	server := &http.Server{
 		Addr:              addr,
@@ -90,6 +109,7 @@ func Server(o ServerOptions) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	err := server.Shutdown(ctx)
+	tracer.Shutdown(ctx)
 	cancel()
 	if err != nil {
 		log.Fatalf("Server shutdown failed:%+v", err)
@@ -113,6 +133,7 @@ func NewServerMux(o ServerOptions) http.Handler {
 
 	mux.Handle(join(o, "/"), Middleware(indexController(o), o))
 	mux.Handle(join(o, "/health"), Middleware(healthController, o))
+	mux.Handle(join(o, "/metrics"), Middleware(metricsController, o))
 
 	image := ImageMiddleware(o)
 	mux.Handle(join(o, "/resize"), image(Resize))
@@ -135,5 +156,5 @@ func NewServerMux(o ServerOptions) http.Handler {
 	mux.Handle(join(o, "/pipeline"), image(Pipeline))
 	mux.Handle(join(o, "/multi"), image(Multi))
 
-	return mux
+	return traceHandler(mux, instrumentHandler(mux, metrics))
 }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/h2non/imaginary/urlsign"
+)
+
+const signUsage = `Usage:
+  imaginary sign [options] <url>
+  imaginary verify [options] <url>
+
+The URL can be relative, such as /resize?width=300&url=http://foo/bar.jpg, or absolute.
+The URL path must include the server -path-prefix, if any.
+
+Options:
+  -key <key>         The URL signature key. Or can use the environment variable URL_SIGNATURE_KEY.
+  -keys <list>       Comma separated list of signature keys by key ID, used by verify.
+                     Or can use the environment variable URL_SIGNATURE_KEYS.
+  -kid <id>          Key ID of the key from -keys or URL_SIGNATURE_KEYS used by sign
+  -expires <value>   Expiration of the signed URL, as a duration or a Unix timestamp. E.g: 1h, 1735689600
+  -params <list>     Comma separated list of the request params covered by the signature [default: all]
+`
+
+// signCommand implements the sign subcommand, which prints the signed URL.
+func signCommand(args []string, stdout, stderr io.Writer) int {
+	fs := newSignFlagSet("sign", stderr)
+	key := fs.String("key", "", "")
+	keys := fs.String("keys", "", "")
+	kid := fs.String("kid", "", "")
+	expires := fs.String("expires", "", "")
+	params := fs.String("params", "", "")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	signature, err := getURLSignature(*key, *keys)
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "Error: invalid URL signature keys: %s\n", err)
+		return 1
+	}
+
+	o := urlsign.Options{Key: signature.Key, KeyID: *kid, Params: parseURLSignatureParams(*params)}
+	if *kid != "" {
+		if o.Key = signature.Keys[*kid]; o.Key == "" {
+			_, _ = fmt.Fprintf(stderr, "Error: key ID %s is not defined\n", *kid)
+			return 1
+		}
+	}
+	if o.Key == "" {
+		_, _ = fmt.Fprintln(stderr, "Error: URL signature key is required")
+		return 1
+	}
+	if *expires != "" {
+		if o.Expires, err = parseSignatureExpiration(*expires, time.Now()); err != nil {
+			_, _ = fmt.Fprintf(stderr, "Error: %s\n", err)
+			return 1
+		}
+	}
+
+	signed, err := urlsign.SignURL(fs.Arg(0), o)
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "Error: invalid URL: %s\n", err)
+		return 1
+	}
+	_, _ = fmt.Fprintln(stdout, signed)
+	return 0
+}
+
+// verifyCommand implements the verify subcommand, which explains why a URL fails the signature validation.
+func verifyCommand(args []string, stdout, stderr io.Writer) int {
+	fs := newSignFlagSet("verify", stderr)
+	key := fs.String("key", "", "")
+	keys := fs.String("keys", "", "")
+	params := fs.String("params", "", "")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	signature, err := getURLSignature(*key, *keys)
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "Error: invalid URL signature keys: %s\n", err)
+		return 1
+	}
+	u, err := url.Parse(fs.Arg(0))
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "Error: invalid URL: %s\n", err)
+		return 1
+	}
+
+	verifier := urlsign.Verifier{Key: signature.Key, Keys: signature.Keys, Params: parseURLSignatureParams(*params)}
+	query := u.Query()
+	err = verifier.Verify(u.Path, query, time.Now())
+	if err == nil {
+		_, _ = fmt.Fprintln(stdout, "Valid URL signature")
+		return 0
+	}
+
+	_, _ = fmt.Fprintf(stdout, "Invalid: %s\n", err)
+	explainURLSignature(stdout, err, verifier, u.Path, query)
+	return 1
+}
+
+// explainURLSignature prints the details of a failed URL signature validation.
+func explainURLSignature(w io.Writer, err error, verifier urlsign.Verifier, path string, query url.Values) {
+	switch err {
+	case urlsign.ErrInvalidSignature:
+		_, _ = fmt.Fprintf(w, "  The %s param must be a base64url encoded digest without padding, got: %q\n", urlsign.SignatureParam, query.Get(urlsign.SignatureParam))
+		return
+	case urlsign.ErrUnknownKey:
+		_, _ = fmt.Fprintf(w, "  The key ID %q defined by the %s param is not defined in -keys\n", query.Get(urlsign.KeyIDParam), urlsign.KeyIDParam)
+		return
+	case urlsign.ErrInvalidExpires:
+		_, _ = fmt.Fprintf(w, "  The %s param must be a Unix timestamp in seconds, got: %q\n", urlsign.ExpiresParam, query.Get(urlsign.ExpiresParam))
+		return
+	case urlsign.ErrExpired:
+		timestamp, _ := strconv.ParseInt(query.Get(urlsign.ExpiresParam), 10, 64)
+		expires := time.Unix(timestamp, 0)
+		_, _ = fmt.Fprintf(w, "  The URL expired at %s, %s ago\n", expires.UTC().Format(time.RFC3339), time.Since(expires).Round(time.Second))
+		return
+	}
+
+	key, _ := verifier.KeyFor(query)
+	keyName := "-key"
+	if kid := query.Get(urlsign.KeyIDParam); kid != "" {
+		keyName = "key ID " + kid
+	}
+
+	var uncovered []string
+	for name := range query {
+		if name != urlsign.SignatureParam && !urlsign.IsCovered(name, verifier.Params) {
+			uncovered = append(uncovered, name)
+		}
+	}
+	sort.Strings(uncovered)
+
+	_, _ = fmt.Fprintf(w, "  Signed path:        %s\n", path)
+	_, _ = fmt.Fprintf(w, "  Signed params:      %s\n", urlsign.CanonicalQuery(query, verifier.Params))
+	if len(uncovered) > 0 {
+		_, _ = fmt.Fprintf(w, "  Uncovered params:   %s\n", strings.Join(uncovered, ", "))
+	}
+	_, _ = fmt.Fprintf(w, "  Verified with:      %s\n", keyName)
+	_, _ = fmt.Fprintf(w, "  Received signature: %s\n", query.Get(urlsign.SignatureParam))
+	_, _ = fmt.Fprintf(w, "  Expected signature: %s\n", urlsign.Signature(key, path, query, verifier.Params))
+	_, _ = fmt.Fprintln(w, "  Make sure the URL is signed with the same key and covered params, the path includes the")
+	_, _ = fmt.Fprintln(w, "  server path prefix and the params are not modified or re-encoded after signing.")
+}
+
+// parseSignatureExpiration parses an expiration defined as a duration from now or a Unix timestamp.
+func parseSignatureExpiration(value string, now time.Time) (time.Time, error) {
+	if timestamp, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(timestamp, 0), nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return time.Time{}, fmt.Errorf("invalid expiration: %s", value)
+	}
+	return now.Add(duration), nil
+}
+
+func newSignFlagSet(name string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		_, _ = fmt.Fprint(stderr, signUsage)
+	}
+	return fs
+}
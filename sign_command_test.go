@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignCommand(t *testing.T) {
+	t.Setenv("URL_SIGNATURE_KEY", "")
+	t.Setenv("URL_SIGNATURE_KEYS", "")
+
+	var stdout, stderr bytes.Buffer
+	code := signCommand([]string{"-keys", "2024b:" + testSignatureNewKey, "-kid", "2024b", "-expires", "1h", "http://localhost:9000/resize?width=300&url=http://foo/bar.jpg"}, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("Invalid exit code: %d: %s", code, stderr.String())
+	}
+
+	signed := strings.TrimSpace(stdout.String())
+	if !strings.HasPrefix(signed, "http://localhost:9000/resize?") || !strings.Contains(signed, "kid=2024b") || !strings.Contains(signed, "expires=") {
+		t.Fatalf("Invalid signed URL: %s", signed)
+	}
+
+	stdout.Reset()
+	if code := verifyCommand([]string{"-keys", "2024b:" + testSignatureNewKey, signed}, &stdout, &stderr); code != 0 {
+		t.Fatalf("Signed URL must be valid: %s", stdout.String())
+	}
+
+	stdout.Reset()
+	if code := verifyCommand([]string{"-keys", "2024b:" + testSignatureNewKey, signed + "&height=200"}, &stdout, &stderr); code != 1 {
+		t.Fatalf("Modified URL must be invalid: %d", code)
+	}
+	explanation := stdout.String()
+	for _, line := range []string{"Invalid: URL signature mismatch", "Signed path:        /resize", "height=200", "Verified with:      key ID 2024b", "Expected signature: "} {
+		if !strings.Contains(explanation, line) {
+			t.Errorf("Missing explanation line %q: %s", line, explanation)
+		}
+	}
+}
+
+func TestSignCommandErrors(t *testing.T) {
+	t.Setenv("URL_SIGNATURE_KEY", "")
+	t.Setenv("URL_SIGNATURE_KEYS", "")
+
+	cases := [][]string{
+		{"/resize?width=300"},
+		{"-key", testSignatureKey, "-kid", "foo", "/resize?width=300"},
+		{"-key", testSignatureKey, "-expires", "foo", "/resize?width=300"},
+		{"-key", testSignatureKey},
+	}
+	for _, args := range cases {
+		var stdout, stderr bytes.Buffer
+		if code := signCommand(args, &stdout, &stderr); code == 0 || stdout.Len() > 0 {
+			t.Errorf("Sign must fail with args: %v", args)
+		}
+	}
+}
+
+func TestParseSignatureExpiration(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	if expires, _ := parseSignatureExpiration("90m", now); expires.Unix() != 1700005400 {
+		t.Fatalf("Invalid duration expiration: %d", expires.Unix())
+	}
+	if expires, _ := parseSignatureExpiration("1735689600", now); expires.Unix() != 1735689600 {
+		t.Fatalf("Invalid timestamp expiration: %d", expires.Unix())
+	}
+	if _, err := parseSignatureExpiration("-1h", now); err == nil {
+		t.Fatal("Negative durations must be rejected")
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/h2non/imaginary/urlsign"
+)
+
+// urlSignatureVerifier returns the URL signature verifier with the configured keys and covered params.
+func urlSignatureVerifier(o ServerOptions) urlsign.Verifier {
+	return urlsign.Verifier{
+		Key:    o.URLSignatureKey,
+		Keys:   o.URLSignatureKeys,
+		Params: o.URLSignatureParams,
+	}
+}
+
+// checkURLSignature verifies the signature and expiration of the URL.
+func checkURLSignature(path string, query url.Values, o ServerOptions) error {
+	switch urlSignatureVerifier(o).Verify(path, query, time.Now()) {
+	case nil:
+		return nil
+	case urlsign.ErrUnknownKey:
+		return ErrURLSignatureUnknownKey
+	case urlsign.ErrMismatch:
+		return ErrURLSignatureMismatch
+	case urlsign.ErrExpired:
+		return ErrURLSignatureExpired
+	default:
+		return ErrInvalidURLSignature
+	}
+}
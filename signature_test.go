@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/h2non/imaginary/urlsign"
+)
+
+const (
+	testSignatureKey    = "4f46feebafc4b5e988f131c4ff8b5997"
+	testSignatureNewKey = "1b8a9d6c7e2f4a30b5c6d7e8f9a0b1c2"
+)
+
+func signTestURL(key, path string, query url.Values, params []string) string {
+	return urlsign.Sign(path, query, urlsign.Options{Key: key, Params: params})
+}
+
+func TestValidateURLSignature(t *testing.T) {
+	o := ServerOptions{
+		URLSignatureKey:  testSignatureKey,
+		URLSignatureKeys: map[string]string{"2024b": testSignatureNewKey},
+	}
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	cases := []struct {
+		name   string
+		url    string
+		params []string
+		status int
+	}{
+		{"valid", signTestURL(testSignatureKey, "/resize", url.Values{"width": {"300"}}, nil), nil, http.StatusOK},
+		{"valid key ID", signTestURL(testSignatureNewKey, "/resize", url.Values{"width": {"300"}, "kid": {"2024b"}}, nil), nil, http.StatusOK},
+		{"valid expiration", signTestURL(testSignatureKey, "/resize", url.Values{"width": {"300"}, "expires": {future}}, nil), nil, http.StatusOK},
+		{"expired", signTestURL(testSignatureKey, "/resize", url.Values{"width": {"300"}, "expires": {past}}, nil), nil, http.StatusForbidden},
+		{"invalid expiration", signTestURL(testSignatureKey, "/resize", url.Values{"width": {"300"}, "expires": {"foo"}}, nil), nil, http.StatusBadRequest},
+		{"unknown key ID", signTestURL(testSignatureNewKey, "/resize", url.Values{"width": {"300"}, "kid": {"2024c"}}, nil), nil, http.StatusForbidden},
+		{"wrong key", signTestURL(testSignatureNewKey, "/resize", url.Values{"width": {"300"}}, nil), nil, http.StatusForbidden},
+		{"tampered path", "/crop" + signTestURL(testSignatureKey, "/resize", url.Values{"width": {"300"}}, nil)[len("/resize"):], nil, http.StatusForbidden},
+		{"tampered param", signTestURL(testSignatureKey, "/resize", url.Values{"width": {"300"}}, nil) + "&height=300", nil, http.StatusForbidden},
+		{"tampered expiration", signTestURL(testSignatureKey, "/resize", url.Values{"width": {"300"}, "expires": {past}}, nil) + "&expires=" + future, nil, http.StatusForbidden},
+		{"invalid signature", "/resize?width=300&sign=!!!", nil, http.StatusBadRequest},
+		{"missing signature", "/resize?width=300", nil, http.StatusForbidden},
+		{"uncovered param", signTestURL(testSignatureKey, "/resize", url.Values{"width": {"300"}}, []string{"width"}) + "&foo=bar", []string{"width"}, http.StatusOK},
+		{"covered param", signTestURL(testSignatureKey, "/resize", url.Values{"width": {"300"}}, []string{"width"}) + "&width=400", []string{"width"}, http.StatusForbidden},
+		{"covered expiration", signTestURL(testSignatureKey, "/resize", url.Values{"width": {"300"}, "expires": {past}}, []string{"width"}) + "&expires=" + future, []string{"width"}, http.StatusForbidden},
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, c := range cases {
+		o.URLSignatureParams = c.params
+		w := httptest.NewRecorder()
+		validateURLSignature(next, o).ServeHTTP(w, httptest.NewRequest(http.MethodGet, c.url, nil))
+		if w.Code != c.status {
+			t.Errorf("%s: invalid response status: %d", c.name, w.Code)
+		}
+	}
+}
+
+func TestParseURLSignatureKeys(t *testing.T) {
+	keys, err := parseURLSignatureKeys("old:" + testSignatureKey + ", new:" + testSignatureNewKey)
+	if err != nil {
+		t.Fatalf("Cannot parse the keys: %s", err)
+	}
+	if len(keys) != 2 || keys["old"] != testSignatureKey || keys["new"] != testSignatureNewKey {
+		t.Fatalf("Invalid keys: %v", keys)
+	}
+
+	// The invalid pairs must not be disclosed, since they may be a key
+	_, err = parseURLSignatureKeys("old:" + testSignatureKey + "," + testSignatureNewKey)
+	if err == nil || strings.Contains(err.Error(), testSignatureNewKey) || !strings.Contains(err.Error(), "position 2") {
+		t.Fatalf("Invalid error: %v", err)
+	}
+
+	if _, err = parseURLSignatureKeys("old:" + testSignatureKey + ",old:" + testSignatureNewKey); err == nil {
+		t.Fatal("Duplicate key IDs must be rejected")
+	}
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sort"
+	"time"
 )
 
 type ImageSourceType string
@@ -10,45 +15,182 @@ type ImageSourceFactoryFunction func(*SourceConfig) ImageSource
 
 type SourceConfig struct {
 	AuthForwarding bool
+	// BearerAuth is true when the incoming Authorization header authenticates the client
+	// with a JWT bearer token, so it must not be forwarded to the image origin servers.
+	BearerAuth     bool
 	Authorization  string
 	MountPath      string
 	Type           ImageSourceType
 	ForwardHeaders []string
 	AllowedOrigins []*url.URL
 	MaxAllowedSize int
+	S3             S3Options
+	HTTPClient     *HTTPClient
 }
 
+// ImageSourceHeader is the response header exposing which image source served the request.
+const ImageSourceHeader = "Image-Source"
+
 var imageSourceMap = make(map[ImageSourceType]ImageSource)
 var imageSourceFactoryMap = make(map[ImageSourceType]ImageSourceFactoryFunction)
 
+// imageSourceOrder stores the enabled image sources in precedence order.
+var imageSourceOrder []ImageSourceType
+
+// defaultSourceOrder defines the precedence of the built-in image sources when
+// no explicit order is configured. Any other registered source is appended
+// afterwards in alphabetical order.
+var defaultSourceOrder = []ImageSourceType{
+	ImageSourceTypeFileSystem,
+	ImageSourceTypeHTTP,
+	ImageSourceTypeBody,
+}
+
 type ImageSource interface {
 	Matches(*http.Request) bool
-	GetImage(*http.Request) ([]byte, error)
+	GetImage(context.Context, *http.Request) ([]byte, error)
+}
+
+// ImageSourceMetadata describes the source image of a request.
+type ImageSourceMetadata struct {
+	// LastModified is the source image modification time, if known.
+	LastModified time.Time
+}
+
+// ImageMetadataSource is implemented by image sources able to provide
+// the metadata of the source image, such as its modification time.
+type ImageMetadataSource interface {
+	GetImageWithMetadata(context.Context, *http.Request) ([]byte, ImageSourceMetadata, error)
 }
 
 func RegisterSource(sourceType ImageSourceType, factory ImageSourceFactoryFunction) {
 	imageSourceFactoryMap[sourceType] = factory
 }
 
+// IsSourceRegistered returns true if an image source factory has been registered with the given name.
+func IsSourceRegistered(sourceType ImageSourceType) bool {
+	_, ok := imageSourceFactoryMap[sourceType]
+	return ok
+}
+
 func LoadSources(o ServerOptions) {
-	for name, factory := range imageSourceFactoryMap {
-		imageSourceMap[name] = factory(&SourceConfig{
+	imageSourceMap = make(map[ImageSourceType]ImageSource)
+	imageSourceOrder = nil
+	client := NewHTTPClient(o.HTTPClient)
+	defaultHTTPClient = client
+
+	for _, name := range sourceOrder(o.Sources, o.DisabledSources) {
+		client := client
+		if name == ImageSourceTypeS3 {
+			client = s3HTTPClient(o, client)
+		}
+		imageSourceMap[name] = imageSourceFactoryMap[name](&SourceConfig{
 			Type:           name,
 			MountPath:      o.Mount,
 			AuthForwarding: o.AuthForwarding,
+			BearerAuth:     o.JWT != nil,
 			Authorization:  o.Authorization,
 			AllowedOrigins: o.AllowedOrigins,
 			MaxAllowedSize: o.MaxAllowedSize,
 			ForwardHeaders: o.ForwardHeaders,
+			S3:             o.S3,
+			HTTPClient:     client,
 		})
+		imageSourceOrder = append(imageSourceOrder, name)
+	}
+}
+
+// sourceOrder resolves the list of enabled image sources in precedence order.
+// If no explicit order is given, the default order is used followed by any
+// other registered source sorted by name. Unregistered or disabled sources are skipped.
+func sourceOrder(order, disabled []ImageSourceType) []ImageSourceType {
+	if len(order) == 0 {
+		order = append(order, defaultSourceOrder...)
+
+		var extra []string
+		for name := range imageSourceFactoryMap {
+			if !containsSourceType(order, name) {
+				extra = append(extra, string(name))
+			}
+		}
+		sort.Strings(extra)
+		for _, name := range extra {
+			order = append(order, ImageSourceType(name))
+		}
+	}
+
+	var sources []ImageSourceType
+	for _, name := range order {
+		if !IsSourceRegistered(name) || containsSourceType(disabled, name) || containsSourceType(sources, name) {
+			continue
+		}
+		sources = append(sources, name)
 	}
+	return sources
 }
 
+// Client returns the HTTP client used to fetch remote images.
+// Falls back to the client shared by any other outbound fetch, such as watermark images.
+func (c *SourceConfig) Client() *HTTPClient {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return defaultHTTPClient
+}
+
+// readWithLimit reads the whole stream, failing as soon as more than maxSize bytes are read.
+// A zero or negative maxSize disables the limit.
+func readWithLimit(r io.Reader, maxSize int) ([]byte, error) {
+	if maxSize <= 0 {
+		return ioutil.ReadAll(r)
+	}
+
+	buf, err := ioutil.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) > maxSize {
+		return nil, ErrMaxAllowedSize
+	}
+	return buf, nil
+}
+
+// exceedsMaxSize returns true if a known content length exceeds the maximum allowed size.
+func exceedsMaxSize(length int64, maxSize int) bool {
+	return maxSize > 0 && length > int64(maxSize)
+}
+
+func containsSourceType(list []ImageSourceType, name ImageSourceType) bool {
+	for _, item := range list {
+		if item == name {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchSource returns the first enabled image source, in precedence order, matching the given request.
 func MatchSource(req *http.Request) ImageSource {
-	for _, source := range imageSourceMap {
+	_, source := matchSource(req)
+	return source
+}
+
+func matchSource(req *http.Request) (ImageSourceType, ImageSource) {
+	for _, name := range imageSourceOrder {
+		source := imageSourceMap[name]
 		if source.Matches(req) {
-			return source
+			return name, source
 		}
 	}
-	return nil
+	return "", nil
+}
+
+// getImageWithMetadata reads the source image and its metadata, if supported by the source.
+// The read is aborted once the context is done, such as when the client disconnects.
+func getImageWithMetadata(ctx context.Context, source ImageSource, req *http.Request) ([]byte, ImageSourceMetadata, error) {
+	if metadataSource, ok := source.(ImageMetadataSource); ok {
+		return metadataSource.GetImageWithMetadata(ctx, req)
+	}
+	buf, err := source.GetImage(ctx, req)
+	return buf, ImageSourceMetadata{}, err
 }
@@ -1,13 +1,13 @@
 package main
 
 import (
-	"io/ioutil"
+	"context"
+	"io"
 	"net/http"
 	"strings"
 )
 
 const formFieldName = "file"
-const maxMemory int64 = 1024 * 1024 * 64
 
 const ImageSourceTypeBody ImageSourceType = "payload"
 
@@ -23,39 +23,54 @@ func (s *BodyImageSource) Matches(r *http.Request) bool {
 	return r.Method == http.MethodPost || r.Method == http.MethodPut
 }
 
-func (s *BodyImageSource) GetImage(r *http.Request) ([]byte, error) {
+func (s *BodyImageSource) GetImage(ctx context.Context, r *http.Request) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	if isFormBody(r) {
-		return readFormBody(r)
+		return readFormBody(r, s.Config.MaxAllowedSize)
 	}
-	return readRawBody(r)
+	return readRawBody(r, s.Config.MaxAllowedSize)
 }
 
 func isFormBody(r *http.Request) bool {
 	return strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/")
 }
 
-func readFormBody(r *http.Request) ([]byte, error) {
-	err := r.ParseMultipartForm(maxMemory)
+// readFormBody streams the multipart body until the file field is found,
+// so the image is never fully buffered before the size limit is checked.
+func readFormBody(r *http.Request, maxSize int) ([]byte, error) {
+	reader, err := r.MultipartReader()
 	if err != nil {
 		return nil, err
 	}
 
-	file, _, err := r.FormFile(formFieldName)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, http.ErrMissingFile
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() != formFieldName {
+			continue
+		}
 
-	buf, err := ioutil.ReadAll(file)
-	if len(buf) == 0 {
-		err = ErrEmptyBody
+		buf, err := readWithLimit(part, maxSize)
+		_ = part.Close()
+		if err == nil && len(buf) == 0 {
+			err = ErrEmptyBody
+		}
+		return buf, err
 	}
-
-	return buf, err
 }
 
-func readRawBody(r *http.Request) ([]byte, error) {
-	return ioutil.ReadAll(r.Body)
+func readRawBody(r *http.Request, maxSize int) ([]byte, error) {
+	if exceedsMaxSize(r.ContentLength, maxSize) {
+		return nil, ErrMaxAllowedSize
+	}
+	return readWithLimit(r.Body, maxSize)
 }
 
 func init() {
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"io"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -31,7 +34,7 @@ func TestBodyImageSource(t *testing.T) {
 			t.Fatal("Cannot match the request")
 		}
 
-		body, err = source.GetImage(r)
+		body, err = source.GetImage(r.Context(), r)
 		if err != nil {
 			t.Fatalf("Error while reading the body: %s", err)
 		}
@@ -59,7 +62,7 @@ func testReadBody(t *testing.T) {
 			t.Fatal("Cannot match the request")
 		}
 
-		body, err = source.GetImage(r)
+		body, err = source.GetImage(r.Context(), r)
 		if err != nil {
 			t.Fatalf("Error while reading the body: %s", err)
 		}
@@ -76,3 +79,49 @@ func testReadBody(t *testing.T) {
 		t.Error("Invalid response body")
 	}
 }
+
+func TestBodyImageSourceMaxAllowedSize(t *testing.T) {
+	buf, _ := ioutil.ReadFile(fixture1024Bytes)
+	source := NewBodyImageSource(&SourceConfig{MaxAllowedSize: 1023})
+
+	r, _ := http.NewRequest(http.MethodPost, "http://foo/bar", bytes.NewReader(buf))
+	r.ContentLength = -1 // Unknown length enforces the limit while streaming
+	if _, err := source.GetImage(r.Context(), r); err != ErrMaxAllowedSize {
+		t.Fatalf("Expected maximum allowed size error: %v", err)
+	}
+
+	body, contentType := multipartBody(t, buf)
+	r, _ = http.NewRequest(http.MethodPost, "http://foo/bar", body)
+	r.Header.Set("Content-Type", contentType)
+	if _, err := source.GetImage(r.Context(), r); err != ErrMaxAllowedSize {
+		t.Fatalf("Expected maximum allowed size error: %v", err)
+	}
+
+	source = NewBodyImageSource(&SourceConfig{MaxAllowedSize: 1024})
+	body, contentType = multipartBody(t, buf)
+	r, _ = http.NewRequest(http.MethodPost, "http://foo/bar", body)
+	r.Header.Set("Content-Type", contentType)
+	image, err := source.GetImage(r.Context(), r)
+	if err != nil {
+		t.Fatalf("Error while reading the body: %s", err)
+	}
+	if len(image) != len(buf) {
+		t.Error("Invalid response body")
+	}
+}
+
+func multipartBody(t *testing.T, buf []byte) (io.Reader, string) {
+	t.Helper()
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	_ = mw.WriteField("foo", "bar")
+	part, err := mw.CreateFormFile(formFieldName, "image.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = part.Write(buf)
+	_ = mw.Close()
+
+	return body, mw.FormDataContentType()
+}
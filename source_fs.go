@@ -1,8 +1,9 @@
 package main
 
 import (
-	"io/ioutil"
+	"context"
 	"net/http"
+	"os"
 	"path"
 	"strings"
 )
@@ -21,15 +22,25 @@ func (s *FileSystemImageSource) Matches(r *http.Request) bool {
 	return r.Method == http.MethodGet && s.getFileParam(r) != ""
 }
 
-func (s *FileSystemImageSource) GetImage(r *http.Request) ([]byte, error) {
+func (s *FileSystemImageSource) GetImage(ctx context.Context, r *http.Request) ([]byte, error) {
+	buf, _, err := s.GetImageWithMetadata(ctx, r)
+	return buf, err
+}
+
+// GetImageWithMetadata reads the image file, exposing its modification time.
+func (s *FileSystemImageSource) GetImageWithMetadata(ctx context.Context, r *http.Request) ([]byte, ImageSourceMetadata, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, ImageSourceMetadata{}, err
+	}
+
 	file := s.getFileParam(r)
 	if file == "" {
-		return nil, ErrMissingParamFile
+		return nil, ImageSourceMetadata{}, ErrMissingParamFile
 	}
 
 	file, err := s.buildPath(file)
 	if err != nil {
-		return nil, err
+		return nil, ImageSourceMetadata{}, err
 	}
 
 	return s.read(file)
@@ -43,12 +54,29 @@ func (s *FileSystemImageSource) buildPath(file string) (string, error) {
 	return file, nil
 }
 
-func (s *FileSystemImageSource) read(file string) ([]byte, error) {
-	buf, err := ioutil.ReadFile(file)
+func (s *FileSystemImageSource) read(file string) ([]byte, ImageSourceMetadata, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, ImageSourceMetadata{}, ErrInvalidFilePath
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil || stat.IsDir() {
+		return nil, ImageSourceMetadata{}, ErrInvalidFilePath
+	}
+	if exceedsMaxSize(stat.Size(), s.Config.MaxAllowedSize) {
+		return nil, ImageSourceMetadata{}, ErrMaxAllowedSize
+	}
+
+	buf, err := readWithLimit(f, s.Config.MaxAllowedSize)
+	if err == ErrMaxAllowedSize {
+		return nil, ImageSourceMetadata{}, err
+	}
 	if err != nil {
-		return nil, ErrInvalidFilePath
+		return nil, ImageSourceMetadata{}, ErrInvalidFilePath
 	}
-	return buf, nil
+	return buf, ImageSourceMetadata{LastModified: stat.ModTime()}, nil
 }
 
 func (s *FileSystemImageSource) getFileParam(r *http.Request) string {
@@ -19,7 +19,7 @@ func TestFileSystemImageSource(t *testing.T) {
 			t.Fatal("Cannot match the request")
 		}
 
-		body, err = source.GetImage(r)
+		body, err = source.GetImage(r.Context(), r)
 		if err != nil {
 			t.Fatalf("Error while reading the body: %s", err)
 		}
@@ -36,3 +36,27 @@ func TestFileSystemImageSource(t *testing.T) {
 		t.Error("Invalid response body")
 	}
 }
+
+func TestFileSystemImageSourceMaxAllowedSize(t *testing.T) {
+	source := NewFileSystemImageSource(&SourceConfig{MountPath: "testdata", MaxAllowedSize: 1023})
+
+	r, _ := http.NewRequest(http.MethodGet, "http://foo/bar?file=1024bytes", nil)
+	if _, err := source.GetImage(r.Context(), r); err != ErrMaxAllowedSize {
+		t.Fatalf("Expected maximum allowed size error: %v", err)
+	}
+}
+
+func TestFileSystemImageSourceLastModified(t *testing.T) {
+	source := NewFileSystemImageSource(&SourceConfig{MountPath: "testdata"})
+
+	r, _ := http.NewRequest(http.MethodGet, "http://foo/bar?file=large.jpg", nil)
+	_, meta, err := source.(ImageMetadataSource).GetImageWithMetadata(r.Context(), r)
+	if err != nil {
+		t.Fatalf("Error while reading the image: %s", err)
+	}
+
+	stat, _ := os.Stat("testdata/large.jpg")
+	if !meta.LastModified.Equal(stat.ModTime()) {
+		t.Fatalf("Invalid last modified time: %s", meta.LastModified)
+	}
+}
@@ -1,12 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"net/url"
-	"strconv"
 	"strings"
+	"time"
 )
 
 const ImageSourceTypeHTTP ImageSourceType = "http"
@@ -24,53 +24,72 @@ func (s *HTTPImageSource) Matches(r *http.Request) bool {
 	return r.Method == http.MethodGet && r.URL.Query().Get(URLQueryKey) != ""
 }
 
-func (s *HTTPImageSource) GetImage(req *http.Request) ([]byte, error) {
+func (s *HTTPImageSource) GetImage(ctx context.Context, req *http.Request) ([]byte, error) {
+	buf, _, err := s.GetImageWithMetadata(ctx, req)
+	return buf, err
+}
+
+// GetImageWithMetadata fetches the remote image, exposing the origin Last-Modified header.
+func (s *HTTPImageSource) GetImageWithMetadata(ctx context.Context, req *http.Request) ([]byte, ImageSourceMetadata, error) {
 	u, err := parseURL(req)
 	if err != nil {
-		return nil, ErrInvalidImageURL
+		return nil, ImageSourceMetadata{}, ErrInvalidImageURL
+	}
+	if err := checkURLScheme(u); err != nil {
+		return nil, ImageSourceMetadata{}, err
 	}
 	if shouldRestrictOrigin(u, s.Config.AllowedOrigins) {
-		return nil, fmt.Errorf("not allowed remote URL origin: %s%s", u.Host, u.Path)
+		return nil, ImageSourceMetadata{}, fmt.Errorf("not allowed remote URL origin: %s%s", u.Host, u.Path)
 	}
-	return s.fetchImage(u, req)
+	if err := authorizeOrigin(ctx, u); err != nil {
+		return nil, ImageSourceMetadata{}, err
+	}
+	return s.fetchImage(ctx, u, req)
 }
 
-func (s *HTTPImageSource) fetchImage(url *url.URL, ireq *http.Request) ([]byte, error) {
-	// Check remote image size by fetching HTTP Headers
-	if s.Config.MaxAllowedSize > 0 {
-		req := newHTTPRequest(s, ireq, http.MethodHead, url)
-		res, err := http.DefaultClient.Do(req)
-		if err != nil {
-			return nil, fmt.Errorf("error fetching remote http image headers: %v", err)
-		}
-		_ = res.Body.Close()
-		if res.StatusCode < 200 || res.StatusCode > 206 {
-			return nil, NewError(fmt.Sprintf("error fetching remote http image headers: (status=%d) (url=%s)", res.StatusCode, req.URL.String()), res.StatusCode)
-		}
+// remoteImage is the result of a remote image fetch, shared by coalesced fetches.
+type remoteImage struct {
+	buf          []byte
+	lastModified time.Time
+}
 
-		contentLength, _ := strconv.Atoi(res.Header.Get("Content-Length"))
-		if contentLength > s.Config.MaxAllowedSize {
-			return nil, fmt.Errorf("Content-Length %d exceeds maximum allowed %d bytes", contentLength, s.Config.MaxAllowedSize)
-		}
+func (s *HTTPImageSource) fetchImage(ctx context.Context, url *url.URL, ireq *http.Request) ([]byte, ImageSourceMetadata, error) {
+	// Share a single download between concurrent identical requests,
+	// which is only aborted once every request waiting for it is done
+	req := newHTTPRequest(s, ireq, http.MethodGet, url)
+	image, err, _ := fetchFlight.DoContext(ctx, flightRequestKey(req), func(ctx context.Context) (interface{}, error) {
+		return s.doFetchImage(req.WithContext(ctx))
+	})
+	if err != nil {
+		return nil, ImageSourceMetadata{}, err
 	}
+	return image.(remoteImage).buf, ImageSourceMetadata{LastModified: image.(remoteImage).lastModified}, nil
+}
 
-	// Perform the request using the default client
-	req := newHTTPRequest(s, ireq, http.MethodGet, url)
-	res, err := http.DefaultClient.Do(req)
+func (s *HTTPImageSource) doFetchImage(req *http.Request) (remoteImage, error) {
+	// Perform the request using the source client
+	res, err := s.Config.Client().Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("error fetching remote http image: %v", err)
+		return remoteImage{}, NewOriginError("fetching remote http image", err)
 	}
 	defer res.Body.Close()
 	if res.StatusCode != 200 {
-		return nil, NewError(fmt.Sprintf("error fetching remote http image: (status=%d) (url=%s)", res.StatusCode, req.URL.String()), res.StatusCode)
+		return remoteImage{}, NewError(fmt.Sprintf("error fetching remote http image: (status=%d) (url=%s)", res.StatusCode, req.URL.String()), originStatusCode(res.StatusCode))
+	}
+
+	// Fail fast if the announced length exceeds the limit, which is enforced while reading anyway
+	if exceedsMaxSize(res.ContentLength, s.Config.MaxAllowedSize) {
+		return remoteImage{}, ErrMaxAllowedSize
 	}
 
 	// Read the body
-	buf, err := ioutil.ReadAll(res.Body)
+	buf, err := readWithLimit(res.Body, s.Config.MaxAllowedSize)
 	if err != nil {
-		return nil, fmt.Errorf("unable to create image from response body: %s (url=%s)", req.URL.String(), err)
+		return remoteImage{}, NewOriginError(fmt.Sprintf("reading remote http image body (url=%s)", req.URL.String()), err)
 	}
-	return buf, nil
+
+	lastModified, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	return remoteImage{buf, lastModified}, nil
 }
 
 func (s *HTTPImageSource) setAuthorizationHeader(req *http.Request, ireq *http.Request) {
@@ -78,7 +97,7 @@ func (s *HTTPImageSource) setAuthorizationHeader(req *http.Request, ireq *http.R
 	if auth == "" {
 		auth = ireq.Header.Get("X-Forward-Authorization")
 	}
-	if auth == "" {
+	if auth == "" && !s.Config.BearerAuth {
 		auth = ireq.Header.Get("Authorization")
 	}
 	if auth != "" {
@@ -113,6 +132,9 @@ func newHTTPRequest(s *HTTPImageSource, ireq *http.Request, method string, url *
 		s.setAuthorizationHeader(req, ireq)
 	}
 
+	// Propagate the trace context to the origin server
+	injectTraceContext(ireq.Context(), req)
+
 	return req
 }
 
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 const fixtureImage = "testdata/large.jpg"
@@ -27,7 +31,7 @@ func TestHttpImageSource(t *testing.T) {
 			t.Fatal("Cannot match the request")
 		}
 
-		body, err = source.GetImage(r)
+		body, err = source.GetImage(r.Context(), r)
 		if err != nil {
 			t.Fatalf("Error while reading the body: %s", err)
 		}
@@ -59,7 +63,7 @@ func TestHttpImageSourceAllowedOrigin(t *testing.T) {
 			t.Fatal("Cannot match the request")
 		}
 
-		body, err := source.GetImage(r)
+		body, err := source.GetImage(r.Context(), r)
 		if err != nil {
 			t.Fatalf("Error while reading the body: %s", err)
 		}
@@ -85,7 +89,7 @@ func TestHttpImageSourceNotAllowedOrigin(t *testing.T) {
 			t.Fatal("Cannot match the request")
 		}
 
-		_, err := source.GetImage(r)
+		_, err := source.GetImage(r.Context(), r)
 		if err == nil {
 			t.Fatal("Error cannot be empty")
 		}
@@ -124,6 +128,24 @@ func TestHttpImageSourceForwardAuthHeader(t *testing.T) {
 	}
 }
 
+func TestHttpImageSourceForwardAuthHeaderWithBearerAuth(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodGet, "http://foo/bar?url=http://bar.com", nil)
+	r.Header.Set("Authorization", "Bearer client-token")
+
+	source := &HTTPImageSource{&SourceConfig{AuthForwarding: true, BearerAuth: true}}
+	oreq := &http.Request{Header: make(http.Header)}
+	source.setAuthorizationHeader(oreq, r)
+	if oreq.Header.Get("Authorization") != "" {
+		t.Fatal("The client bearer token must not be forwarded")
+	}
+
+	r.Header.Set("X-Forward-Authorization", "foobar")
+	source.setAuthorizationHeader(oreq, r)
+	if oreq.Header.Get("Authorization") != "foobar" {
+		t.Fatal("Missmatch Authorization header")
+	}
+}
+
 func TestHttpImageSourceForwardHeaders(t *testing.T) {
 	cases := []string{
 		"X-Custom",
@@ -256,7 +278,7 @@ func TestHttpImageSourceError(t *testing.T) {
 			t.Fatal("Cannot match the request")
 		}
 
-		_, err = source.GetImage(r)
+		_, err = source.GetImage(r.Context(), r)
 		if err == nil {
 			t.Fatalf("Server response should not be valid: %s", err)
 		}
@@ -285,7 +307,7 @@ func TestHttpImageSourceExceedsMaximumAllowedLength(t *testing.T) {
 			t.Fatal("Cannot match the request")
 		}
 
-		body, err = source.GetImage(r)
+		body, err = source.GetImage(r.Context(), r)
 		if err == nil {
 			t.Fatalf("It should not allow a request to image exceeding maximum allowed size: %s", err)
 		}
@@ -297,6 +319,27 @@ func TestHttpImageSourceExceedsMaximumAllowedLength(t *testing.T) {
 	fakeHandler(w, r)
 }
 
+func TestHttpImageSourceExceedsMaximumAllowedLengthWhileStreaming(t *testing.T) {
+	buf, _ := ioutil.ReadFile(fixture1024Bytes)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Errorf("Unexpected request method: %s", r.Method)
+		}
+		// Flushing forces a chunked response without Content-Length
+		_, _ = w.Write(buf[:512])
+		w.(http.Flusher).Flush()
+		_, _ = w.Write(buf[512:])
+	}))
+	defer ts.Close()
+
+	source := NewHTTPImageSource(&SourceConfig{MaxAllowedSize: 1023})
+	r, _ := http.NewRequest(http.MethodGet, "http://foo/bar?url="+ts.URL, nil)
+	_, err := source.GetImage(r.Context(), r)
+	if err != ErrMaxAllowedSize {
+		t.Fatalf("Expected maximum allowed size error: %v", err)
+	}
+}
+
 func TestShouldRestrictOrigin(t *testing.T) {
 	plainOrigins := parseOrigins(
 		"https://example.org",
@@ -483,3 +526,78 @@ func createURL(urlStr string, t *testing.T) *url.URL {
 
 	return result
 }
+
+func TestHttpImageSourceCoalescesFetches(t *testing.T) {
+	var requests int32
+	buf, _ := ioutil.ReadFile(fixtureImage)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(100 * time.Millisecond)
+		_, _ = w.Write(buf)
+	}))
+	defer ts.Close()
+
+	source := NewHTTPImageSource(&SourceConfig{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, _ := http.NewRequest(http.MethodGet, "http://foo/bar?url="+ts.URL, nil)
+			body, err := source.GetImage(r.Context(), r)
+			if err != nil || len(body) != len(buf) {
+				t.Errorf("Invalid response body: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if requests != 1 {
+		t.Fatalf("Concurrent fetches must be coalesced, got %d requests", requests)
+	}
+}
+
+func TestHttpImageSourceCanceled(t *testing.T) {
+	canceled := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(canceled)
+	}))
+	defer ts.Close()
+
+	source := NewHTTPImageSource(&SourceConfig{})
+	r, _ := http.NewRequest(http.MethodGet, "http://foo/bar?url="+ts.URL, nil)
+	ctx, cancel := context.WithTimeout(r.Context(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := source.GetImage(ctx, r); err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded error: %v", err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("The origin request must be canceled")
+	}
+}
+
+func TestHttpImageSourceLastModified(t *testing.T) {
+	buf, _ := ioutil.ReadFile(fixtureImage)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Last-Modified", "Wed, 01 Jan 2020 10:00:00 GMT")
+		_, _ = w.Write(buf)
+	}))
+	defer ts.Close()
+
+	source := NewHTTPImageSource(&SourceConfig{})
+	r, _ := http.NewRequest(http.MethodGet, "http://foo/bar?url="+ts.URL, nil)
+	_, meta, err := source.(ImageMetadataSource).GetImageWithMetadata(r.Context(), r)
+	if err != nil {
+		t.Fatalf("Error while fetching the image: %s", err)
+	}
+
+	expected := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	if !meta.LastModified.Equal(expected) {
+		t.Fatalf("Invalid last modified time: %s", meta.LastModified)
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const ImageSourceTypeS3 ImageSourceType = "s3"
+const S3BucketQueryKey = "bucket"
+const S3ObjectQueryKey = "object"
+
+const (
+	s3Algorithm        = "AWS4-HMAC-SHA256"
+	s3Service          = "s3"
+	s3DefaultRegion    = "us-east-1"
+	s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	s3AmzDateFormat    = "20060102T150405Z"
+	s3ShortDateFormat  = "20060102"
+)
+
+// S3Options defines the S3-compatible object storage image source settings.
+type S3Options struct {
+	Enabled      bool
+	Endpoint     string
+	Region       string
+	Bucket       string
+	PathStyle    bool
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	// AllowedBuckets restricts the buckets defined by the bucket param. The default bucket is always allowed.
+	AllowedBuckets []string
+}
+
+// S3Credentials stores the credentials used to sign requests with AWS Signature Version 4.
+type S3Credentials struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+type S3ImageSource struct {
+	Config *SourceConfig
+}
+
+func NewS3ImageSource(config *SourceConfig) ImageSource {
+	return &S3ImageSource{config}
+}
+
+func (s *S3ImageSource) Matches(r *http.Request) bool {
+	if r.Method != http.MethodGet || !s.Config.S3.Enabled {
+		return false
+	}
+	bucket, key := s.getObjectParams(r)
+	return bucket != "" && key != ""
+}
+
+func (s *S3ImageSource) GetImage(ctx context.Context, req *http.Request) ([]byte, error) {
+	buf, _, err := s.GetImageWithMetadata(ctx, req)
+	return buf, err
+}
+
+// GetImageWithMetadata fetches the object, exposing its Last-Modified header.
+func (s *S3ImageSource) GetImageWithMetadata(ctx context.Context, req *http.Request) ([]byte, ImageSourceMetadata, error) {
+	bucket, key := s.getObjectParams(req)
+	if key == "" {
+		return nil, ImageSourceMetadata{}, ErrMissingParamObject
+	}
+	if bucket == "" {
+		return nil, ImageSourceMetadata{}, ErrMissingParamBucket
+	}
+	if err := s.checkBucket(bucket); err != nil {
+		return nil, ImageSourceMetadata{}, err
+	}
+
+	u, err := s.objectURL(bucket, key)
+	if err != nil {
+		return nil, ImageSourceMetadata{}, err
+	}
+	return s.fetchObject(ctx, u, bucket, key)
+}
+
+func (s *S3ImageSource) fetchObject(ctx context.Context, u *url.URL, bucket, key string) ([]byte, ImageSourceMetadata, error) {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	req.Header.Set("User-Agent", "imaginary/"+Version)
+
+	creds := S3Credentials{
+		AccessKey:    s.Config.S3.AccessKey,
+		SecretKey:    s.Config.S3.SecretKey,
+		SessionToken: s.Config.S3.SessionToken,
+	}
+	if creds.AccessKey != "" && creds.SecretKey != "" {
+		signS3Request(req, creds, s.region(), time.Now())
+	}
+
+	res, err := s.Config.Client().Do(req)
+	if err != nil {
+		return nil, ImageSourceMetadata{}, NewOriginError("fetching S3 object", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, ImageSourceMetadata{}, NewError(fmt.Sprintf("error fetching S3 object: (status=%d) (bucket=%s) (key=%s)", res.StatusCode, bucket, key), originStatusCode(res.StatusCode))
+	}
+
+	if exceedsMaxSize(res.ContentLength, s.Config.MaxAllowedSize) {
+		return nil, ImageSourceMetadata{}, ErrMaxAllowedSize
+	}
+
+	buf, err := readWithLimit(res.Body, s.Config.MaxAllowedSize)
+	if err != nil {
+		return nil, ImageSourceMetadata{}, NewOriginError(fmt.Sprintf("reading S3 object body (bucket=%s) (key=%s)", bucket, key), err)
+	}
+
+	lastModified, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	return buf, ImageSourceMetadata{LastModified: lastModified}, nil
+}
+
+// objectURL builds the object URL using either path-style or virtual-hosted-style addressing.
+func (s *S3ImageSource) objectURL(bucket, key string) (*url.URL, error) {
+	endpoint := s.Config.S3.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s.region())
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, NewError("Invalid S3 endpoint: "+endpoint, http.StatusInternalServerError)
+	}
+
+	basePath := strings.TrimSuffix(u.Path, "/")
+	if s.Config.S3.PathStyle {
+		u.Path = basePath + "/" + bucket + "/" + key
+	} else {
+		u.Host = bucket + "." + u.Host
+		u.Path = basePath + "/" + key
+	}
+	u.RawPath = s3URIEncode(u.Path, false)
+	u.RawQuery = ""
+
+	return u, nil
+}
+
+// checkBucket validates the bucket name, which becomes part of the host name with virtual-hosted-style addressing.
+func (s *S3ImageSource) checkBucket(bucket string) error {
+	if !isValidS3BucketName(bucket) {
+		return ErrInvalidBucketName
+	}
+	if len(s.Config.S3.AllowedBuckets) == 0 || bucket == s.Config.S3.Bucket {
+		return nil
+	}
+	for _, allowed := range s.Config.S3.AllowedBuckets {
+		if bucket == allowed {
+			return nil
+		}
+	}
+	return ErrBucketNotAllowed
+}
+
+func (s *S3ImageSource) region() string {
+	if s.Config.S3.Region != "" {
+		return s.Config.S3.Region
+	}
+	return s3DefaultRegion
+}
+
+func (s *S3ImageSource) getObjectParams(r *http.Request) (bucket, key string) {
+	query := r.URL.Query()
+	bucket = query.Get(S3BucketQueryKey)
+	if bucket == "" {
+		bucket = s.Config.S3.Bucket
+	}
+	key = strings.TrimLeft(query.Get(S3ObjectQueryKey), "/")
+	return bucket, key
+}
+
+// isValidS3BucketName checks the bucket name against the S3 bucket naming rules:
+// 3 to 63 lowercase letters, numbers, dots and hyphens, starting and ending with a letter or number,
+// without adjacent dots and not formatted as an IP address.
+func isValidS3BucketName(bucket string) bool {
+	if len(bucket) < 3 || len(bucket) > 63 || net.ParseIP(bucket) != nil || strings.Contains(bucket, "..") {
+		return false
+	}
+	for i := 0; i < len(bucket); i++ {
+		c := bucket[i]
+		alnum := (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9')
+		if !alnum && (i == 0 || i == len(bucket)-1 || (c != '.' && c != '-')) {
+			return false
+		}
+	}
+	return true
+}
+
+// signS3Request signs the given request in place using AWS Signature Version 4.
+// Only the host, range, content and x-amz-* headers are covered by the signature.
+func signS3Request(req *http.Request, creds S3Credentials, region string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format(s3AmzDateFormat)
+	shortDate := now.Format(s3ShortDateFormat)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if req.Header.Get("X-Amz-Content-Sha256") == "" {
+		req.Header.Set("X-Amz-Content-Sha256", s3EmptyPayloadHash)
+	}
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	signedHeaders, canonicalHeaders := s3CanonicalHeaders(req)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3URIEncode(req.URL.Path, false),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+
+	scope := strings.Join([]string{shortDate, region, s3Service, "aws4_request"}, "/")
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{s3Algorithm, amzDate, scope, hex.EncodeToString(hash[:])}, "\n")
+
+	key := s3HMAC([]byte("AWS4"+creds.SecretKey), shortDate)
+	key = s3HMAC(key, region)
+	key = s3HMAC(key, s3Service)
+	key = s3HMAC(key, "aws4_request")
+	signature := hex.EncodeToString(s3HMAC(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, creds.AccessKey, scope, signedHeaders, signature))
+}
+
+func s3CanonicalHeaders(req *http.Request) (signed string, canonical string) {
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "range" || strings.HasPrefix(name, "content-") || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name + ":" + headers[name] + "\n")
+	}
+	return strings.Join(names, ";"), b.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, s3URIEncode(key, true)+"="+s3URIEncode(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// s3URIEncode encodes every byte except the unreserved characters, as required by SigV4.
+func s3URIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3HTTPClient returns the HTTP client of the S3 source. The endpoint configured by the operator
+// is trusted, so it gets its own client exempted from the SSRF protection, such as a local MinIO server.
+func s3HTTPClient(o ServerOptions, client *HTTPClient) *HTTPClient {
+	if o.S3.Endpoint == "" || !o.HTTPClient.SSRFProtection {
+		return client
+	}
+	opts := o.HTTPClient
+	opts.SSRFProtection = false
+	return NewHTTPClient(opts)
+}
+
+// getS3Options returns the S3 options, using the standard AWS environment variables as fallback.
+func getS3Options(o S3Options) S3Options {
+	if o.Region == "" {
+		o.Region = os.Getenv("AWS_REGION")
+	}
+	if o.AccessKey == "" {
+		o.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if o.SecretKey == "" {
+		o.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if o.SessionToken == "" {
+		o.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	return o
+}
+
+func init() {
+	RegisterSource(ImageSourceTypeS3, NewS3ImageSource)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
 )
@@ -15,3 +16,65 @@ func TestMatchSource(t *testing.T) {
 		t.Error("Cannot match image source")
 	}
 }
+
+func TestMatchSourcePrecedence(t *testing.T) {
+	defer LoadSources(ServerOptions{})
+
+	u, _ := url.Parse("http://foo?file=large.jpg&url=http://bar/image.jpg")
+	req := &http.Request{Method: http.MethodGet, URL: u}
+
+	cases := []struct {
+		sources  []ImageSourceType
+		disabled []ImageSourceType
+		expected ImageSourceType
+	}{
+		{nil, nil, ImageSourceTypeFileSystem},
+		{[]ImageSourceType{ImageSourceTypeHTTP, ImageSourceTypeFileSystem}, nil, ImageSourceTypeHTTP},
+		{nil, []ImageSourceType{ImageSourceTypeFileSystem}, ImageSourceTypeHTTP},
+		{[]ImageSourceType{ImageSourceTypeBody}, nil, ""},
+	}
+
+	for _, test := range cases {
+		LoadSources(ServerOptions{Sources: test.sources, DisabledSources: test.disabled})
+
+		// Run multiple times to ensure the resolution is deterministic
+		for i := 0; i < 10; i++ {
+			name, _ := matchSource(req)
+			if name != test.expected {
+				t.Fatalf("Invalid matched source: %q != %q", name, test.expected)
+			}
+		}
+	}
+}
+
+func TestSourceOrder(t *testing.T) {
+	order := sourceOrder([]ImageSourceType{"http", "unknown", "http", "fs"}, []ImageSourceType{"fs"})
+	if len(order) != 1 || order[0] != ImageSourceTypeHTTP {
+		t.Fatalf("Invalid source order: %v", order)
+	}
+
+	order = sourceOrder(nil, nil)
+	for i, name := range defaultSourceOrder {
+		if order[i] != name {
+			t.Fatalf("Invalid default source order: %v", order)
+		}
+	}
+}
+
+func TestImageSourceHeader(t *testing.T) {
+	opts := ServerOptions{Mount: "testdata"}
+	LoadSources(opts)
+	defer LoadSources(ServerOptions{})
+
+	ts := httptest.NewServer(ImageMiddleware(opts)(Crop))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "?width=200&file=missing.jpg")
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+
+	if res.Header.Get(ImageSourceHeader) != string(ImageSourceTypeFileSystem) {
+		t.Fatalf("Invalid image source header: %q", res.Header.Get(ImageSourceHeader))
+	}
+}
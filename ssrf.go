@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+// reservedNetworks lists additional non-public IPv4 ranges not covered by the net.IP helpers.
+var reservedNetworks = mustParseNetworks("0.0.0.0/8,100.64.0.0/10,240.0.0.0/4")
+
+// SSRFGuard prevents outbound requests to loopback, private, link-local and multicast
+// IP addresses, unless they belong to an explicitly allowed network.
+type SSRFGuard struct {
+	AllowedNetworks []*net.IPNet
+}
+
+// IsAllowedIP returns true if the given IP address can be dialed.
+func (g *SSRFGuard) IsAllowedIP(ip net.IP) bool {
+	for _, network := range g.AllowedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, network := range reservedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Control validates the resolved address right before dialing. It is meant to be used as net.Dialer.Control,
+// so every connection is validated, including the ones performed after following redirects.
+func (g *SSRFGuard) Control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !g.IsAllowedIP(ip) {
+		return ErrRemoteAddressNotAllowed
+	}
+	return nil
+}
+
+// CheckURL validates the URL scheme and every IP address its host resolves to.
+func (g *SSRFGuard) CheckURL(ctx context.Context, u *url.URL) error {
+	if err := checkURLScheme(u); err != nil {
+		return err
+	}
+
+	host := u.Hostname()
+	if ip := net.ParseIP(host); ip != nil {
+		if !g.IsAllowedIP(ip) {
+			return ErrRemoteAddressNotAllowed
+		}
+		return nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if !g.IsAllowedIP(addr.IP) {
+			return ErrRemoteAddressNotAllowed
+		}
+	}
+	return nil
+}
+
+func checkURLScheme(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ErrInvalidURLScheme
+	}
+	return nil
+}
+
+// parseNetworks parses a comma separated list of CIDR networks or single IP addresses.
+func parseNetworks(input string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, value := range strings.Split(input, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address: %s", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network: %s", value)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func mustParseNetworks(input string) []*net.IPNet {
+	networks, err := parseNetworks(input)
+	if err != nil {
+		panic(err)
+	}
+	return networks
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestSSRFGuardIsAllowedIP(t *testing.T) {
+	guard := &SSRFGuard{AllowedNetworks: mustParseNetworks("10.1.0.0/16,::1")}
+
+	cases := []struct {
+		ip       string
+		expected bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"10.0.0.1", false},
+		{"10.1.2.3", true},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+		{"100.64.0.1", false},
+		{"::1", true},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"::ffff:127.0.0.1", false},
+	}
+
+	for _, test := range cases {
+		if guard.IsAllowedIP(net.ParseIP(test.ip)) != test.expected {
+			t.Errorf("Invalid result for %s: expected %t", test.ip, test.expected)
+		}
+	}
+}
+
+func TestSSRFGuardCheckURL(t *testing.T) {
+	guard := &SSRFGuard{}
+
+	cases := []struct {
+		url      string
+		expected error
+	}{
+		{"file:///etc/passwd", ErrInvalidURLScheme},
+		{"gopher://127.0.0.1", ErrInvalidURLScheme},
+		{"http://169.254.169.254/latest/meta-data", ErrRemoteAddressNotAllowed},
+		{"http://[::1]:8080/", ErrRemoteAddressNotAllowed},
+		{"https://93.184.216.34/image.jpg", nil},
+	}
+
+	for _, test := range cases {
+		u, _ := url.Parse(test.url)
+		if err := guard.CheckURL(context.Background(), u); err != test.expected {
+			t.Errorf("Invalid result for %s: %v", test.url, err)
+		}
+	}
+}
+
+func TestSSRFGuardControl(t *testing.T) {
+	guard := &SSRFGuard{}
+	if err := guard.Control("tcp", "127.0.0.1:80", nil); err != ErrRemoteAddressNotAllowed {
+		t.Errorf("Expected loopback address to be rejected: %v", err)
+	}
+	if err := guard.Control("tcp", "93.184.216.34:443", nil); err != nil {
+		t.Errorf("Expected public address to be allowed: %v", err)
+	}
+}
+
+func TestHttpImageSourceSSRFProtection(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data", http.StatusFound)
+			return
+		}
+		_, _ = w.Write([]byte("image"))
+	}))
+	defer ts.Close()
+
+	cases := []struct {
+		url      string
+		networks string
+		expected int
+	}{
+		{ts.URL, "", http.StatusForbidden},
+		{ts.URL, "127.0.0.0/8,::1", 0},
+		{ts.URL + "/redirect", "127.0.0.0/8,::1", http.StatusForbidden},
+	}
+
+	for _, test := range cases {
+		client := NewHTTPClient(HTTPClientOptions{SSRFProtection: true, AllowedNetworks: mustParseNetworks(test.networks)})
+		source := NewHTTPImageSource(&SourceConfig{HTTPClient: client})
+
+		r, _ := http.NewRequest(http.MethodGet, "http://foo/bar?url="+url.QueryEscape(test.url), nil)
+		_, err := source.GetImage(r.Context(), r)
+		if test.expected == 0 {
+			if err != nil {
+				t.Errorf("Unexpected error for %s: %s", test.url, err)
+			}
+			continue
+		}
+
+		xerr, ok := err.(Error)
+		if !ok || xerr.HTTPCode() != test.expected {
+			t.Errorf("Invalid error for %s: %v", test.url, err)
+		}
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := parseNetworks("10.0.0.0/8, 127.0.0.1,::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(networks) != 3 || networks[1].String() != "127.0.0.1/32" || networks[2].String() != "::1/128" {
+		t.Fatalf("Invalid networks: %v", networks)
+	}
+
+	if _, err := parseNetworks("10.0.0.0/33"); err == nil {
+		t.Fatal("Expected error for invalid network")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RequestTimeoutHeader defines the request header to set a deadline for processing the request,
+// either in seconds or as a duration, such as "2.5" or "2500ms".
+const RequestTimeoutHeader = "X-Request-Timeout"
+
+// StatusClientClosedRequest defines the non-standard status code logged when the client
+// closes the connection before the response is written.
+const StatusClientClosedRequest = 499
+
+// requestTimeout aborts the source fetch and the image processing once the request deadline
+// defined by the client is exceeded.
+func requestTimeout(next http.Handler, o ServerOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := r.Header.Get(RequestTimeoutHeader)
+		if value == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		timeout, err := parseRequestTimeout(value)
+		if err != nil {
+			ErrorReply(r, w, ErrInvalidRequestTimeout, o)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// parseRequestTimeout parses a positive timeout in seconds or as a duration.
+func parseRequestTimeout(value string) (time.Duration, error) {
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, serr := strconv.ParseFloat(value, 64)
+		if serr != nil {
+			return 0, err
+		}
+		timeout = time.Duration(seconds * float64(time.Second))
+	}
+	if timeout <= 0 {
+		return 0, ErrInvalidRequestTimeout
+	}
+	return timeout, nil
+}
+
+// requestContextError returns the error to reply if the request was aborted,
+// either because its deadline was exceeded or the client went away.
+func requestContextError(r *http.Request) (Error, bool) {
+	switch r.Context().Err() {
+	case context.DeadlineExceeded:
+		return ErrRequestTimeout, true
+	case context.Canceled:
+		return ErrRequestCanceled, true
+	}
+	return Error{}, false
+}
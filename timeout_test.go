@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRequestTimeout(t *testing.T) {
+	cases := map[string]time.Duration{
+		"2":      2 * time.Second,
+		"0.5":    500 * time.Millisecond,
+		"2500ms": 2500 * time.Millisecond,
+		"1m":     time.Minute,
+	}
+	for value, expected := range cases {
+		if timeout, err := parseRequestTimeout(value); err != nil || timeout != expected {
+			t.Errorf("Invalid timeout of %s: %s %v", value, timeout, err)
+		}
+	}
+
+	for _, value := range []string{"foo", "0", "-1", "-1s", "5x"} {
+		if _, err := parseRequestTimeout(value); err == nil {
+			t.Errorf("Invalid timeout must be rejected: %s", value)
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	var deadline time.Time
+	handler := requestTimeout(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline, _ = r.Context().Deadline()
+	}), ServerOptions{})
+
+	req := httptest.NewRequest(http.MethodGet, "/resize", nil)
+	req.Header.Set(RequestTimeoutHeader, "2")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if remaining := time.Until(deadline); remaining <= time.Second || remaining > 2*time.Second {
+		t.Fatalf("Invalid request deadline: %s", remaining)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/resize", nil)
+	req.Header.Set(RequestTimeoutHeader, "foo")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Invalid response status: %d", w.Code)
+	}
+}
+
+func TestImageHandlerRequestTimeout(t *testing.T) {
+	op := func(buf []byte, opts ImageOptions) (Image, error) {
+		<-opts.Context().Done()
+		return Image{}, opts.Context().Err()
+	}
+
+	buf, _ := ioutil.ReadFile("testdata/large.jpg")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodGet, "/resize?width=300&height=200", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	imageHandler(w, req, buf, ImageSourceMetadata{}, op, ServerOptions{})
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("Invalid response status: %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// W3C Trace Context headers
+const (
+	TraceParentHeader = "traceparent"
+	TraceStateHeader  = "tracestate"
+)
+
+// Supported tracing exporters
+const (
+	TracingExporterOTLP   = "otlp"
+	TracingExporterStdout = "stdout"
+	TracingExporterFile   = "file"
+)
+
+const (
+	tracingQueueSize     = 2048
+	tracingBatchSize     = 512
+	tracingFlushInterval = 5 * time.Second
+)
+
+// SpanKind defines the span kind, using the OpenTelemetry values.
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// TracingOptions defines the distributed tracing settings.
+type TracingOptions struct {
+	Exporter    string
+	Endpoint    string
+	File        string
+	ServiceName string
+	SampleRatio float64
+}
+
+// tracer records the request spans, if tracing is enabled.
+var tracer *Tracer
+
+type spanContextKey struct{}
+
+// TraceID and SpanID identify traces and spans, as defined by W3C Trace Context.
+type TraceID [16]byte
+type SpanID [8]byte
+
+// SpanContext identifies a span across process boundaries.
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Sampled    bool
+	TraceState string
+	Remote     bool
+}
+
+// IsValid returns true if both trace and span IDs are defined.
+func (c SpanContext) IsValid() bool {
+	return c.TraceID != TraceID{} && c.SpanID != SpanID{}
+}
+
+// Span represents a single operation within a trace.
+// Every method is safe to be called on a nil span, which is used when tracing is disabled.
+type Span struct {
+	tracer     *Tracer
+	Name       string
+	Kind       SpanKind
+	Context    SpanContext
+	ParentID   SpanID
+	Start      time.Time
+	End        time.Time
+	Attributes []SpanAttribute
+	Err        string
+	mutex      sync.Mutex
+	ended      bool
+}
+
+// SpanAttribute represents a span key-value attribute.
+type SpanAttribute struct {
+	Key   string
+	Value interface{}
+}
+
+// SetAttribute adds a key-value attribute to the span.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	s.Attributes = append(s.Attributes, SpanAttribute{key, value})
+	s.mutex.Unlock()
+}
+
+// RecordError marks the span as failed with the given error, if any.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mutex.Lock()
+	s.Err = err.Error()
+	s.mutex.Unlock()
+}
+
+// Finish ends the span, queueing it to be exported if sampled.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mutex.Unlock()
+
+	if s.Context.Sampled {
+		s.tracer.enqueue(s)
+	}
+}
+
+// SpanExporter sends batches of finished spans to a tracing backend.
+type SpanExporter interface {
+	ExportSpans(spans []*Span) error
+}
+
+// Tracer creates spans and exports them in batches in background.
+type Tracer struct {
+	exporter    SpanExporter
+	sampleRatio float64
+	queue       chan *Span
+	flush       chan chan struct{}
+	done        chan struct{}
+	stop        sync.Once
+}
+
+// NewTracer creates a new tracer exporting the sampled spans with the given exporter.
+func NewTracer(exporter SpanExporter, sampleRatio float64) *Tracer {
+	t := &Tracer{
+		exporter:    exporter,
+		sampleRatio: sampleRatio,
+		queue:       make(chan *Span, tracingQueueSize),
+		flush:       make(chan chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// LoadTracer creates the tracer with the configured exporter, if tracing is enabled.
+func LoadTracer(o ServerOptions) error {
+	tracer = nil
+
+	var exporter SpanExporter
+	switch o.Tracing.Exporter {
+	case "":
+		return nil
+	case TracingExporterOTLP:
+		exporter = NewOTLPExporter(o.Tracing.Endpoint, o.Tracing.ServiceName)
+	case TracingExporterStdout:
+		exporter = NewWriterExporter(stdoutWriter{})
+	case TracingExporterFile:
+		writer, err := newFileWriter(o.Tracing.File)
+		if err != nil {
+			return err
+		}
+		exporter = NewWriterExporter(writer)
+	default:
+		return fmt.Errorf("unsupported tracing exporter: %s", o.Tracing.Exporter)
+	}
+
+	tracer = NewTracer(exporter, o.Tracing.SampleRatio)
+	return nil
+}
+
+// Shutdown exports the pending spans and stops the tracer.
+func (t *Tracer) Shutdown(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	t.stop.Do(func() {
+		defer close(t.done)
+
+		done := make(chan struct{})
+		select {
+		case t.flush <- done:
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	})
+}
+
+func (t *Tracer) enqueue(span *Span) {
+	// Drop the span rather than blocking the request if the exporter is lagging behind
+	select {
+	case t.queue <- span:
+	default:
+		metrics.AddDroppedSpans("queue_full", 1)
+	}
+}
+
+func (t *Tracer) run() {
+	ticker := time.NewTicker(tracingFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	var failing bool
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		// Only the first failure is logged until the exporter recovers, to not flood the logs
+		if err := t.exporter.ExportSpans(batch); err != nil {
+			metrics.AddDroppedSpans("export_error", len(batch))
+			if !failing {
+				log.Printf("Cannot export tracing spans, dropping them until the exporter recovers: %s", err)
+			}
+			failing = true
+		} else {
+			failing = false
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) >= tracingBatchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case done := <-t.flush:
+			for len(t.queue) > 0 {
+				batch = append(batch, <-t.queue)
+			}
+			export()
+			close(done)
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// StartSpan starts a new span as child of the span stored in the context, if any.
+// It returns the context unchanged and a nil span if tracing is disabled.
+func StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+
+	parent, _ := ctx.Value(spanContextKey{}).(SpanContext)
+	span := &Span{
+		tracer: tracer,
+		Name:   name,
+		Kind:   kind,
+		Start:  time.Now(),
+	}
+
+	if parent.IsValid() {
+		span.Context = SpanContext{TraceID: parent.TraceID, Sampled: parent.Sampled, TraceState: parent.TraceState}
+		span.ParentID = parent.SpanID
+	} else {
+		span.Context = SpanContext{TraceID: newTraceID(), Sampled: tracer.shouldSample()}
+	}
+	span.Context.SpanID = newSpanID()
+
+	return context.WithValue(ctx, spanContextKey{}, span.Context), span
+}
+
+func (t *Tracer) shouldSample() bool {
+	if t.sampleRatio >= 1 {
+		return true
+	}
+	if t.sampleRatio <= 0 {
+		return false
+	}
+	var buf [8]byte
+	_, _ = rand.Read(buf[:])
+	return float64(binary.BigEndian.Uint64(buf[:])>>11)/(1<<53) < t.sampleRatio
+}
+
+// extractTraceContext returns a copy of the context storing the remote span context
+// received in the W3C traceparent request header, if valid.
+func extractTraceContext(ctx context.Context, r *http.Request) context.Context {
+	sc, ok := parseTraceParent(r.Header.Get(TraceParentHeader))
+	if !ok {
+		return ctx
+	}
+	sc.TraceState = r.Header.Get(TraceStateHeader)
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// injectTraceContext sets the W3C traceparent header of an outbound request
+// from the span stored in the context, if any.
+func injectTraceContext(ctx context.Context, req *http.Request) {
+	if tracer == nil {
+		return
+	}
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	if !ok || !sc.IsValid() {
+		return
+	}
+
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	req.Header.Set(TraceParentHeader, fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), flags))
+	if sc.TraceState != "" {
+		req.Header.Set(TraceStateHeader, sc.TraceState)
+	}
+}
+
+// parseTraceParent parses a W3C traceparent header, such as 00-<trace-id>-<span-id>-<flags>.
+func parseTraceParent(header string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+
+	version, err := hex.DecodeString(parts[0])
+	if err != nil || len(version) != 1 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil || parts[1] != strings.ToLower(parts[1]) {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil || parts[2] != strings.ToLower(parts[2]) {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, false
+	}
+
+	sc.Sampled = flags[0]&0x01 == 0x01
+	sc.Remote = true
+	return sc, sc.IsValid()
+}
+
+// traceHandler starts the server span of every request, named by the matched route pattern.
+func traceHandler(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tracer == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		_, route := mux.Handler(r)
+		ctx := extractTraceContext(r.Context(), r)
+		ctx, span := StartSpan(ctx, r.Method+" "+route, SpanKindServer)
+		defer span.Finish()
+
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.route", route)
+		span.SetAttribute("http.target", r.URL.RequestURI())
+		span.SetAttribute("imaginary.request_id", requestInfoFrom(r.Context()).ID)
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		span.SetAttribute("http.status_code", recorder.status)
+		if recorder.status >= http.StatusInternalServerError {
+			span.RecordError(fmt.Errorf("HTTP %d", recorder.status))
+		}
+	})
+}
+
+// traceSpan wraps the handler in a span with the given name.
+func traceSpan(name string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := StartSpan(r.Context(), name, SpanKindInternal)
+		defer span.Finish()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func newTraceID() (id TraceID) {
+	_, _ = rand.Read(id[:])
+	return id
+}
+
+func newSpanID() (id SpanID) {
+	_, _ = rand.Read(id[:])
+	return id
+}
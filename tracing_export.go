@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultOTLPEndpoint is the default OTLP/HTTP traces endpoint of a local collector.
+const DefaultOTLPEndpoint = "http://localhost:4318/v1/traces"
+
+// OTLPExporter sends spans to an OpenTelemetry collector using the OTLP/HTTP protocol with JSON encoding.
+type OTLPExporter struct {
+	endpoint    string
+	serviceName string
+	client      *http.Client
+}
+
+// NewOTLPExporter creates a new OTLP/HTTP exporter sending spans to the given traces endpoint.
+func NewOTLPExporter(endpoint, serviceName string) *OTLPExporter {
+	if endpoint == "" {
+		endpoint = DefaultOTLPEndpoint
+	}
+	return &OTLPExporter{
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// ExportSpans sends the spans in a single export request.
+func (e *OTLPExporter) ExportSpans(spans []*Span) error {
+	body, err := json.Marshal(newOTLPRequest(e.serviceName, spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "imaginary/"+Version)
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("cannot export spans: (status=%d)", res.StatusCode)
+	}
+	return nil
+}
+
+// OTLP/HTTP JSON encoding of the ExportTraceServiceRequest message
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	TraceState        string          `json:"traceState,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func newOTLPRequest(serviceName string, spans []*Span) otlpRequest {
+	if serviceName == "" {
+		serviceName = "imaginary"
+	}
+
+	out := make([]otlpSpan, len(spans))
+	for i, span := range spans {
+		out[i] = newOTLPSpan(span)
+	}
+
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			newOTLPAttribute("service.name", serviceName),
+			newOTLPAttribute("service.version", Version),
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "imaginary", Version: Version},
+			Spans: out,
+		}},
+	}}}
+}
+
+func newOTLPSpan(span *Span) otlpSpan {
+	span.mutex.Lock()
+	defer span.mutex.Unlock()
+
+	out := otlpSpan{
+		TraceID:           hex.EncodeToString(span.Context.TraceID[:]),
+		SpanID:            hex.EncodeToString(span.Context.SpanID[:]),
+		TraceState:        span.Context.TraceState,
+		Name:              span.Name,
+		Kind:              span.Kind,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+	}
+	if span.ParentID != (SpanID{}) {
+		out.ParentSpanID = hex.EncodeToString(span.ParentID[:])
+	}
+	for _, attr := range span.Attributes {
+		out.Attributes = append(out.Attributes, newOTLPAttribute(attr.Key, attr.Value))
+	}
+	if span.Err != "" {
+		out.Status = otlpStatus{Code: 2, Message: span.Err}
+	}
+	return out
+}
+
+func newOTLPAttribute(key string, value interface{}) otlpAttribute {
+	var v map[string]interface{}
+	switch value := value.(type) {
+	case string:
+		v = map[string]interface{}{"stringValue": value}
+	case bool:
+		v = map[string]interface{}{"boolValue": value}
+	case int:
+		v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+	case int64:
+		v = map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+	case float64:
+		v = map[string]interface{}{"doubleValue": value}
+	default:
+		v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+	}
+	return otlpAttribute{Key: key, Value: v}
+}
+
+// WriterExporter writes every span as a JSON line, meant for local testing.
+type WriterExporter struct {
+	mutex sync.Mutex
+	out   io.Writer
+}
+
+// NewWriterExporter creates a new exporter writing the spans to the given stream.
+func NewWriterExporter(out io.Writer) *WriterExporter {
+	return &WriterExporter{out: out}
+}
+
+// writerSpan represents the JSON line of an exported span.
+type writerSpan struct {
+	TraceID      string                 `json:"traceId"`
+	SpanID       string                 `json:"spanId"`
+	ParentSpanID string                 `json:"parentSpanId,omitempty"`
+	Name         string                 `json:"name"`
+	Kind         SpanKind               `json:"kind"`
+	Start        time.Time              `json:"start"`
+	Duration     float64                `json:"duration"`
+	Attributes   map[string]interface{} `json:"attributes,omitempty"`
+	Error        string                 `json:"error,omitempty"`
+}
+
+// ExportSpans writes the spans, one JSON object per line.
+func (e *WriterExporter) ExportSpans(spans []*Span) error {
+	var buf bytes.Buffer
+	for _, span := range spans {
+		otlp := newOTLPSpan(span)
+		line := writerSpan{
+			TraceID:      otlp.TraceID,
+			SpanID:       otlp.SpanID,
+			ParentSpanID: otlp.ParentSpanID,
+			Name:         span.Name,
+			Kind:         span.Kind,
+			Start:        span.Start.UTC(),
+			Duration:     span.End.Sub(span.Start).Seconds(),
+			Error:        otlp.Status.Message,
+		}
+		if len(span.Attributes) > 0 {
+			line.Attributes = make(map[string]interface{}, len(span.Attributes))
+			for _, attr := range span.Attributes {
+				line.Attributes[attr.Key] = attr.Value
+			}
+		}
+
+		data, err := json.Marshal(line)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(data, '\n'))
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	_, err := e.out.Write(buf.Bytes())
+	return err
+}
+
+type stdoutWriter struct{}
+
+func (stdoutWriter) Write(p []byte) (int, error) {
+	return os.Stdout.Write(p)
+}
+
+func newFileWriter(file string) (io.Writer, error) {
+	if file == "" {
+		return nil, fmt.Errorf("missing tracing file path")
+	}
+	return os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+}
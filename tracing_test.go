@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testExporter struct {
+	mutex sync.Mutex
+	spans []*Span
+}
+
+func (e *testExporter) ExportSpans(spans []*Span) error {
+	e.mutex.Lock()
+	e.spans = append(e.spans, spans...)
+	e.mutex.Unlock()
+	return nil
+}
+
+type failingExporter struct {
+	calls int
+}
+
+func (e *failingExporter) ExportSpans(spans []*Span) error {
+	e.calls++
+	return errors.New("connection refused")
+}
+
+func withTestTracer(t *testing.T) *testExporter {
+	exporter := &testExporter{}
+	tracer = NewTracer(exporter, 1)
+	t.Cleanup(func() {
+		tracer.Shutdown(context.Background())
+		tracer = nil
+	})
+	return exporter
+}
+
+func TestParseTraceParent(t *testing.T) {
+	cases := []struct {
+		header  string
+		valid   bool
+		sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-foo", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-foo", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", false, false},
+		{"00-zzf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"", false, false},
+	}
+
+	for _, c := range cases {
+		sc, ok := parseTraceParent(c.header)
+		if ok != c.valid {
+			t.Errorf("Invalid traceparent validation: %s", c.header)
+			continue
+		}
+		if ok && sc.Sampled != c.sampled {
+			t.Errorf("Invalid traceparent sampled flag: %s", c.header)
+		}
+	}
+}
+
+func TestTraceContextPropagation(t *testing.T) {
+	withTestTracer(t)
+
+	in := httptest.NewRequest(http.MethodGet, "/resize", nil)
+	in.Header.Set(TraceParentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	in.Header.Set(TraceStateHeader, "foo=bar")
+
+	ctx, span := StartSpan(extractTraceContext(context.Background(), in), "test", SpanKindServer)
+	defer span.Finish()
+
+	out, _ := http.NewRequest(http.MethodGet, "http://foo/bar.jpg", nil)
+	injectTraceContext(ctx, out)
+
+	traceparent := out.Header.Get(TraceParentHeader)
+	if !strings.HasPrefix(traceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || !strings.HasSuffix(traceparent, "-01") {
+		t.Fatalf("Invalid propagated traceparent: %s", traceparent)
+	}
+	if strings.Contains(traceparent, "00f067aa0ba902b7") {
+		t.Fatal("The propagated traceparent must identify the current span")
+	}
+	if out.Header.Get(TraceStateHeader) != "foo=bar" {
+		t.Fatalf("Invalid propagated tracestate: %s", out.Header.Get(TraceStateHeader))
+	}
+}
+
+func TestStartSpanDisabled(t *testing.T) {
+	ctx, span := StartSpan(context.Background(), "test", SpanKindInternal)
+	if span != nil {
+		t.Fatal("No span must be created if tracing is disabled")
+	}
+	span.SetAttribute("foo", "bar")
+	span.Finish()
+
+	req, _ := http.NewRequest(http.MethodGet, "http://foo/bar.jpg", nil)
+	injectTraceContext(ctx, req)
+	if req.Header.Get(TraceParentHeader) != "" {
+		t.Fatal("Trace context must not be propagated if tracing is disabled")
+	}
+}
+
+func TestTraceHandler(t *testing.T) {
+	exporter := withTestTracer(t)
+
+	mux := http.NewServeMux()
+	mux.Handle("/resize", traceSpan("middleware", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, span := StartSpan(r.Context(), "child", SpanKindInternal)
+		span.Finish()
+		w.WriteHeader(http.StatusNotFound)
+	})))
+
+	req := httptest.NewRequest(http.MethodGet, "/resize?width=300", nil)
+	req.Header.Set(TraceParentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	traceHandler(mux, mux).ServeHTTP(httptest.NewRecorder(), req)
+	tracer.Shutdown(context.Background())
+
+	if len(exporter.spans) != 3 {
+		t.Fatalf("Invalid number of exported spans: %d", len(exporter.spans))
+	}
+
+	spans := map[string]*Span{}
+	for _, span := range exporter.spans {
+		spans[span.Name] = span
+		if span.Context.TraceID != exporter.spans[0].Context.TraceID {
+			t.Fatal("Every span must belong to the same trace")
+		}
+	}
+
+	server, middleware, child := spans["GET /resize"], spans["middleware"], spans["child"]
+	if server == nil || middleware == nil || child == nil {
+		t.Fatalf("Missing spans: %v", spans)
+	}
+	if server.Kind != SpanKindServer || server.ParentID != (SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7}) {
+		t.Fatal("The server span must continue the remote trace")
+	}
+	if middleware.ParentID != server.Context.SpanID || child.ParentID != middleware.Context.SpanID {
+		t.Fatal("Invalid spans hierarchy")
+	}
+
+	var status interface{}
+	for _, attr := range server.Attributes {
+		if attr.Key == "http.status_code" {
+			status = attr.Value
+		}
+	}
+	if status != http.StatusNotFound {
+		t.Fatalf("Invalid status code attribute: %v", status)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var body map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Invalid content type: %s", r.Header.Get("Content-Type"))
+		}
+		buf, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(buf, &body); err != nil {
+			t.Errorf("Invalid JSON body: %s", err)
+		}
+	}))
+	defer ts.Close()
+
+	span := &Span{
+		Name:     "image.process",
+		Kind:     SpanKindInternal,
+		Context:  SpanContext{TraceID: TraceID{1}, SpanID: SpanID{2}, Sampled: true},
+		ParentID: SpanID{3},
+		Start:    time.Unix(1, 0),
+		End:      time.Unix(2, 0),
+		Err:      "foo",
+	}
+	span.SetAttribute("imaginary.input.bytes", 1024)
+
+	if err := NewOTLPExporter(ts.URL, "foo").ExportSpans([]*Span{span}); err != nil {
+		t.Fatalf("Cannot export spans: %s", err)
+	}
+
+	resource := body["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	attrs, _ := json.Marshal(resource["resource"])
+	if !strings.Contains(string(attrs), `{"key":"service.name","value":{"stringValue":"foo"}}`) {
+		t.Fatalf("Invalid resource attributes: %s", attrs)
+	}
+
+	scope := resource["scopeSpans"].([]interface{})[0].(map[string]interface{})
+	exported, _ := json.Marshal(scope["spans"].([]interface{})[0])
+	expected := []string{
+		`"traceId":"01000000000000000000000000000000"`,
+		`"spanId":"0200000000000000"`,
+		`"parentSpanId":"0300000000000000"`,
+		`"startTimeUnixNano":"1000000000"`,
+		`"endTimeUnixNano":"2000000000"`,
+		`{"key":"imaginary.input.bytes","value":{"intValue":"1024"}}`,
+		`"status":{"code":2,"message":"foo"}`,
+	}
+	for _, field := range expected {
+		if !strings.Contains(string(exported), field) {
+			t.Errorf("Missing exported span field %s: %s", field, exported)
+		}
+	}
+}
+
+func TestTracerExportErrors(t *testing.T) {
+	defer func(m *Metrics) { metrics = m }(metrics)
+	metrics = NewMetrics()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	exporter := &failingExporter{}
+	tracer = NewTracer(exporter, 1)
+	defer func() { tracer = nil }()
+
+	for i := 0; i < 3; i++ {
+		_, span := StartSpan(context.Background(), "foo", SpanKindInternal)
+		span.Finish()
+		_, span = StartSpan(context.Background(), "bar", SpanKindInternal)
+		span.Finish()
+
+		// Flush the pending spans as a single batch
+		done := make(chan struct{})
+		tracer.flush <- done
+		<-done
+	}
+	tracer.Shutdown(context.Background())
+
+	if exporter.calls != 3 {
+		t.Fatalf("Invalid number of exports: %d", exporter.calls)
+	}
+	if count := strings.Count(logs.String(), "Cannot export tracing spans"); count != 1 {
+		t.Fatalf("Only the first export error must be logged, got %d: %s", count, logs.String())
+	}
+
+	var b strings.Builder
+	_, _ = metrics.WriteTo(&b)
+	if line := `imaginary_tracing_spans_dropped_total{reason="export_error"} 6`; !strings.Contains(b.String(), line+"\n") {
+		t.Fatalf("Missing metric line: %s", line)
+	}
+}
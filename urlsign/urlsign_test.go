@@ -0,0 +1,79 @@
+package urlsign
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testKey = "4f46feebafc4b5e988f131c4ff8b5997"
+
+func TestSignature(t *testing.T) {
+	// Signature computed as documented in the imaginary README
+	query, _ := url.ParseQuery("width=300&type=jpeg&height=200&file=image.jpg")
+	if sign := Signature(testKey, "/resize", query, nil); sign != "ruEWRoFO-ic-L38vTsjqIYE6DLZ532CTaZXOh1gwuVo" {
+		t.Fatalf("Invalid URL signature: %s", sign)
+	}
+}
+
+func TestCanonicalQuery(t *testing.T) {
+	query, _ := url.ParseQuery("width=300&sign=foo&kid=2024a&url=http://foo/bar.jpg?a=b c&expires=1&foo=bar")
+
+	if q := CanonicalQuery(query, nil); q != "expires=1&foo=bar&kid=2024a&url=http%3A%2F%2Ffoo%2Fbar.jpg%3Fa%3Db+c&width=300" {
+		t.Fatalf("Invalid canonical query: %s", q)
+	}
+	if q := CanonicalQuery(query, []string{"width"}); q != "expires=1&kid=2024a&width=300" {
+		t.Fatalf("Invalid canonical query with covered params: %s", q)
+	}
+}
+
+func TestSignURL(t *testing.T) {
+	expires := time.Now().Add(time.Hour)
+	signed, err := SignURL("http://localhost:9000/resize?width=300&url=http://foo/bar.jpg", Options{Key: testKey, KeyID: "2024a", Expires: expires})
+	if err != nil {
+		t.Fatalf("Cannot sign URL: %s", err)
+	}
+	if !strings.HasPrefix(signed, "http://localhost:9000/resize?") {
+		t.Fatalf("Invalid signed URL: %s", signed)
+	}
+
+	u, _ := url.Parse(signed)
+	query := u.Query()
+	if query.Get(KeyIDParam) != "2024a" || query.Get(ExpiresParam) == "" || query.Get(SignatureParam) == "" {
+		t.Fatalf("Missing signature params: %s", signed)
+	}
+
+	verifier := Verifier{Keys: map[string]string{"2024a": testKey}}
+	if err := verifier.Verify(u.Path, query, time.Now()); err != nil {
+		t.Fatalf("Signed URL must be valid: %s", err)
+	}
+	if err := verifier.Verify(u.Path, query, expires.Add(time.Second)); err != ErrExpired {
+		t.Fatalf("Signed URL must expire: %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	verifier := Verifier{Key: testKey, Keys: map[string]string{"2024b": "1b8a9d6c7e2f4a30b5c6d7e8f9a0b1c2"}}
+	now := time.Now()
+
+	cases := []struct {
+		url string
+		err error
+	}{
+		{Sign("/resize", url.Values{"width": {"300"}}, Options{Key: testKey}), nil},
+		{Sign("/resize", url.Values{"width": {"300"}}, Options{Key: "1b8a9d6c7e2f4a30b5c6d7e8f9a0b1c2", KeyID: "2024b"}), nil},
+		{Sign("/resize", url.Values{"width": {"300"}}, Options{Key: testKey, KeyID: "2024c"}), ErrUnknownKey},
+		{Sign("/resize", url.Values{"width": {"300"}}, Options{Key: testKey}) + "&height=200", ErrMismatch},
+		{Sign("/resize", url.Values{"width": {"300"}, "expires": {"foo"}}, Options{Key: testKey}), ErrInvalidExpires},
+		{Sign("/resize", url.Values{"width": {"300"}}, Options{Key: testKey, Expires: now.Add(-time.Minute)}), ErrExpired},
+		{"/resize?width=300&sign=!!!", ErrInvalidSignature},
+	}
+
+	for _, c := range cases {
+		u, _ := url.Parse(c.url)
+		if err := verifier.Verify(u.Path, u.Query(), now); err != c.err {
+			t.Errorf("Invalid verification result of %s: %v", c.url, err)
+		}
+	}
+}